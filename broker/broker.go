@@ -0,0 +1,55 @@
+// Package broker is minimal interface of message broker with topics and
+// consumer groups, like Kafka, that collector can publish Pinba data to, and
+// its in-memory and file-backed implementations. Topics have one partition,
+// message keys are kept for brokers that partition by them
+package broker
+
+import (
+	"errors"
+)
+
+// Message is record of topic. Offset is set by broker, when message is
+// produced
+type Message struct {
+	Offset    int64
+	Timestamp int64
+	Key       []byte
+	Value     []byte
+}
+
+// Broker keeps messages of topics and offsets of consumer groups in them
+type Broker interface {
+	// Produce appends messages to topic, creating it if needed
+	Produce(topic string, messages ...Message) error
+	// Fetch returns up to max messages of topic starting at offset, or no
+	// messages if there is none yet
+	Fetch(topic string, offset int64, max int) ([]Message, error)
+	// Commit stores offset of the next message, that group should read from
+	// topic, and Committed returns it, zero if nothing was committed
+	Commit(group, topic string, offset int64) error
+	Committed(group, topic string) (int64, error)
+	Close() error
+}
+
+// ErrClosed is returned by methods of closed broker
+var ErrClosed = errors.New("broker is closed")
+
+// ErrInvalidTopic is returned for topic names, that can't be used
+var ErrInvalidTopic = errors.New("invalid topic name")
+
+// validName returns true for non-empty names of letters, digits, '.', '_'
+// and '-', so they are safe as file names
+func validName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
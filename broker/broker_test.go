@@ -0,0 +1,150 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testMessages(from, to int) []Message {
+	var messages []Message
+	for i := from; i < to; i++ {
+		messages = append(messages, Message{
+			Timestamp: 1500000000 + int64(i),
+			Key:       []byte(fmt.Sprintf("web%d", i%2)),
+			Value:     []byte(fmt.Sprintf("request %d", i)),
+		})
+	}
+	return messages
+}
+
+// testBroker checks behaviour common for all brokers
+func testBroker(t *testing.T, b Broker) {
+	messages, err := b.Fetch("pinba", 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	assert.NoError(t, b.Produce("pinba", testMessages(0, 3)...))
+	assert.NoError(t, b.Produce("pinba", testMessages(3, 5)...))
+	assert.NoError(t, b.Produce("other", testMessages(0, 1)...))
+	assert.Equal(t, ErrInvalidTopic, b.Produce("../pinba", testMessages(0, 1)...))
+
+	messages, err = b.Fetch("pinba", 1, 3)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 3)
+	for i, m := range messages {
+		expected := testMessages(i+1, i+2)[0]
+		expected.Offset = int64(i + 1)
+		assert.Equal(t, expected, m)
+	}
+
+	messages, err = b.Fetch("pinba", 3, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+	messages, err = b.Fetch("pinba", 5, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+	for _, max := range []int{0, -1} {
+		messages, err = b.Fetch("pinba", 1, max)
+		assert.NoError(t, err)
+		assert.Empty(t, messages)
+	}
+
+	// Groups read topic independently
+	first, err := NewConsumer(b, "first", "pinba")
+	assert.NoError(t, err)
+	second, err := NewConsumer(b, "second", "pinba")
+	assert.NoError(t, err)
+
+	messages, err = first.Poll(4)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 4)
+	assert.NoError(t, first.Commit())
+	messages, err = second.Poll(10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 5)
+
+	// Consumer resumes from committed offset, and can replay from start
+	first, err = NewConsumer(b, "first", "pinba")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, first.Offset())
+	messages, err = first.Poll(10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.EqualValues(t, 4, messages[0].Offset)
+	first.SeekOffset(0)
+	messages, err = first.Poll(10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 5)
+
+	offset, err := b.Committed("second", "pinba")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, offset)
+
+	assert.NoError(t, b.Close())
+	assert.Equal(t, ErrClosed, b.Produce("pinba", testMessages(0, 1)...))
+}
+
+func TestMemoryBroker(t *testing.T) {
+	testBroker(t, NewMemoryBroker())
+}
+
+func TestFileBroker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	b, err := NewFileBroker(dir)
+	assert.NoError(t, err)
+	testBroker(t, b)
+}
+
+func TestFileBrokerProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	producer, err := NewFileBroker(dir)
+	assert.NoError(t, err)
+	defer producer.Close()
+	consumer, err := NewFileBroker(dir)
+	assert.NoError(t, err)
+	defer consumer.Close()
+
+	// Consumer sees messages produced after it opened topic
+	assert.NoError(t, producer.Produce("pinba", testMessages(0, 2)...))
+	messages, err := consumer.Fetch("pinba", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+	assert.NoError(t, producer.Produce("pinba", testMessages(2, 3)...))
+	messages, err = consumer.Fetch("pinba", 2, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, []byte("request 2"), messages[0].Value)
+
+	// Incomplete record is not read, and is cut by the next producer
+	f, err := os.OpenFile(filepath.Join(dir, "pinba.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	f.Write([]byte{100, 0, 0, 0, 1, 2})
+	f.Close()
+	messages, err = consumer.Fetch("pinba", 3, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	restarted, err := NewFileBroker(dir)
+	assert.NoError(t, err)
+	defer restarted.Close()
+	assert.NoError(t, restarted.Produce("pinba", testMessages(3, 4)...))
+	messages, err = consumer.Fetch("pinba", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 4)
+	assert.EqualValues(t, 3, messages[3].Offset)
+	assert.Equal(t, []byte("request 3"), messages[3].Value)
+
+	_, err = NewConsumer(consumer, "../group", "pinba")
+	assert.Error(t, err)
+}
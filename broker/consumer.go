@@ -0,0 +1,49 @@
+package broker
+
+// Consumer reads topic on behalf of consumer group, from the offset group
+// committed. Every group has its own offset, so groups read the same
+// messages independently, and any of them can replay topic with SeekOffset
+type Consumer struct {
+	broker Broker
+	group  string
+	topic  string
+	offset int64
+}
+
+// NewConsumer creates consumer of topic, that starts at committed offset of
+// group
+func NewConsumer(broker Broker, group, topic string) (*Consumer, error) {
+	offset, err := broker.Committed(group, topic)
+	if err != nil {
+		return nil, err
+	}
+	return &Consumer{broker: broker, group: group, topic: topic, offset: offset}, nil
+}
+
+// Poll returns up to max next messages, or no messages if there is none
+// yet. They are read again after restart, until offset is committed
+func (c *Consumer) Poll(max int) ([]Message, error) {
+	messages, err := c.broker.Fetch(c.topic, c.offset, max)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > 0 {
+		c.offset = messages[len(messages)-1].Offset + 1
+	}
+	return messages, nil
+}
+
+// Commit stores offset of the next message for group
+func (c *Consumer) Commit() error {
+	return c.broker.Commit(c.group, c.topic, c.offset)
+}
+
+// SeekOffset moves consumer to given offset, zero replays topic from the start
+func (c *Consumer) SeekOffset(offset int64) {
+	c.offset = offset
+}
+
+// Offset returns offset of the next message
+func (c *Consumer) Offset() int64 {
+	return c.offset
+}
@@ -0,0 +1,244 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Every record of topic file is length of the rest of it, timestamp, length
+// of key, key and value. Integers are little endian
+const recordHeader = 4 + 8 + 4
+
+// fileTopic is log file of topic and positions of its records, offset of
+// message is index of its record
+type fileTopic struct {
+	file      *os.File
+	positions []int64
+	// size is end of the last complete record
+	size int64
+}
+
+// FileBroker keeps every topic in "<dir>/<topic>.log" and offsets of groups
+// in "<dir>/offsets/<group>/<topic>", so consumers in other processes can
+// read topics. Topic should have only one producer. There is no retention,
+// old files should be removed by cron
+type FileBroker struct {
+	dir string
+
+	mu     sync.Mutex
+	topics map[string]*fileTopic
+	closed bool
+}
+
+// NewFileBroker creates broker with topics in given directory
+func NewFileBroker(dir string) (*FileBroker, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "offsets"), 0755); err != nil {
+		return nil, err
+	}
+	return &FileBroker{dir: dir, topics: make(map[string]*fileTopic)}, nil
+}
+
+// topic returns opened topic, nil if it doesn't exist and create is false.
+// Records appended by other processes are indexed
+func (b *FileBroker) topic(name string, create bool) (*fileTopic, error) {
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if !validName(name) {
+		return nil, ErrInvalidTopic
+	}
+	t, ok := b.topics[name]
+	if !ok {
+		flags := os.O_RDWR | os.O_APPEND
+		if create {
+			flags |= os.O_CREATE
+		}
+		file, err := os.OpenFile(filepath.Join(b.dir, name+".log"), flags, 0644)
+		if os.IsNotExist(err) && !create {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		t = &fileTopic{file: file}
+		b.topics[name] = t
+	}
+	return t, t.scan()
+}
+
+// scan indexes complete records after the last known one
+func (t *fileTopic) scan() error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(t.file, t.size, info.Size()-t.size))
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil // EOF or incomplete record
+		}
+		n := int64(binary.LittleEndian.Uint32(length[:]))
+		if t.size+4+n > info.Size() {
+			return nil
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return err
+		}
+		t.positions = append(t.positions, t.size)
+		t.size += 4 + n
+	}
+}
+
+// Produce appends messages to topic file
+func (b *FileBroker) Produce(topic string, messages ...Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, err := b.topic(topic, true)
+	if err != nil {
+		return err
+	}
+
+	// Incomplete record of crashed producer is cut, so new ones are readable
+	if info, err := t.file.Stat(); err != nil {
+		return err
+	} else if info.Size() > t.size {
+		if err := t.file.Truncate(t.size); err != nil {
+			return err
+		}
+	}
+
+	var data []byte
+	positions := make([]int64, 0, len(messages))
+	for _, m := range messages {
+		positions = append(positions, t.size+int64(len(data)))
+		record := make([]byte, 4+recordHeader+len(m.Key)+len(m.Value))
+		binary.LittleEndian.PutUint32(record, uint32(len(record)-4))
+		binary.LittleEndian.PutUint64(record[4:], uint64(m.Timestamp))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(m.Key)))
+		copy(record[4+recordHeader:], m.Key)
+		copy(record[4+recordHeader+len(m.Key):], m.Value)
+		data = append(data, record...)
+	}
+	if _, err := t.file.Write(data); err != nil {
+		return err
+	}
+	t.positions = append(t.positions, positions...)
+	t.size += int64(len(data))
+	return nil
+}
+
+// Fetch returns up to max messages of topic starting at offset
+func (b *FileBroker) Fetch(topic string, offset int64, max int) ([]Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, err := b.topic(topic, false)
+	if t == nil || err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= int64(len(t.positions)) || max <= 0 {
+		return nil, nil
+	}
+
+	end := offset + int64(max)
+	if end > int64(len(t.positions)) {
+		end = int64(len(t.positions))
+	}
+	to := t.size
+	if end < int64(len(t.positions)) {
+		to = t.positions[end]
+	}
+	data := make([]byte, to-t.positions[offset])
+	if _, err := t.file.ReadAt(data, t.positions[offset]); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, end-offset)
+	for i := offset; i < end; i++ {
+		record := data[t.positions[i]-t.positions[offset]+4:]
+		record = record[:binary.LittleEndian.Uint32(data[t.positions[i]-t.positions[offset]:])]
+		if len(record) < recordHeader {
+			return nil, fmt.Errorf("corrupted record %d of topic %q", i, topic)
+		}
+		keyLen := int(binary.LittleEndian.Uint32(record[8:]))
+		if recordHeader+keyLen > len(record) {
+			return nil, fmt.Errorf("corrupted record %d of topic %q", i, topic)
+		}
+		messages = append(messages, Message{
+			Offset:    i,
+			Timestamp: int64(binary.LittleEndian.Uint64(record)),
+			Key:       record[recordHeader : recordHeader+keyLen],
+			Value:     record[recordHeader+keyLen:],
+		})
+	}
+	return messages, nil
+}
+
+func (b *FileBroker) offsetFile(group, topic string) (string, error) {
+	if !validName(group) {
+		return "", fmt.Errorf("invalid group name %q", group)
+	}
+	if !validName(topic) {
+		return "", ErrInvalidTopic
+	}
+	return filepath.Join(b.dir, "offsets", group, topic), nil
+}
+
+// Commit writes offset of group in topic to file
+func (b *FileBroker) Commit(group, topic string, offset int64) error {
+	filename, err := b.offsetFile(group, topic)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	// Offset is replaced atomically, so it's never lost on crash
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Committed reads offset of group in topic from file
+func (b *FileBroker) Committed(group, topic string) (int64, error) {
+	filename, err := b.offsetFile(group, topic)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Close closes files of topics
+func (b *FileBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, t := range b.topics {
+		if cerr := t.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	b.topics = nil
+	b.closed = true
+	return err
+}
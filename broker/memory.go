@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"sync"
+)
+
+// MemoryBroker keeps topics in memory of process, it's for tests and for
+// consumers running in the same process as producer
+type MemoryBroker struct {
+	mu      sync.Mutex
+	topics  map[string][]Message
+	offsets map[string]int64
+	closed  bool
+}
+
+// NewMemoryBroker creates empty broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		topics:  make(map[string][]Message),
+		offsets: make(map[string]int64),
+	}
+}
+
+// Produce appends messages to topic
+func (b *MemoryBroker) Produce(topic string, messages ...Message) error {
+	if !validName(topic) {
+		return ErrInvalidTopic
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	for _, m := range messages {
+		m.Offset = int64(len(b.topics[topic]))
+		b.topics[topic] = append(b.topics[topic], m)
+	}
+	return nil
+}
+
+// Fetch returns up to max messages of topic starting at offset
+func (b *MemoryBroker) Fetch(topic string, offset int64, max int) ([]Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	messages := b.topics[topic]
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= int64(len(messages)) || max <= 0 {
+		return nil, nil
+	}
+	end := offset + int64(max)
+	if end > int64(len(messages)) {
+		end = int64(len(messages))
+	}
+	return append([]Message(nil), messages[offset:end]...), nil
+}
+
+// Commit stores offset of group in topic
+func (b *MemoryBroker) Commit(group, topic string, offset int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	b.offsets[group+"/"+topic] = offset
+	return nil
+}
+
+// Committed returns offset of group in topic
+func (b *MemoryBroker) Committed(group, topic string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, ErrClosed
+	}
+	return b.offsets[group+"/"+topic], nil
+}
+
+// Close drops all messages
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.topics = nil
+	return nil
+}
@@ -4,15 +4,22 @@ import (
 	"bytes"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 // rawRequests is struct to pass raw pinba requests along with timestamp
+// and number of seconds they cover
 type rawRequests struct {
 	Timestamp int64
+	Span      int64
 	Data      []byte
 }
 
+// keepAlivePeriod is period of TCP keepalive probes, they detect dead
+// connection to collector, that doesn't send heartbeats
+const keepAlivePeriod = 15 * time.Second
+
 // Client is net.Conn wrapper for reading data from pinba-collector
 type Client struct {
 	Requests chan *PinbaRequests
@@ -23,6 +30,9 @@ type Client struct {
 	readTimeout    time.Duration
 
 	stream chan rawRequests
+
+	mu        sync.Mutex
+	heartbeat *Heartbeat
 }
 
 // New validates given address and creates new Client
@@ -52,34 +62,72 @@ func (c *Client) Listen(interval int64) {
 	var message ServerMessage
 	var buffer bytes.Buffer
 
+	// span is how many seconds buffer actually covers, and prevTimestamp is
+	// timestamp of previous message read from current connection
+	var span, prevTimestamp int64
+
 	lastFlush := time.Now().Unix()
 	c.stream = make(chan rawRequests, 10)
 
 	for {
 		c.serverConn.SetReadDeadline(time.Now().Add(c.readTimeout))
 		if err := message.ReadFrom(c.serverConn); err != nil {
-			log.Printf("[ERROR] Failed to read message: (%#v) %v", err, err)
+			timeout := false
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				timeout = true
+			}
+			if timeout && c.LastHeartbeat() == nil {
+				// Collector without heartbeats sends nothing, while idle,
+				// dead connection is detected by TCP keepalive instead
+				log.Printf("[INFO] Nothing read in %v, collector is idle", c.readTimeout)
+				continue
+			}
+			if timeout {
+				// Collector with heartbeats sends something every second
+				log.Printf("[ERROR] No heartbeat in %v, connection is dead", c.readTimeout)
+			} else {
+				log.Printf("[ERROR] Failed to read message: (%#v) %v", err, err)
+			}
+			c.serverConn.Close()
 			c.serverConn = mustConnect(c.serverAddr, c.connectTimeout)
+			// Everything between last message and reconnect is lost
+			prevTimestamp = 0
+			c.setHeartbeat(nil)
 			continue
 		}
-		log.Printf("[INFO] Read message for %v / %v (%v bytes)",
-			time.Unix(int64(message.Timestamp), 0).Format("15:04:05"),
-			message.Timestamp,
-			message.Data.Len(),
-		)
+		if message.Gap != nil {
+			log.Printf("[WARN] Collector dropped %v messages (%v bytes) for %v - %v, we are too slow",
+				message.Gap.Messages, message.Gap.Bytes, message.Gap.From, message.Gap.To)
+			// Dropped seconds are lost, like on reconnect
+			prevTimestamp = 0
+			continue
+		}
+		if message.Heartbeat != nil {
+			c.checkHeartbeat(message.Timestamp, message.Heartbeat)
+		} else {
+			log.Printf("[INFO] Read message for %v / %v (%v bytes)",
+				time.Unix(int64(message.Timestamp), 0).Format("15:04:05"),
+				message.Timestamp,
+				message.Data.Len(),
+			)
+		}
 
-		// Append message to buffer
+		// Append message to buffer, heartbeat has no data, but it covers
+		// idle seconds and flushes them as empty interval
 		buffer.ReadFrom(&message.Data)
+		span += messageSpan(prevTimestamp, message.Timestamp)
+		prevTimestamp = message.Timestamp
 
 		// If it's time to flush buffer
-		if message.Timestamp%interval == 0 || message.Timestamp-lastFlush > interval {
+		if flushDue(message.Timestamp, lastFlush, interval, buffer.Len() == 0) {
 			select {
-			case c.stream <- rawRequests{message.Timestamp, buffer.Bytes()}:
+			case c.stream <- rawRequests{message.Timestamp, span, buffer.Bytes()}:
 				// Sending buffer to processing
 			default:
 				log.Printf("[WARN] Stream channel is full! Skipping requests for %v", message.Timestamp)
 			}
 			lastFlush = message.Timestamp
+			span = 0
 			buffer.Reset()
 		}
 	}
@@ -87,6 +135,53 @@ func (c *Client) Listen(interval int64) {
 	close(c.stream)
 }
 
+// flushDue returns true if buffer should be flushed at given timestamp.
+// Heartbeat of second, that is already flushed with data, has nothing to
+// add, so it doesn't flush empty buffer once again
+func flushDue(timestamp, lastFlush, interval int64, empty bool) bool {
+	if timestamp == lastFlush && empty {
+		return false
+	}
+	return timestamp%interval == 0 || timestamp-lastFlush > interval
+}
+
+// LastHeartbeat returns last heartbeat of collector on current connection,
+// or nil if there was none
+func (c *Client) LastHeartbeat() *Heartbeat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.heartbeat
+}
+
+func (c *Client) setHeartbeat(heartbeat *Heartbeat) *Heartbeat {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.heartbeat
+	c.heartbeat = heartbeat
+	return prev
+}
+
+// checkHeartbeat remembers heartbeat and warns about packets, that collector
+// dropped since previous one
+func (c *Client) checkHeartbeat(timestamp int64, heartbeat *Heartbeat) {
+	prev := c.setHeartbeat(heartbeat)
+	log.Printf("[INFO] Heartbeat for %v / %v, collector is idle for %v sec, %v packets received, %v messages queued for us",
+		time.Unix(timestamp, 0).Format("15:04:05"), timestamp, heartbeat.Idle, heartbeat.Packets, heartbeat.Queued)
+	if lost := droppedSince(prev, heartbeat); lost > 0 {
+		log.Printf("[WARN] Collector dropped %v of %v packets since previous heartbeat",
+			lost, heartbeat.Packets-prev.Packets)
+	}
+}
+
+// droppedSince returns number of packets dropped by collector between two
+// heartbeats, counters of restarted collector start from zero
+func droppedSince(prev, heartbeat *Heartbeat) int64 {
+	if prev == nil || heartbeat.Packets < prev.Packets {
+		return 0
+	}
+	return heartbeat.Dropped - prev.Dropped
+}
+
 // decode get data from stream channel and decode it from []byte to pinba.Request
 // and sends its result to Client.Requests channel
 func (c *Client) decode() {
@@ -100,6 +195,7 @@ func (c *Client) decode() {
 				log.Printf("[ERROR] Failed to unmarshal request for %v: %v", data.Timestamp, err)
 				continue
 			}
+			requests.Span = data.Span
 			log.Printf("[INFO] Decoded %v requests for %v in %v", len(requests.Requests), data.Timestamp, time.Since(t))
 
 			select {
@@ -112,11 +208,26 @@ func (c *Client) decode() {
 	}
 }
 
+// messageSpan returns how many seconds message with given timestamp covers.
+// Collector sends heartbeat for idle seconds, if they are enabled, otherwise
+// nothing, so on live connection message covers everything since previous
+// one, and first message after (re)connect covers only its own second
+func messageSpan(prevTimestamp, timestamp int64) int64 {
+	if prevTimestamp == 0 {
+		return 1
+	}
+	if timestamp <= prevTimestamp {
+		return 0
+	}
+	return timestamp - prevTimestamp
+}
+
 // mustConnect try to connect to server, and if failed will retry every 5 seconds
 // TODO: move 5 seconds constant to Clients property?
 func mustConnect(addr string, timeout time.Duration) net.Conn {
+	dialer := net.Dialer{Timeout: timeout, KeepAlive: keepAlivePeriod}
 	for {
-		conn, err := net.DialTimeout("tcp", addr, timeout)
+		conn, err := dialer.Dial("tcp", addr)
 		if err != nil {
 			log.Printf("[WARN] Can't connect to %v: %v", addr, err)
 			time.Sleep(5 * time.Second)
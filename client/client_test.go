@@ -10,3 +10,33 @@ func TestClient(t *testing.T) {
 	// TODO
 	assert.Equal(t, "test", "test")
 }
+
+func TestMessageSpan(t *testing.T) {
+	// First message after (re)connect
+	assert.EqualValues(t, 1, messageSpan(0, 1452146656))
+	assert.EqualValues(t, 1, messageSpan(1452146655, 1452146656))
+	// Collector was idle for couple of seconds
+	assert.EqualValues(t, 3, messageSpan(1452146653, 1452146656))
+	// Duplicate or out of order message
+	assert.EqualValues(t, 0, messageSpan(1452146656, 1452146656))
+}
+
+func TestFlushDue(t *testing.T) {
+	assert.True(t, flushDue(1452146650, 1452146640, 10, false))
+	assert.False(t, flushDue(1452146651, 1452146650, 10, false))
+	// Collector was idle for longer than interval
+	assert.True(t, flushDue(1452146661, 1452146650, 10, true))
+	// Heartbeat right after data of the same second
+	assert.False(t, flushDue(1452146650, 1452146650, 10, true))
+	// Late data of already flushed second is still sent
+	assert.True(t, flushDue(1452146650, 1452146650, 10, false))
+}
+
+func TestDroppedSince(t *testing.T) {
+	prev := &Heartbeat{Packets: 100, Dropped: 2}
+	assert.EqualValues(t, 0, droppedSince(nil, prev))
+	assert.EqualValues(t, 3, droppedSince(prev, &Heartbeat{Packets: 150, Dropped: 5}))
+	assert.EqualValues(t, 0, droppedSince(prev, &Heartbeat{Packets: 150, Dropped: 2}))
+	// Collector was restarted
+	assert.EqualValues(t, 0, droppedSince(prev, &Heartbeat{Packets: 10, Dropped: 1}))
+}
@@ -4,13 +4,86 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 )
 
+// Every collector message starts with int32 length of payload and int32
+// timestamp. For data messages payload is zlib-compressed requests, each
+// prefixed with its int32 length. Negative length marks control message, its
+// payload is int32 length of JSON, followed by the JSON itself
+const (
+	heartbeatMessage int32 = -1
+	gapMessage       int32 = -2
+)
+
+// maxControlSize limits JSON of control message, so garbage is not read as
+// gigabytes of it
+const maxControlSize = 1 << 16
+
+// Heartbeat is sent by collector every second it has no requests, and from
+// time to time when it has, so client can tell idle collector from dead
+// connection. Counters are totals since collector start, so their difference
+// between heartbeats shows how many packets were lost before collector
+type Heartbeat struct {
+	// Packets is number of UDP packets collector received
+	Packets int64 `json:"packets"`
+	// Dropped is number of packets collector dropped, because its queue
+	// was full
+	Dropped int64 `json:"dropped"`
+	// Requests is number of requests collector sent to its clients
+	Requests int64 `json:"requests"`
+	// Idle is number of seconds since collector sent last data message
+	Idle int64 `json:"idle"`
+	// Queued is number of messages and their bytes, queued for this client
+	// in collector before heartbeat, that is how far client lags behind
+	Queued      int64 `json:"queued"`
+	QueuedBytes int64 `json:"queued_bytes"`
+}
+
+// Gap is sent by collector in place of messages, it dropped because client
+// was too slow to read them
+type Gap struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+	// From and To are timestamps of first and last dropped messages
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// EncodeHeartbeat returns heartbeat message for given timestamp ready to be
+// send over the wire
+func EncodeHeartbeat(timestamp int64, heartbeat Heartbeat) ([]byte, error) {
+	return encodeControl(heartbeatMessage, timestamp, heartbeat)
+}
+
+// EncodeGap returns gap message ready to be send over the wire, its
+// timestamp is the one of last dropped message
+func EncodeGap(gap Gap) ([]byte, error) {
+	return encodeControl(gapMessage, gap.To, gap)
+}
+
+func encodeControl(kind int32, timestamp int64, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var result bytes.Buffer
+	binary.Write(&result, binary.LittleEndian, kind)
+	binary.Write(&result, binary.LittleEndian, int32(timestamp))
+	binary.Write(&result, binary.LittleEndian, int32(len(payload)))
+	result.Write(payload)
+	return result.Bytes(), nil
+}
+
 // ServerMessage is struct to read and "decode" pinba-collector (server) messages
 type ServerMessage struct {
 	Timestamp int64
 	Data      bytes.Buffer
+	// Heartbeat or Gap is set, if message is control and not data message
+	Heartbeat *Heartbeat
+	Gap       *Gap
 
 	length int32
 }
@@ -18,6 +91,7 @@ type ServerMessage struct {
 // ReadFrom will read message from given io.Reader and "extract" from it
 // timestamp and raw byte data of pinba requests for this timestamp
 func (message *ServerMessage) ReadFrom(r io.Reader) error {
+	message.Heartbeat, message.Gap = nil, nil
 	if err := binary.Read(r, binary.LittleEndian, &message.length); err != nil {
 		return err
 	}
@@ -26,6 +100,10 @@ func (message *ServerMessage) ReadFrom(r io.Reader) error {
 		return err
 	}
 	message.Timestamp = int64(ts)
+	if message.length < 0 {
+		return message.readControl(r)
+	}
+
 	zdata, err := zlib.NewReader(io.LimitReader(r, int64(message.length)))
 	if err != nil {
 		return err
@@ -37,3 +115,28 @@ func (message *ServerMessage) ReadFrom(r io.Reader) error {
 	}
 	return nil
 }
+
+func (message *ServerMessage) readControl(r io.Reader) error {
+	var size int32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size < 0 || size > maxControlSize {
+		return fmt.Errorf("invalid size of control message: %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+
+	switch message.length {
+	case heartbeatMessage:
+		message.Heartbeat = &Heartbeat{}
+		return json.Unmarshal(payload, message.Heartbeat)
+	case gapMessage:
+		message.Gap = &Gap{}
+		return json.Unmarshal(payload, message.Gap)
+	}
+	// Unknown control messages are skipped, so collector can add new ones
+	return nil
+}
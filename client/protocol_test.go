@@ -71,3 +71,47 @@ func generateTestData(t *testing.T) {
 
 	t.Logf("testData: %#v", testData.Bytes())
 }
+
+func TestReadHeartbeat(t *testing.T) {
+	heartbeat := Heartbeat{Packets: 100, Dropped: 2, Requests: 98, Idle: 3}
+	data, err := EncodeHeartbeat(testDataTimestamp, heartbeat)
+	assert.NoError(t, err)
+
+	// Heartbeat between data messages
+	var stream bytes.Buffer
+	stream.Write(testData)
+	stream.Write(data)
+	stream.Write(testData)
+	r := bytes.NewReader(stream.Bytes())
+
+	message := ServerMessage{}
+	assert.NoError(t, message.ReadFrom(r))
+	assert.Nil(t, message.Heartbeat)
+	message.Data.Reset()
+
+	assert.NoError(t, message.ReadFrom(r))
+	assert.EqualValues(t, testDataTimestamp, message.Timestamp)
+	assert.Equal(t, &heartbeat, message.Heartbeat)
+	assert.EqualValues(t, 0, message.Data.Len())
+
+	assert.NoError(t, message.ReadFrom(r))
+	assert.Nil(t, message.Heartbeat)
+	assert.EqualValues(t, 2*len(validData)+8, message.Data.Len())
+
+	// Size of control message is checked
+	data[8] = 0xff
+	data[11] = 0x7f
+	assert.Error(t, message.ReadFrom(bytes.NewReader(data)))
+}
+
+func TestReadGap(t *testing.T) {
+	gap := Gap{Messages: 3, Bytes: 1024, From: testDataTimestamp - 2, To: testDataTimestamp}
+	data, err := EncodeGap(gap)
+	assert.NoError(t, err)
+
+	message := ServerMessage{}
+	assert.NoError(t, message.ReadFrom(bytes.NewReader(data)))
+	assert.EqualValues(t, testDataTimestamp, message.Timestamp)
+	assert.Equal(t, &gap, message.Gap)
+	assert.Nil(t, message.Heartbeat)
+}
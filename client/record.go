@@ -0,0 +1,69 @@
+package client
+
+import (
+	"github.com/olegfedoseev/pinba"
+)
+
+// Record is decoded request in JSON, as it's exported to files and published
+// to subscribers of decoder. Tags are object of tag names and values
+type Record struct {
+	Timestamp    int64             `json:"timestamp"`
+	Hostname     string            `json:"hostname"`
+	ServerName   string            `json:"server_name"`
+	ScriptName   string            `json:"script_name"`
+	Status       uint32            `json:"status"`
+	RequestCount uint32            `json:"request_count"`
+	DocumentSize uint32            `json:"document_size"`
+	MemoryPeak   uint32            `json:"memory_peak"`
+	RequestTime  float32           `json:"request_time"`
+	RuUtime      float32           `json:"ru_utime"`
+	RuStime      float32           `json:"ru_stime"`
+	Tags         map[string]string `json:"tags"`
+	Timers       []RecordTimer     `json:"timers"`
+}
+
+// RecordTimer is timer of request in JSON
+type RecordTimer struct {
+	HitCount int               `json:"hit_count"`
+	Value    float32           `json:"value"`
+	RuUtime  float32           `json:"ru_utime"`
+	RuStime  float32           `json:"ru_stime"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// NewRecord returns record of request collected at given timestamp
+func NewRecord(timestamp int64, r *pinba.Request) Record {
+	record := Record{
+		Timestamp:    timestamp,
+		Hostname:     r.Hostname,
+		ServerName:   r.ServerName,
+		ScriptName:   r.ScriptName,
+		Status:       r.Status,
+		RequestCount: r.RequestCount,
+		DocumentSize: r.DocumentSize,
+		MemoryPeak:   r.MemoryPeak,
+		RequestTime:  r.RequestTime,
+		RuUtime:      r.RuUtime,
+		RuStime:      r.RuStime,
+		Tags:         tagsMap(r.Tags),
+		Timers:       make([]RecordTimer, len(r.Timers)),
+	}
+	for i, timer := range r.Timers {
+		record.Timers[i] = RecordTimer{
+			HitCount: timer.HitCount,
+			Value:    timer.Value,
+			RuUtime:  timer.RuUtime,
+			RuStime:  timer.RuStime,
+			Tags:     tagsMap(timer.Tags),
+		}
+	}
+	return record
+}
+
+func tagsMap(tags pinba.Tags) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[tag.Key] = tag.Value
+	}
+	return m
+}
@@ -9,12 +9,22 @@ import (
 )
 
 // PinbaRequests struct holds slice of decoded Request's and timestamp, when
-// they were collected
+// they were collected. Span is number of seconds they actually cover, it can
+// be less than configured interval, for example after reconnect
 type PinbaRequests struct {
 	Timestamp int64
+	Span      int64
 	Requests  []*pinba.Request
 }
 
+// Rate returns given count per second over time span of this requests
+func (r *PinbaRequests) Rate(count int64) float64 {
+	if r.Span <= 0 {
+		return float64(count)
+	}
+	return float64(count) / float64(r.Span)
+}
+
 // NewPinbaRequests will read and decode requests for given timestamp
 func NewPinbaRequests(timestamp int64, data io.Reader) (*PinbaRequests, error) {
 	var buf bytes.Buffer
@@ -26,11 +36,13 @@ func NewPinbaRequests(timestamp int64, data io.Reader) (*PinbaRequests, error) {
 
 	result := PinbaRequests{
 		Timestamp: timestamp,
+		Span:      1,
 		Requests:  make([]*pinba.Request, 0),
 	}
 
 	var cnt int64
-	for {
+	// Interval without requests is valid and gives empty result
+	for length > 0 {
 		buf.Reset()
 		if err := binary.Read(&reader, binary.LittleEndian, &requestLen); err != nil {
 			return nil, err
@@ -47,9 +59,6 @@ func NewPinbaRequests(timestamp int64, data io.Reader) (*PinbaRequests, error) {
 		result.Requests = append(result.Requests, request)
 
 		length -= 4 + requestLen
-		if length <= 0 {
-			break
-		}
 	}
 	return &result, nil
 }
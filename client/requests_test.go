@@ -55,3 +55,23 @@ func BenchmarkUnmarshal(b *testing.B) {
 		NewPinbaRequests(ts, &buffer)
 	}
 }
+
+func TestRequestsRate(t *testing.T) {
+	requests := PinbaRequests{Span: 10}
+	assert.EqualValues(t, 2.5, requests.Rate(25))
+
+	// Partial bucket, for example after reconnect
+	requests.Span = 4
+	assert.EqualValues(t, 6.25, requests.Rate(25))
+
+	// Unknown span is treated as one second
+	requests.Span = 0
+	assert.EqualValues(t, 25, requests.Rate(25))
+}
+
+func TestReadEmptyRequests(t *testing.T) {
+	requests, err := NewPinbaRequests(1452146656, &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1452146656, requests.Timestamp)
+	assert.Empty(t, requests.Requests)
+}
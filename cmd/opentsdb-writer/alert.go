@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AlertsSettings describes rules checked against aggregates of every
+// interval and where to send alerts, when they fire and resolve
+type AlertsSettings struct {
+	// Webhook is URL, that gets POST with JSON of every alert event
+	Webhook string `yaml:"webhook"`
+	// File gets JSON of every alert event as a line
+	File  string              `yaml:"file"`
+	Rules []AlertRuleSettings `yaml:"rules"`
+}
+
+// AlertRuleSettings describes condition on value of series. Value is
+// compared with Above and Below as is, or, if Baseline is set, they are
+// factors of median of this value for last Baseline seconds
+type AlertRuleSettings struct {
+	Name string `yaml:"name"`
+	// Metric is regexp of series name, with prefix, like "^php\.requests$"
+	Metric string `yaml:"metric"`
+	// Tags are regexps of tag values, that series should have
+	Tags map[string]string `yaml:"tags"`
+	// Value is one of alertValues, default is p95
+	Value string   `yaml:"value"`
+	Above *float64 `yaml:"above"`
+	Below *float64 `yaml:"below"`
+	// Baseline is window in seconds of values to compare with
+	Baseline int64 `yaml:"baseline"`
+	// MinCount is minimal number of values in interval to check series, so
+	// alerts are not fired on a couple of slow requests at night
+	MinCount int64 `yaml:"min_count"`
+}
+
+// alertValues are values of series, that can be checked by alert rules
+var alertValues = map[string]func(m *Metric, span int64) (float64, bool){
+	"p50":   func(m *Metric, span int64) (float64, bool) { return m.Percentile(50), true },
+	"p75":   func(m *Metric, span int64) (float64, bool) { return m.Percentile(75), true },
+	"p95":   func(m *Metric, span int64) (float64, bool) { return m.Percentile(95), true },
+	"p99":   func(m *Metric, span int64) (float64, bool) { return m.Percentile(99), true },
+	"max":   func(m *Metric, span int64) (float64, bool) { return m.Max(), true },
+	"count": func(m *Metric, span int64) (float64, bool) { return float64(m.Count), true },
+	"rps": func(m *Metric, span int64) (float64, bool) {
+		if span <= 0 {
+			span = 1
+		}
+		return float64(m.Count) / float64(span), true
+	},
+	"error_rate": func(m *Metric, span int64) (float64, bool) {
+		if m.Statuses == nil || m.Count == 0 {
+			return 0, false
+		}
+		return float64(m.Statuses[4]) / float64(m.Count), true
+	},
+	"apdex": func(m *Metric, span int64) (float64, bool) {
+		if m.Apdex == nil {
+			return 0, false
+		}
+		return m.Apdex.Score(), true
+	},
+}
+
+// AlertRule is compiled AlertRuleSettings
+type AlertRule struct {
+	AlertRuleSettings
+	metric *regexp.Regexp
+	tags   map[string]*regexp.Regexp
+	value  func(m *Metric, span int64) (float64, bool)
+}
+
+// Compile validates settings and returns rule for them
+func (s AlertRuleSettings) Compile() (*AlertRule, error) {
+	if s.Name == "" {
+		return nil, fmt.Errorf("alert rule name is empty")
+	}
+	if s.Above == nil && s.Below == nil {
+		return nil, fmt.Errorf("alert rule %q needs above or below", s.Name)
+	}
+	if s.Baseline < 0 || s.MinCount < 0 {
+		return nil, fmt.Errorf("alert rule %q: baseline and min_count should be positive", s.Name)
+	}
+	if s.Value == "" {
+		s.Value = "p95"
+	}
+
+	r := &AlertRule{AlertRuleSettings: s, value: alertValues[s.Value]}
+	if r.value == nil {
+		return nil, fmt.Errorf("alert rule %q: unknown value %q", s.Name, s.Value)
+	}
+	var err error
+	if r.metric, err = compileRegexp("metric", s.Metric); err != nil {
+		return nil, fmt.Errorf("alert rule %q: %v", s.Name, err)
+	}
+	if r.tags, err = compileTags(s.Tags); err != nil {
+		return nil, fmt.Errorf("alert rule %q: %v", s.Name, err)
+	}
+	return r, nil
+}
+
+// Match returns true if rule applies to series
+func (r *AlertRule) Match(m *Metric) bool {
+	if r.metric != nil && !r.metric.MatchString(m.Name) {
+		return false
+	}
+	for key, re := range r.tags {
+		value, ok := m.Tags[key]
+		if !ok || !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// AlertEvent is sent when alert fires or resolves
+type AlertEvent struct {
+	Rule      string            `json:"rule"`
+	State     string            `json:"state"`
+	Metric    string            `json:"metric"`
+	Tags      map[string]string `json:"tags"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	// Threshold value was compared with, it's factor times baseline median
+	// for rules with baseline
+	Threshold float64  `json:"threshold"`
+	Baseline  *float64 `json:"baseline,omitempty"`
+}
+
+// minBaselineValues is how many values series should have in baseline
+// window, before it's checked against baseline
+const minBaselineValues = 6
+
+type alertState struct {
+	firing  bool
+	seen    int64
+	history []float64 // ring of values for baseline
+	next    int
+	full    bool
+}
+
+// Alerts checks rules against series of every interval and keeps state of
+// every rule and series, so events are sent only when alert fires and
+// resolves
+type Alerts struct {
+	interval int64
+	rules    []*AlertRule
+	states   map[string]*alertState
+}
+
+// NewAlerts creates engine for given aggregation interval in seconds
+func NewAlerts(interval int64) *Alerts {
+	return &Alerts{interval: interval, states: make(map[string]*alertState)}
+}
+
+// SetRules replaces rules, state of rules with the same names and baseline
+// windows is kept, so reload doesn't fire alerts again
+func (a *Alerts) SetRules(rules []*AlertRule) {
+	a.rules = rules
+	for key, state := range a.states {
+		name := key[:strings.IndexByte(key, 0)]
+		if !a.hasRule(name, len(state.history)) {
+			delete(a.states, key)
+		}
+	}
+}
+
+// hasRule returns true if there is rule with given name and baseline of
+// given number of values
+func (a *Alerts) hasRule(name string, history int) bool {
+	for _, rule := range a.rules {
+		if rule.Name == name && a.baselineSize(rule) == history {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Alerts) baselineSize(rule *AlertRule) int {
+	if rule.Baseline == 0 || a.interval <= 0 {
+		return 0
+	}
+	return int(rule.Baseline / a.interval)
+}
+
+// Check checks rules against series of interval, that covers span seconds,
+// and returns events of fired and resolved alerts
+func (a *Alerts) Check(ts, span int64, data map[string]*Metric) []AlertEvent {
+	var events []AlertEvent
+	for _, rule := range a.rules {
+		for id, m := range data {
+			if m.Count < rule.MinCount || !rule.Match(m) {
+				continue
+			}
+			value, ok := rule.value(m, span)
+			if !ok {
+				continue
+			}
+
+			key := rule.Name + "\x00" + id
+			state, ok := a.states[key]
+			if !ok {
+				state = &alertState{history: make([]float64, a.baselineSize(rule))}
+				a.states[key] = state
+			}
+			state.seen = ts
+
+			event, fire, ok := a.check(rule, state, value)
+			if len(state.history) > 0 {
+				state.history[state.next] = value
+				state.next = (state.next + 1) % len(state.history)
+				state.full = state.full || state.next == 0
+			}
+			if !ok || fire == state.firing {
+				continue
+			}
+
+			state.firing = fire
+			event.Rule, event.Metric, event.Timestamp, event.Value = rule.Name, m.Name, ts, value
+			event.State = "resolved"
+			if fire {
+				event.State = "firing"
+			}
+			event.Tags = make(map[string]string, len(m.Tags))
+			for k, v := range m.Tags {
+				event.Tags[k] = v
+			}
+			events = append(events, event)
+		}
+	}
+	a.expire(ts)
+	return events
+}
+
+// check returns event with threshold and whether rule fires for value, or
+// false if it can't be checked yet
+func (a *Alerts) check(rule *AlertRule, state *alertState, value float64) (AlertEvent, bool, bool) {
+	var event AlertEvent
+	factor := 1.0
+	if len(state.history) > 0 {
+		n := state.next
+		if state.full {
+			n = len(state.history)
+		}
+		if n < minBaselineValues {
+			return event, false, false
+		}
+		factor = median(state.history[:n])
+		event.Baseline = &factor
+	}
+
+	if rule.Above != nil && value > *rule.Above*factor {
+		event.Threshold = *rule.Above * factor
+		return event, true, true
+	}
+	if rule.Below != nil && value < *rule.Below*factor {
+		event.Threshold = *rule.Below * factor
+		return event, true, true
+	}
+	if rule.Above != nil {
+		event.Threshold = *rule.Above * factor
+	} else {
+		event.Threshold = *rule.Below * factor
+	}
+	return event, false, true
+}
+
+// expire forgets state of series, that weren't seen for an hour or baseline
+// window. Alerts of such series are not resolved, they just disappear
+func (a *Alerts) expire(ts int64) {
+	for key, state := range a.states {
+		keep := int64(3600)
+		if window := int64(len(state.history)) * a.interval; window > keep {
+			keep = window
+		}
+		if ts-state.seen > keep {
+			delete(a.states, key)
+		}
+	}
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Notifier sends alert events to webhook and file in background
+type Notifier struct {
+	webhook string
+	file    string
+	client  *http.Client
+	events  chan AlertEvent
+}
+
+// NewNotifier creates notifier and starts its goroutine, it returns nil if
+// there is nowhere to send events
+func NewNotifier(webhook, file string, timeout time.Duration) *Notifier {
+	if webhook == "" && file == "" {
+		return nil
+	}
+	n := &Notifier{
+		webhook: webhook,
+		file:    file,
+		client:  &http.Client{Timeout: timeout},
+		events:  make(chan AlertEvent, 1000),
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues events, they are dropped if queue is full
+func (n *Notifier) Notify(events []AlertEvent) {
+	for _, event := range events {
+		log.Printf("[WARN][%d] Alert %q is %s for %v%v: %v (threshold %v)",
+			event.Timestamp, event.Rule, event.State, event.Metric, event.Tags, event.Value, event.Threshold)
+		if n == nil {
+			continue
+		}
+		select {
+		case n.events <- event:
+		default:
+			log.Printf("[ERROR] Too many alert events, %q for %v dropped", event.Rule, event.Metric)
+		}
+	}
+}
+
+func (n *Notifier) run() {
+	for event := range n.events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[ERROR] Failed to encode alert event: %v", err)
+			continue
+		}
+		if n.file != "" {
+			if err := appendLine(n.file, data); err != nil {
+				log.Printf("[ERROR] Failed to write alert event to %v: %v", n.file, err)
+			}
+		}
+		if n.webhook != "" {
+			if err := n.post(data); err != nil {
+				log.Printf("[ERROR] Failed to send alert event to webhook: %v", err)
+			}
+		}
+	}
+}
+
+func appendLine(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (n *Notifier) post(data []byte) error {
+	resp, err := n.client.Post(n.webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestAlertRuleSettingsCompile(t *testing.T) {
+	rule, err := AlertRuleSettings{Name: "slow", Above: float(1)}.Compile()
+	assert.NoError(t, err)
+	assert.Equal(t, "p95", rule.Value)
+
+	for _, s := range []AlertRuleSettings{
+		{Above: float(1)},
+		{Name: "slow"},
+		{Name: "slow", Above: float(1), Value: "p42"},
+		{Name: "slow", Above: float(1), Baseline: -1},
+		{Name: "slow", Above: float(1), Metric: "("},
+		{Name: "slow", Above: float(1), Tags: map[string]string{"script": "("}},
+	} {
+		_, err := s.Compile()
+		assert.Error(t, err, "%+v", s)
+	}
+}
+
+func testAlertSeries(name, script string, values ...float64) map[string]*Metric {
+	m := NewMetric(name, pinba.Tags{{Key: "script", Value: script}}, NewExact())
+	for _, v := range values {
+		m.Add(1, v)
+	}
+	return map[string]*Metric{name + " script=" + script: m}
+}
+
+func TestAlertsThreshold(t *testing.T) {
+	rule, err := AlertRuleSettings{
+		Name:     "errors",
+		Metric:   `^php\.requests$`,
+		Value:    "max",
+		Above:    float(1),
+		MinCount: 2,
+	}.Compile()
+	assert.NoError(t, err)
+	a := NewAlerts(10)
+	a.SetRules([]*AlertRule{rule})
+
+	assert.Empty(t, a.Check(1500000000, 10, testAlertSeries("php.requests", "/", 0.1, 0.2)))
+	// Too few values or other metric
+	assert.Empty(t, a.Check(1500000010, 10, testAlertSeries("php.requests", "/", 2)))
+	assert.Empty(t, a.Check(1500000010, 10, testAlertSeries("php.other", "/", 2, 2)))
+
+	events := a.Check(1500000020, 10, testAlertSeries("php.requests", "/", 0.1, 2))
+	assert.Len(t, events, 1)
+	assert.Equal(t, AlertEvent{
+		Rule: "errors", State: "firing", Metric: "php.requests",
+		Tags: map[string]string{"script": "/"}, Timestamp: 1500000020, Value: 2, Threshold: 1,
+	}, events[0])
+
+	// Alert is sent only once while it fires
+	assert.Empty(t, a.Check(1500000030, 10, testAlertSeries("php.requests", "/", 0.1, 3)))
+	events = a.Check(1500000040, 10, testAlertSeries("php.requests", "/", 0.1, 0.5))
+	assert.Len(t, events, 1)
+	assert.Equal(t, "resolved", events[0].State)
+
+	// State is forgotten when series disappears
+	a.Check(1500000040+3601, 10, nil)
+	assert.Empty(t, a.states)
+}
+
+func TestAlertsBaseline(t *testing.T) {
+	rule, err := AlertRuleSettings{
+		Name:     "slow index",
+		Tags:     map[string]string{"script": "^/index.php$"},
+		Above:    float(2),
+		Baseline: 3600,
+	}.Compile()
+	assert.NoError(t, err)
+	a := NewAlerts(10)
+	a.SetRules([]*AlertRule{rule})
+
+	ts := int64(1500000000)
+	for i := 0; i < 360; i++ {
+		// Nothing is checked until there is enough of baseline
+		v := 0.1 + float64(i%3)/10
+		if i < minBaselineValues {
+			v = 10
+		}
+		assert.Empty(t, a.Check(ts, 10, testAlertSeries("php.requests", "/index.php", v)), "%d", i)
+		ts += 10
+	}
+	assert.Empty(t, a.Check(ts, 10, testAlertSeries("php.requests", "/other.php", 1)))
+
+	events := a.Check(ts, 10, testAlertSeries("php.requests", "/index.php", 0.5))
+	assert.Len(t, events, 1)
+	assert.InDelta(t, 0.4, events[0].Threshold, 1e-9)
+	assert.InDelta(t, 0.2, *events[0].Baseline, 1e-9)
+
+	// Reload with the same rule keeps state, changed baseline resets it
+	a.SetRules([]*AlertRule{rule})
+	assert.Len(t, a.states, 1)
+	rule, _ = AlertRuleSettings{Name: "slow index", Above: float(2), Baseline: 600}.Compile()
+	a.SetRules([]*AlertRule{rule})
+	assert.Empty(t, a.states)
+}
+
+func TestNotifier(t *testing.T) {
+	received := make(chan AlertEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event AlertEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "alerts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "alerts.jsonl")
+
+	assert.Nil(t, NewNotifier("", "", time.Second))
+	n := NewNotifier(server.URL, file, time.Second)
+	n.Notify([]AlertEvent{{Rule: "slow", State: "firing", Metric: "php.requests", Value: 2}})
+
+	select {
+	case event := <-received:
+		assert.Equal(t, "slow", event.Rule)
+		assert.Equal(t, 2.0, event.Value)
+	case <-time.After(time.Second):
+		t.Fatalf("webhook wasn't called")
+	}
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), `{"rule":"slow","state":"firing"`), string(data))
+	assert.True(t, strings.HasSuffix(string(data), "}\n"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+)
+
+// Backend sends data points to OpenTSDB
+type Backend interface {
+	// Push queues data point for sending, it's dropped if queue is full
+	Push(p *opentsdb.DataPoint)
+	// Queue returns number of queued data points and capacity of queue
+	Queue() (int, int)
+	// Stats returns total numbers of sent and dropped data points
+	Stats() (sent, dropped int64)
+	// Rejected returns numbers of data points rejected by OpenTSDB by reason
+	// since the last call, nil if backend can't tell
+	Rejected() map[string]int64
+	// Batches receives timings of sent batches
+	Batches() <-chan Batch
+	Errors() <-chan error
+	// SetFallback sets function, that takes batches backend failed to send,
+	// they are dropped if it returns error. Backend, that can't tell failed
+	// data points, ignores it
+	SetFallback(fallback func([]*opentsdb.DataPoint) error)
+}
+
+// Batch is timing of one sent batch of data points
+type Batch struct {
+	Timestamp   int64
+	Start, Stop time.Time
+}
+
+// TelnetBackend is Backend on top of opentsdb.Client, that writes to
+// telnet interface of OpenTSDB
+type TelnetBackend struct {
+	client  *opentsdb.Client
+	batches chan Batch
+}
+
+// NewTelnetBackend creates client and starts its workers
+func NewTelnetBackend(host string, size int, timeout time.Duration, workers, batchSize int) (*TelnetBackend, error) {
+	client, err := opentsdb.NewClient(host, size, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client.StartWorkers(workers, batchSize, 100*time.Millisecond)
+
+	b := &TelnetBackend{client: client, batches: make(chan Batch)}
+	go func() {
+		for timer := range client.Clock {
+			b.batches <- Batch{timer.Timestamp, timer.Start, timer.Stop}
+		}
+	}()
+	return b, nil
+}
+
+func (b *TelnetBackend) Push(p *opentsdb.DataPoint) {
+	b.client.Push(p)
+}
+
+func (b *TelnetBackend) Queue() (int, int) {
+	return len(b.client.Queue), cap(b.client.Queue)
+}
+
+func (b *TelnetBackend) Stats() (int64, int64) {
+	return int64(b.client.Sent), int64(b.client.Dropped)
+}
+
+func (b *TelnetBackend) Rejected() map[string]int64 {
+	return nil
+}
+
+func (b *TelnetBackend) Batches() <-chan Batch {
+	return b.batches
+}
+
+func (b *TelnetBackend) Errors() <-chan error {
+	return b.client.Errors
+}
+
+// SetFallback is ignored, opentsdb.Client drops failed batches itself
+func (b *TelnetBackend) SetFallback(fallback func([]*opentsdb.DataPoint) error) {
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/olegfedoseev/pinba"
+)
+
+// Values of group_by tags of breakdown series for timers without them and
+// for time of request not covered by timers
+const (
+	noneTagValue        = "none"
+	unaccountedTagValue = "unaccounted"
+)
+
+// breakdownGroup is sum of values of request timers with the same values of
+// group_by tags, and sum of their CPU time
+type breakdownGroup struct {
+	tags  pinba.Tags
+	value float32
+	cpu   float32
+}
+
+// breakdown sums values of request timers by values of GroupBy tags and
+// returns groups with given tags of series added. Groups are in order of
+// their first timers, unaccounted one is the last. Nested timers are summed
+// up as they are, so their sum can exceed value of request, then unaccounted
+// value is clamped to zero
+func (s *MetricsSettings) breakdown(request *pinba.Request, tags pinba.Tags) []breakdownGroup {
+	groups := make([]breakdownGroup, 0, len(request.Timers)+1)
+	index := make(map[string]int, len(request.Timers))
+	var total, totalCPU float32
+	for _, timer := range request.Timers {
+		cpu := timer.RuUtime + timer.RuStime
+		value := timer.Value
+		if s.Value == "cpu" {
+			value = cpu
+		}
+		total += value
+		totalCPU += cpu
+
+		values := make([]string, len(s.GroupBy))
+		for i, key := range s.GroupBy {
+			if values[i], _ = tagValue(timer.Tags, key); values[i] == "" {
+				values[i] = noneTagValue
+			}
+		}
+		key := strings.Join(values, "\x00")
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, breakdownGroup{tags: s.groupTags(tags, values)})
+		}
+		groups[i].value += value
+		groups[i].cpu += cpu
+	}
+
+	if s.Unaccounted {
+		cpu := request.RuUtime + request.RuStime
+		value := request.RequestTime
+		if s.Value == "cpu" {
+			value = cpu
+		}
+		values := make([]string, len(s.GroupBy))
+		for i := range values {
+			values[i] = unaccountedTagValue
+		}
+		groups = append(groups, breakdownGroup{
+			tags:  s.groupTags(tags, values),
+			value: positive(value - total),
+			cpu:   positive(cpu - totalCPU),
+		})
+	}
+	return groups
+}
+
+// groupTags returns copy of tags with GroupBy tags of given values added
+func (s *MetricsSettings) groupTags(tags pinba.Tags, values []string) pinba.Tags {
+	result := make(pinba.Tags, len(tags), len(tags)+len(values))
+	copy(result, tags)
+	for i, key := range s.GroupBy {
+		result = append(result, pinba.Tag{Key: key, Value: values[i]})
+	}
+	return result
+}
+
+func positive(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
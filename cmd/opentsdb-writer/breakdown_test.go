@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBreakdownRequest() *pinba.Request {
+	return &pinba.Request{
+		RequestTime: 1,
+		RuUtime:     0.3,
+		Tags:        parseTags("server=test.ru,script=/index.php"),
+		Timers: []pinba.Timer{
+			{HitCount: 2, Value: 0.2, RuUtime: 0.01, Tags: parseTags("group=db,op=select")},
+			{HitCount: 1, Value: 0.1, RuUtime: 0.02, Tags: parseTags("group=cache,op=get")},
+			{HitCount: 1, Value: 0.3, RuUtime: 0.01, Tags: parseTags("group=db,op=update")},
+			{HitCount: 1, Value: 0.05, Tags: parseTags("op=sleep")},
+		},
+	}
+}
+
+func TestBreakdown(t *testing.T) {
+	s := &MetricsSettings{GroupBy: []string{"group"}, Unaccounted: true}
+	tags := parseTags("server=test.ru")
+
+	groups := s.breakdown(testBreakdownRequest(), tags)
+	assert.Len(t, groups, 4)
+	expected := []struct {
+		tags  string
+		value float32
+	}{
+		{" group=db server=test.ru", 0.5},
+		{" group=cache server=test.ru", 0.1},
+		{" group=none server=test.ru", 0.05},
+		{" group=unaccounted server=test.ru", 0.35},
+	}
+	for i, e := range expected {
+		assert.Equal(t, e.tags, groups[i].tags.String())
+		assert.InDelta(t, e.value, groups[i].value, 1e-6)
+	}
+	assert.InDelta(t, 0.02, groups[0].cpu, 1e-6)
+	assert.InDelta(t, 0.26, groups[3].cpu, 1e-6)
+	// Tags of request are not changed
+	assert.Equal(t, " server=test.ru", tags.String())
+
+	// Several tags, CPU time as value and timers longer than request
+	s = &MetricsSettings{GroupBy: []string{"group", "op"}, Unaccounted: true, Value: "cpu"}
+	request := testBreakdownRequest()
+	request.RuUtime = 0
+	groups = s.breakdown(request, tags)
+	assert.Len(t, groups, 5)
+	assert.Equal(t, " group=db op=select server=test.ru", groups[0].tags.String())
+	assert.InDelta(t, 0.01, groups[0].value, 1e-6)
+	assert.Equal(t, " group=unaccounted op=unaccounted server=test.ru", groups[4].tags.String())
+	assert.EqualValues(t, 0, groups[4].value)
+}
+
+func TestWriterBreakdown(t *testing.T) {
+	config := &writerConfig{
+		Prefix: "php.",
+		Metrics: []MetricsSettings{
+			{Name: "breakdown.{server}", Tags: []string{"script"}, Type: "breakdown",
+				GroupBy: []string{"group"}, Unaccounted: true, CPUTime: true},
+		},
+	}
+	assert.NoError(t, config.Validate())
+	w := &Writer{shards: []*Metrics{NewMetrics(0)}}
+	assert.NoError(t, w.configure(config))
+
+	samples, _ := w.match([]*pinba.Request{testBreakdownRequest(), testBreakdownRequest()})
+	values := make(map[string]int)
+	for _, s := range samples[0] {
+		assert.EqualValues(t, 1, s.count)
+		values[s.name+s.tags.String()]++
+	}
+	assert.Equal(t, 2, values["php.breakdown.test.ru group=db script=/index.php"])
+	assert.Equal(t, 2, values["php.breakdown.test.ru.cpu group=unaccounted script=/index.php"])
+	assert.Len(t, values, 8)
+
+	var out bytes.Buffer
+	w.explain(&out, testBreakdownRequest())
+	assert.Contains(t, out.String(), `+ breakdown "breakdown.{server}": php.breakdown.test.ru group=db script=/index.php = 0.5`)
+
+	config.Metrics[0].Value = "memory_peak"
+	assert.Error(t, w.configure(config))
+}
+
+func TestBreakdownSettingsValidate(t *testing.T) {
+	mandatory := []string{"server"}
+	assert.NoError(t, MetricsSettings{Name: "breakdown.{server}", Tags: []string{"script"}, Type: "breakdown",
+		GroupBy: []string{"group"}}.Validate(mandatory))
+
+	for _, s := range []MetricsSettings{
+		{Name: "breakdown", Tags: []string{"server"}, Type: "breakdown"},
+		{Name: "breakdown", Tags: []string{"server", "group"}, Type: "breakdown", GroupBy: []string{"group"}},
+		{Name: "requests", Tags: []string{"server"}, Type: "request", Unaccounted: true},
+		{Name: "timers", Tags: []string{"server"}, Type: "timer", GroupBy: []string{"group"}},
+	} {
+		assert.Error(t, s.Validate(mandatory), "%+v", s)
+	}
+}
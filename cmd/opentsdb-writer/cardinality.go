@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+)
+
+// CardinalitySettings describes limits of unique series and report of
+// metrics and tags with the most of them
+type CardinalitySettings struct {
+	// MaxSeries is limit of unique series in one interval, zero is unlimited.
+	// Values of new series over the limit are folded into "__other__" series,
+	// that keep values of required and mandatory tags
+	MaxSeries int `yaml:"max_series"`
+	// Top is how many metrics and tags to report in self metrics, default 10
+	Top int `yaml:"top"`
+}
+
+// Cardinality is number of unique series of metric, or number of unique
+// values of tag
+type Cardinality struct {
+	Key   string
+	Count int
+}
+
+// topCardinality returns top n metric names by number of series and top n
+// tag keys by number of unique values in given shards of metrics buffer
+func topCardinality(shards []*Metrics, n int) (names, tags []Cardinality) {
+	series := make(map[string]int)
+	values := make(map[string]map[string]struct{})
+	for _, shard := range shards {
+		for _, m := range shard.Data {
+			series[m.Name]++
+			for k, v := range m.Tags {
+				if _, ok := values[k]; !ok {
+					values[k] = make(map[string]struct{})
+				}
+				values[k][v] = struct{}{}
+			}
+		}
+	}
+
+	for name, count := range series {
+		names = append(names, Cardinality{name, count})
+	}
+	for key, v := range values {
+		tags = append(tags, Cardinality{key, len(v)})
+	}
+	return top(names, n), top(tags, n)
+}
+
+// top sorts list by count descending (and by key, to be stable) and returns
+// first n of it
+func top(list []Cardinality, n int) []Cardinality {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count == list[j].Count {
+			return list[i].Key < list[j].Key
+		}
+		return list[i].Count > list[j].Count
+	})
+	if len(list) > n {
+		return list[:n]
+	}
+	return list
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsSeriesLimit(t *testing.T) {
+	settings := &MetricsSettings{
+		newEstimator: func() Estimator { return NewExact() },
+		seriesLimit:  3,
+	}
+
+	metrics := NewMetrics(10)
+	for i := 0; i < 10; i++ {
+		tags := pinba.Tags{{"server", "test.ru"}, {"script", fmt.Sprintf("/item/%d", i)}}
+		metrics.Add(tags, "requests", 1, 0.1, settings)
+		metrics.Add(tags, "requests.cpu", 1, 0.1, settings)
+	}
+
+	// Three series per name and one "__other__" for each of them
+	assert.Len(t, metrics.Data, 8)
+	assert.EqualValues(t, 14, metrics.Overflow)
+	assert.EqualValues(t, 20, metrics.Count)
+
+	other := metrics.Data["requests"+pinba.Tags{{"server", OtherTagValue}, {"script", OtherTagValue}}.String()]
+	if assert.NotNil(t, other) {
+		assert.EqualValues(t, 7, other.Count)
+		assert.Equal(t, OtherTagValue, other.Tags["script"])
+	}
+
+	metrics.Reset()
+	assert.Len(t, metrics.Data, 0)
+	assert.EqualValues(t, 0, metrics.Overflow)
+}
+
+func TestMetricsSeriesLimitKeepTags(t *testing.T) {
+	settings := &MetricsSettings{
+		newEstimator: func() Estimator { return NewExact() },
+		seriesLimit:  2,
+		keepTags:     []string{"server"},
+	}
+
+	metrics := NewMetrics(10)
+	for i := 0; i < 10; i++ {
+		server := fmt.Sprintf("www%d.test.ru", i%2)
+		tags := pinba.Tags{{"server", server}, {"script", fmt.Sprintf("/item/%d", i)}}
+		metrics.Add(tags, "requests", 1, 0.1, settings)
+	}
+
+	// Values over the limit are still counted by server
+	assert.Len(t, metrics.Data, 4)
+	for _, server := range []string{"www0.test.ru", "www1.test.ru"} {
+		other := metrics.Data["requests"+pinba.Tags{{"server", server}, {"script", OtherTagValue}}.String()]
+		if assert.NotNil(t, other, server) {
+			assert.EqualValues(t, 4, other.Count)
+		}
+	}
+}
+
+func TestMetricsTotalLimit(t *testing.T) {
+	settings := &MetricsSettings{newEstimator: func() Estimator { return NewExact() }}
+
+	metrics := NewMetrics(10)
+	metrics.Limit = 5
+	for i := 0; i < 10; i++ {
+		metrics.Add(pinba.Tags{{"script", fmt.Sprintf("/item/%d", i)}}, "requests", 1, 0.1, settings)
+	}
+	// Overflow series itself is allowed over the limit
+	assert.Len(t, metrics.Data, 6)
+	assert.EqualValues(t, 5, metrics.Overflow)
+}
+
+func TestTopCardinality(t *testing.T) {
+	settings := &MetricsSettings{newEstimator: func() Estimator { return NewExact() }}
+
+	first, second := NewMetrics(10), NewMetrics(10)
+	for i := 0; i < 5; i++ {
+		first.Add(pinba.Tags{{"server", "a"}, {"script", fmt.Sprintf("/%d", i)}}, "requests", 1, 0.1, settings)
+		second.Add(pinba.Tags{{"server", "b"}, {"script", fmt.Sprintf("/%d", i)}}, "requests", 1, 0.1, settings)
+	}
+	second.Add(pinba.Tags{{"server", "b"}}, "servers", 1, 0.1, settings)
+
+	names, tags := topCardinality([]*Metrics{first, second}, 1)
+	assert.Equal(t, []Cardinality{{"requests", 10}}, names)
+	assert.Equal(t, []Cardinality{{"script", 5}}, tags)
+
+	names, tags = topCardinality([]*Metrics{first, second}, 10)
+	assert.Equal(t, []Cardinality{{"requests", 10}, {"servers", 1}}, names)
+	assert.Equal(t, []Cardinality{{"script", 5}, {"server", 2}}, tags)
+}
+
+func TestMetricsSeriesLimitExplodingKeptTag(t *testing.T) {
+	settings := &MetricsSettings{
+		newEstimator: func() Estimator { return NewExact() },
+		seriesLimit:  2,
+		keepTags:     []string{"server"},
+	}
+
+	// Required server tag is in name template too, and every request has
+	// its own server
+	metrics := NewMetrics(10)
+	for i := 0; i < 10; i++ {
+		server := fmt.Sprintf("www%d.test.ru", i)
+		tags := pinba.Tags{{"server", server}, {"script", "/index.php"}}
+		name := "requests." + server
+		metrics.add(sample{name + tags.String(), name, "requests.__other__", tags, 1, 0.1, 0, settings})
+	}
+
+	// Two series, two over the limit with kept server and one with
+	// everything folded
+	assert.Len(t, metrics.Data, 5)
+	assert.EqualValues(t, 8, metrics.Overflow)
+	other := metrics.Data["requests.__other__"+pinba.Tags{{"server", OtherTagValue}, {"script", OtherTagValue}}.String()]
+	if assert.NotNil(t, other) {
+		assert.EqualValues(t, 6, other.Count)
+		assert.Equal(t, "requests.__other__", other.Name)
+	}
+}
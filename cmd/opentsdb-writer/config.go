@@ -3,21 +3,49 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 type writerConfig struct {
 	Metrics []MetricsSettings `yaml:"metrics"`
+	// Estimator is default estimator for metrics, that don't set their own
+	Estimator EstimatorSettings `yaml:"estimator"`
 
 	Prefix     string `yaml:"prefix"`
 	Interval   int64  `yaml:"interval"`
 	Workers    int    `yaml:"workers"`
 	BatchSize  int    `yaml:"batch_size"`
 	BufferSize int    `yaml:"buffer_size"`
-	TSDB       struct {
+	// MaxInFlight is number of intervals, that can be sent at the same time
+	MaxInFlight int           `yaml:"max_in_flight"`
+	Shard       ShardSettings `yaml:"shard"`
+	// Limits of unique series and report of metrics with the most of them
+	Cardinality CardinalitySettings `yaml:"cardinality"`
+	// Requests without any of this tags are skipped, default is "server"
+	MandatoryTags []MandatoryTag `yaml:"mandatory_tags"`
+	// Tiers of coarser series, like 1 minute and 1 hour ones
+	Rollups []RollupSettings `yaml:"rollups"`
+	// Cleaning of metric names and tag values from illegal characters
+	Sanitize SanitizeSettings `yaml:"sanitize"`
+	// Data points, that OpenTSDB can't take right now, are kept on disk
+	Spool SpoolSettings `yaml:"spool"`
+	// Rules checked against every interval and where to send alerts
+	Alerts AlertsSettings `yaml:"alerts"`
+	// The slowest requests of every interval with all their tags and timers
+	SlowLog SlowLogSettings `yaml:"slow_log"`
+	TSDB    struct {
 		Host    string `yaml:"host"`
 		Timeout int64  `yaml:"timeout"`
+		// Protocol is "telnet" (default) or "http" for /api/put endpoint
+		Protocol string `yaml:"protocol"`
+		// Gzip compresses requests to /api/put
+		Gzip bool `yaml:"gzip"`
 	} `yaml:"tsdb"`
 }
 
@@ -28,8 +56,155 @@ func getConfig(filename string) (*writerConfig, error) {
 	}
 
 	config := writerConfig{}
-	if err := yaml.Unmarshal(file, &config); err != nil {
+	if err := yaml.UnmarshalStrict(file, &config); err != nil {
 		return nil, fmt.Errorf("unmarshal failed: %v", err)
 	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
 	return &config, nil
 }
+
+// Defaults for settings missing in config
+const (
+	defaultInterval    = 10
+	defaultWorkers     = 1
+	defaultBatchSize   = 1000
+	defaultBufferSize  = 100000
+	defaultTSDBTimeout = 5000
+	defaultMaxInFlight = 2
+	defaultSpoolSize   = 1024
+	defaultSegmentSize = 16
+)
+
+// Validate sets defaults for missing settings and checks that the rest of
+// them makes sense. Settings of estimators, histograms and match conditions
+// are checked by Writer, when it compiles them
+func (c *writerConfig) Validate() error {
+	if c.Interval == 0 {
+		c.Interval = defaultInterval
+	}
+	if c.Workers == 0 {
+		c.Workers = defaultWorkers
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.BufferSize == 0 {
+		c.BufferSize = defaultBufferSize
+	}
+	if c.TSDB.Timeout == 0 {
+		c.TSDB.Timeout = defaultTSDBTimeout
+	}
+	if c.MaxInFlight == 0 {
+		c.MaxInFlight = defaultMaxInFlight
+	}
+	if c.Interval < 0 || c.Workers < 0 || c.BatchSize < 0 || c.BufferSize < 0 || c.TSDB.Timeout < 0 || c.MaxInFlight < 0 {
+		return fmt.Errorf("interval, workers, batch_size, buffer_size, max_in_flight and tsdb.timeout should be positive")
+	}
+	if c.TSDB.Protocol == "" {
+		c.TSDB.Protocol = "telnet"
+	}
+	if c.TSDB.Protocol != "telnet" && c.TSDB.Protocol != "http" {
+		return fmt.Errorf("tsdb.protocol should be telnet or http, got %q", c.TSDB.Protocol)
+	}
+	if err := c.Shard.Validate(); err != nil {
+		return err
+	}
+	if err := c.Spool.Validate(); err != nil {
+		return err
+	}
+	if err := c.SlowLog.Validate(); err != nil {
+		return err
+	}
+	for _, tag := range c.MandatoryTags {
+		if err := tag.Validate(); err != nil {
+			return err
+		}
+	}
+	intervals := make(map[int64]bool, len(c.Rollups))
+	for _, rollup := range c.Rollups {
+		if err := rollup.Validate(c.Interval); err != nil {
+			return err
+		}
+		if intervals[rollup.Interval] {
+			return fmt.Errorf("duplicate rollup interval %d", rollup.Interval)
+		}
+		intervals[rollup.Interval] = true
+	}
+
+	if len(c.Metrics) == 0 {
+		return fmt.Errorf("there is no metrics")
+	}
+	names := make(map[string]bool, len(c.Metrics))
+	for i, metric := range c.Metrics {
+		if err := metric.Validate(c.mandatoryTags()); err != nil {
+			return fmt.Errorf("metric #%d %q: %v", i+1, metric.Name, err)
+		}
+		if names[metric.Name] {
+			return fmt.Errorf("metric #%d: duplicate name %q", i+1, metric.Name)
+		}
+		names[metric.Name] = true
+	}
+	return validateRollups(c)
+}
+
+// mandatoryTags returns names of tags, that every request has
+func (c *writerConfig) mandatoryTags() []string {
+	tags := c.MandatoryTags
+	if tags == nil {
+		tags = defaultMandatoryTags
+	}
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.Tag
+	}
+	return names
+}
+
+// watchConfig reloads config on SIGHUP or when file is changed, prepares it
+// with given function (to apply command line flags) and sends it to reload
+// channel. Failed reloads are only logged
+func watchConfig(filename string, interval time.Duration, prepare func(*writerConfig), reload chan<- *writerConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	modTime := fileModTime(filename)
+	for {
+		select {
+		case <-signals:
+			log.Printf("[INFO] Got SIGHUP, reloading config from %v", filename)
+			modTime = fileModTime(filename)
+
+		case <-ticker.C:
+			t := fileModTime(filename)
+			if t.Equal(modTime) {
+				continue
+			}
+			modTime = t
+			log.Printf("[INFO] Config %v changed, reloading", filename)
+		}
+
+		config, err := getConfig(filename)
+		if err != nil {
+			log.Printf("[ERROR] Failed to reload config from %v: %v", filename, err)
+			continue
+		}
+		prepare(config)
+		reload <- config
+	}
+}
+
+// fileModTime returns modification time of file, or zero time if file is
+// not accessible right now
+func fileModTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
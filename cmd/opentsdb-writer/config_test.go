@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `
+prefix: "php."
+interval: 10
+metrics:
+    - tags: ["server"]
+      name: "requests"
+      type: "request"
+`
+
+func TestWriterConfigure(t *testing.T) {
+	w := &Writer{shards: []*Metrics{NewMetrics(10), NewMetrics(10)}}
+	config := &writerConfig{
+		Prefix: "php.",
+		Metrics: []MetricsSettings{
+			{Name: "requests", Tags: []string{"server"}, Type: "request", MaxSeries: 101},
+			{Name: "timers.{group}", Tags: []string{"group"}, Type: "timer"},
+		},
+	}
+	config.Cardinality.MaxSeries = 1000
+	assert.NoError(t, w.configure(config))
+	assert.Equal(t, "php.", w.prefix)
+	assert.Len(t, w.requestsSettings, 1)
+	assert.Len(t, w.timersSettings, 1)
+	assert.Equal(t, 51, w.requestsSettings[0].seriesLimit)
+	assert.Equal(t, "php.timers.__other__", w.timersSettings[0].otherName)
+	assert.Equal(t, 500, w.shards[0].Limit)
+	assert.Equal(t, defaultMandatoryTags, w.mandatoryTags)
+
+	// Invalid config changes nothing
+	invalid := &writerConfig{
+		Prefix: "test.",
+		Metrics: []MetricsSettings{
+			{Name: "requests", Tags: []string{"server"}, Type: "request"},
+			{Name: "timers", Tags: []string{"group"}, Type: "timer", Value: "memory_peak"},
+		},
+	}
+	assert.Error(t, w.configure(invalid))
+	assert.Equal(t, "php.", w.prefix)
+	assert.Len(t, w.requestsSettings, 1)
+	assert.Equal(t, 500, w.shards[0].Limit)
+}
+
+func TestWriterReload(t *testing.T) {
+	w := &Writer{shards: []*Metrics{NewMetrics(10)}, config: &writerConfig{Interval: 10}}
+	w.config.Shard.Validate()
+	assert.NoError(t, w.configure(w.config))
+
+	config := &writerConfig{
+		Interval: 60,
+		Prefix:   "test.",
+		Metrics:  []MetricsSettings{{Name: "requests", Tags: []string{"server"}, Type: "request"}},
+	}
+	w.reload(config)
+	assert.Equal(t, opentsdb.Tags{"type": "test."}, w.statsTag.Load())
+	assert.Len(t, w.requestsSettings, 1)
+	assert.Equal(t, config, w.config)
+	// Interval can't be reloaded, so config has running one
+	assert.EqualValues(t, 10, w.config.Interval)
+	changed := *w.config
+	changed.Interval = 60
+	assert.Equal(t, []string{"interval"}, restartRequired(w.config, &changed))
+
+	w.reload(&writerConfig{Metrics: []MetricsSettings{{Name: "requests", Type: "request", Value: "?"}}})
+	assert.Equal(t, config, w.config)
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := &writerConfig{Interval: 10, Workers: 4}
+	new := &writerConfig{Interval: 10, Workers: 4, Prefix: "test."}
+	assert.Empty(t, restartRequired(old, new))
+
+	new.Interval = 60
+	new.TSDB.Host = "127.0.0.1:4242"
+	new.Rollups = []RollupSettings{{Interval: 3600, Suffix: ".1h"}}
+	assert.Equal(t, []string{"interval", "tsdb", "rollups"}, restartRequired(old, new))
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-writer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yml")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(testConfig), 0644))
+
+	reload := make(chan *writerConfig, 1)
+	prepare := func(config *writerConfig) { config.TSDB.Host = "tsdb:4242" }
+	go watchConfig(filename, 10*time.Millisecond, prepare, reload)
+	time.Sleep(50 * time.Millisecond)
+
+	// Broken config is not sent
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("metrics: ["), 0644))
+	assert.NoError(t, os.Chtimes(filename, time.Now(), time.Now().Add(time.Second)))
+	select {
+	case <-reload:
+		t.Fatal("broken config should not be reloaded")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(testConfig), 0644))
+	assert.NoError(t, os.Chtimes(filename, time.Now(), time.Now().Add(2*time.Second)))
+	select {
+	case config := <-reload:
+		assert.Equal(t, "php.", config.Prefix)
+		assert.Equal(t, "tsdb:4242", config.TSDB.Host)
+		assert.Len(t, config.Metrics, 1)
+	case <-time.After(time.Second):
+		t.Fatal("config was not reloaded")
+	}
+}
+
+func TestGetConfigDefault(t *testing.T) {
+	config, err := getConfig("config.yml.default")
+	assert.NoError(t, err)
+	assert.Equal(t, "php.", config.Prefix)
+
+	w := &Writer{shards: []*Metrics{NewMetrics(0)}}
+	assert.NoError(t, w.configure(config))
+}
+
+func TestGetConfigStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opentsdb-writer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "config.yml")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(testConfig+"workerz: 4\n"), 0644))
+	_, err = getConfig(filename)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(testConfig+"prefix: \"test.\"\n"), 0644))
+	_, err = getConfig(filename)
+	assert.Error(t, err, "duplicate keys")
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := &writerConfig{Metrics: []MetricsSettings{
+		{Name: "requests", Tags: []string{"server"}, Type: "request"},
+	}}
+	assert.NoError(t, config.Validate())
+	assert.EqualValues(t, defaultInterval, config.Interval)
+	assert.EqualValues(t, defaultWorkers, config.Workers)
+	assert.EqualValues(t, defaultBatchSize, config.BatchSize)
+	assert.EqualValues(t, defaultBufferSize, config.BufferSize)
+	assert.EqualValues(t, defaultTSDBTimeout, config.TSDB.Timeout)
+	assert.Equal(t, 1, config.Shard.Total)
+
+	for _, config := range []*writerConfig{
+		{},
+		{Interval: -10, Metrics: config.Metrics},
+		{Workers: -1, Metrics: config.Metrics},
+		{Shard: ShardSettings{Total: 2, Index: 2}, Metrics: config.Metrics},
+		{MandatoryTags: []MandatoryTag{{Tag: ""}}, Metrics: config.Metrics},
+		{Rollups: []RollupSettings{{Interval: 60}}, Metrics: config.Metrics},
+		{Rollups: []RollupSettings{{Interval: 60, Suffix: ".1m"}, {Interval: 60, Suffix: ".60s"}}, Metrics: config.Metrics},
+		{Rollups: []RollupSettings{{Interval: 60, Suffix: ".1m"}}, Estimator: EstimatorSettings{Type: "exact"}, Metrics: config.Metrics},
+		{Rollups: []RollupSettings{{Interval: 60, Suffix: ".1m"}}, Metrics: []MetricsSettings{
+			{Name: "requests", Tags: []string{"server"}, Type: "request", Estimator: EstimatorSettings{Type: "exact"}},
+		}},
+		{Spool: SpoolSettings{Dir: "/tmp", MaxSize: -1}, Metrics: config.Metrics},
+		{Metrics: []MetricsSettings{
+			{Name: "requests", Tags: []string{"server"}, Type: "request"},
+			{Name: "requests", Tags: []string{"script"}, Type: "request"},
+		}},
+	} {
+		assert.Error(t, config.Validate(), "%+v", config)
+	}
+}
+
+func TestMetricsSettingsValidate(t *testing.T) {
+	mandatory := []string{"server"}
+	for _, s := range []MetricsSettings{
+		{Name: "requests", Tags: []string{"server"}, Type: "request"},
+		{Name: "requests.{server}", Tags: []string{"script"}, Type: "request"},
+		{Name: "timers.{server}.{group}", Tags: []string{"op"}, Type: "timer", ReqiredTags: []string{"server", "group"}},
+	} {
+		assert.NoError(t, s.Validate(mandatory), "%+v", s)
+	}
+
+	for _, s := range []MetricsSettings{
+		{Name: "", Tags: []string{"server"}, Type: "request"},
+		{Name: "requests", Tags: []string{"server"}, Type: "requests"},
+		{Name: "requests", Type: "request"},
+		{Name: "requests.{script}", Tags: []string{"server"}, Type: "request"},
+		{Name: "timers.{server}", Tags: []string{"group"}, Type: "timer"},
+		{Name: "requests.{server", Tags: []string{"server"}, Type: "request"},
+		{Name: "requests.server}", Tags: []string{"server"}, Type: "request"},
+		{Name: "requests.{}", Tags: []string{"server"}, Type: "request"},
+	} {
+		assert.Error(t, s.Validate(mandatory), "%+v", s)
+	}
+}
+
+func TestTemplateTags(t *testing.T) {
+	tags, err := templateTags("timers.{server}.{group}.total")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"server", "group"}, tags)
+
+	tags, err = templateTags("requests")
+	assert.NoError(t, err)
+	assert.Empty(t, tags)
+
+	assert.Equal(t, "timers.__other__.__other__.total", foldName("timers.{server}.{group}.total"))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+)
+
+// runDryRun is "opentsdb-writer dry-run" command. It reads requests from
+// collector or from file with recorded collector stream (for example, saved
+// with "nc collector 5003 > dump.bin"), and explains for every request how
+// metrics from config match it. Nothing is sent to OpenTSDB. Returns exit code
+func runDryRun(args []string) int {
+	flags := flag.NewFlagSet("dry-run", flag.ExitOnError)
+	var (
+		configFile = flags.String("config", "config.yml", "config name, default - config.yml")
+		inAddr     = flags.String("in", "", "collector address to read requests from")
+		file       = flags.String("file", "", "file with recorded collector stream to read requests from")
+		limit      = flags.Int("limit", 0, "stop after explaining this many requests, 0 - no limit")
+	)
+	flags.Parse(args)
+
+	config, err := getConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config from %v: %v\n", *configFile, err)
+		return 1
+	}
+	w := &Writer{shards: []*Metrics{NewMetrics(0)}}
+	if err := w.configure(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config %v: %v\n", *configFile, err)
+		return 1
+	}
+
+	explained := 0
+	handle := func(requests *client.PinbaRequests) bool {
+		for _, request := range requests.Requests {
+			if *limit > 0 && explained >= *limit {
+				return false
+			}
+			fmt.Fprintf(os.Stdout, "[%d] ", requests.Timestamp)
+			w.explain(os.Stdout, request)
+			explained++
+		}
+		return true
+	}
+
+	switch {
+	case *file != "":
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open %v: %v\n", *file, err)
+			return 1
+		}
+		defer f.Close()
+		if err := readRecorded(f, handle); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %v: %v\n", *file, err)
+			return 1
+		}
+
+	case *inAddr != "":
+		pinba, err := client.New(*inAddr, 5*time.Second, 5*time.Second)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create pinba client: %v\n", err)
+			return 1
+		}
+		go pinba.Listen(1)
+		for requests := range pinba.Requests {
+			if !handle(requests) {
+				break
+			}
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "Either --in or --file is required\n")
+		return 1
+	}
+	return 0
+}
+
+// readRecorded reads collector messages from r until EOF and passes decoded
+// requests to handle, until it returns false
+func readRecorded(r io.Reader, handle func(*client.PinbaRequests) bool) error {
+	for {
+		var message client.ServerMessage
+		if err := message.ReadFrom(r); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if message.Data.Len() == 0 {
+			continue
+		}
+
+		requests, err := client.NewPinbaRequests(message.Timestamp, &message.Data)
+		if err != nil {
+			return fmt.Errorf("failed to decode requests for %v: %v", message.Timestamp, err)
+		}
+		if !handle(requests) {
+			return nil
+		}
+	}
+}
+
+// explain writes to out how request is matched by every metric settings:
+// names and tags of series it produces, or why it was skipped
+func (w *Writer) explain(out io.Writer, request *pinba.Request) {
+	fmt.Fprintf(out, "request hostname=%v server=%v script=%v status=%v time=%v tags:%v\n",
+		request.Hostname, request.ServerName, request.ScriptName, request.Status,
+		request.RequestTime, request.Tags.String())
+
+	for _, tag := range w.mandatoryTags {
+		before, _ := tagValue(request.Tags, tag.Tag)
+		var ok bool
+		if request, ok = tag.Apply(request); !ok {
+			fmt.Fprintf(out, "  skipped: no valid %q tag (got %q)\n", tag.Tag, before)
+			return
+		}
+		if after, _ := tagValue(request.Tags, tag.Tag); after != before {
+			fmt.Fprintf(out, "  tag %q set to %q from %v\n", tag.Tag, after, tag.Default)
+		}
+	}
+
+	for i := range w.requestsSettings {
+		config := &w.requestsSettings[i]
+		w.explainRule(out, config, request, request.Tags)
+	}
+
+	for i, timer := range request.Timers {
+		fmt.Fprintf(out, "  timer #%d hits=%v value=%v tags:%v\n", i, timer.HitCount, timer.Value, timer.Tags.String())
+		for j := range w.timersSettings {
+			config := &w.timersSettings[j]
+			w.explainRule(out, config, request, timer.Tags)
+		}
+	}
+
+	for i := range w.breakdownSettings {
+		config := &w.breakdownSettings[i]
+		w.explainRule(out, config, request, request.Tags)
+	}
+}
+
+// explainRule writes result of matching request (or its timer) with given
+// tags by metric settings
+func (w *Writer) explainRule(out io.Writer, config *MetricsSettings, request *pinba.Request, tags pinba.Tags) {
+	indent := "  "
+	if config.Type == "timer" {
+		indent = "    "
+	}
+
+	if config.matcher != nil && !config.matcher.MatchRequest(request) {
+		fmt.Fprintf(out, "%s- %s %q: %s\n", indent, config.Type, config.Name, config.matcher.explainRequest(request))
+		return
+	}
+
+	filtered, reason := config.filter(tags)
+	switch reason {
+	case "":
+		name := w.sanitizer.Name(w.prefix + tags.Stringf(config.Name))
+		if config.Type == "breakdown" {
+			for _, group := range config.breakdown(request, filtered) {
+				fmt.Fprintf(out, "%s+ %s %q: %v%v = %v\n", indent, config.Type, config.Name,
+					name, w.sanitizer.Tags(group.tags).String(), group.value)
+			}
+			return
+		}
+		filtered = w.sanitizer.Tags(filtered)
+		fmt.Fprintf(out, "%s+ %s %q: %v%v\n", indent, config.Type, config.Name, name, filtered.String())
+		if config.CPUTime {
+			fmt.Fprintf(out, "%s+ %s %q: %v%v\n", indent, config.Type, config.Name, name+".cpu", filtered.String())
+		}
+	case skipNoTags:
+		fmt.Fprintf(out, "%s- %s %q: %s %v\n", indent, config.Type, config.Name, reason, config.Tags)
+	case skipRequired:
+		fmt.Fprintf(out, "%s- %s %q: %s %v\n", indent, config.Type, config.Name, reason,
+			missingTags(tags, config.ReqiredTags))
+	case skipTags:
+		fmt.Fprintf(out, "%s- %s %q: %s\n", indent, config.Type, config.Name, config.matcher.explainTags(tags))
+	}
+}
+
+// missingTags returns keys from given list, that are absent in tags
+func missingTags(tags pinba.Tags, keys []string) string {
+	missing := make([]string, 0)
+	for _, key := range keys {
+		if _, ok := tagValue(tags, key); !ok {
+			missing = append(missing, key)
+		}
+	}
+	return strings.Join(missing, ", ")
+}
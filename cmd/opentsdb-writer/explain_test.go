@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// Valid Pinba packet with test request and couple of timers
+var testPinbaPacket = []byte{0xa, 0x8, 0x68, 0x6f, 0x73, 0x74, 0x6e, 0x61, 0x6d, 0x65,
+	0x12, 0x7, 0x74, 0x65, 0x73, 0x74, 0x2e, 0x72, 0x75, 0x1a, 0x9, 0x69, 0x6e,
+	0x64, 0x65, 0x78, 0x2e, 0x70, 0x68, 0x70, 0x20, 0x0, 0x28, 0xa6, 0x2, 0x30,
+	0x80, 0x80, 0x40, 0x3d, 0x7, 0x9b, 0xba, 0x3c, 0x45, 0x0, 0x0, 0x0, 0x0,
+	0x4d, 0xa, 0xd7, 0x23, 0x3c, 0x50, 0x1, 0x50, 0x1, 0x5d, 0x9e, 0xd2, 0xc1,
+	0x3b, 0x5d, 0x4a, 0x96, 0x13, 0x3a, 0x60, 0x3, 0x60, 0x1, 0x68, 0x4, 0x68,
+	0x6, 0x68, 0x8, 0x68, 0xa, 0x70, 0x5, 0x70, 0x7, 0x70, 0x9, 0x70, 0xb, 0x7a,
+	0x8, 0x72, 0x65, 0x71, 0x5f, 0x76, 0x61, 0x6c, 0x31, 0x7a, 0x8, 0x72, 0x65,
+	0x71, 0x5f, 0x74, 0x61, 0x67, 0x31, 0x7a, 0x8, 0x72, 0x65, 0x71, 0x5f, 0x76,
+	0x61, 0x6c, 0x32, 0x7a, 0x8, 0x72, 0x65, 0x71, 0x5f, 0x74, 0x61, 0x67, 0x32,
+	0x7a, 0x4, 0x6b, 0x65, 0x79, 0x31, 0x7a, 0x4, 0x76, 0x61, 0x6c, 0x31, 0x7a,
+	0x4, 0x6b, 0x65, 0x79, 0x32, 0x7a, 0x4, 0x76, 0x61, 0x6c, 0x32, 0x7a, 0x4,
+	0x6b, 0x65, 0x79, 0x33, 0x7a, 0x4, 0x76, 0x61, 0x6c, 0x33, 0x7a, 0x4, 0x6b,
+	0x65, 0x79, 0x34, 0x7a, 0x4, 0x76, 0x61, 0x6c, 0x34, 0x80, 0x1, 0xc8, 0x1,
+	0x88, 0x1, 0x80, 0xc0, 0x85, 0x3, 0xa0, 0x1, 0x1, 0xa0, 0x1, 0x3, 0xa8, 0x1,
+	0x0, 0xa8, 0x1, 0x2, 0xb5, 0x1, 0x0, 0x0, 0x0, 0x0, 0xb5, 0x1, 0x0, 0x0, 0x0,
+	0x0, 0xbd, 0x1, 0x0, 0x0, 0x0, 0x0, 0xbd, 0x1, 0x0, 0x0, 0x0, 0x0}
+
+// recordedMessage returns collector message with given number of requests
+func recordedMessage(ts int32, requests int) []byte {
+	var payload bytes.Buffer
+	zw := zlib.NewWriter(&payload)
+	for i := 0; i < requests; i++ {
+		binary.Write(zw, binary.LittleEndian, int32(len(testPinbaPacket)))
+		zw.Write(testPinbaPacket)
+	}
+	zw.Close()
+
+	var message bytes.Buffer
+	binary.Write(&message, binary.LittleEndian, int32(payload.Len()))
+	binary.Write(&message, binary.LittleEndian, ts)
+	message.Write(payload.Bytes())
+	return message.Bytes()
+}
+
+func TestReadRecorded(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(recordedMessage(1452146656, 2))
+	stream.Write(recordedMessage(1452146657, 3))
+	data := stream.Bytes()
+
+	var timestamps []int64
+	var count int
+	err := readRecorded(bytes.NewReader(data), func(requests *client.PinbaRequests) bool {
+		timestamps = append(timestamps, requests.Timestamp)
+		count += len(requests.Requests)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1452146656, 1452146657}, timestamps)
+	assert.Equal(t, 5, count)
+
+	// Stops when asked
+	count = 0
+	err = readRecorded(bytes.NewReader(data), func(requests *client.PinbaRequests) bool {
+		count += len(requests.Requests)
+		return false
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Truncated stream is an error
+	err = readRecorded(bytes.NewReader(data[:len(data)-10]), func(*client.PinbaRequests) bool { return true })
+	assert.Error(t, err)
+}
+
+func TestWriterExplain(t *testing.T) {
+	config := &writerConfig{
+		Prefix:        "php.",
+		MandatoryTags: []MandatoryTag{{Tag: "server", Default: "server_name"}},
+		Metrics: []MetricsSettings{
+			{Name: "requests", Tags: []string{"server"}, Type: "request", CPUTime: true},
+			{Name: "requests.{server}", Tags: []string{"region"}, Type: "request"},
+			{Name: "requests.user", Tags: []string{"server"}, Type: "request", ReqiredTags: []string{"user"}},
+			{Name: "requests.api", Tags: []string{"server"}, Type: "request",
+				Match: MatchSettings{Script: "^/api/"}},
+			{Name: "requests.humans", Tags: []string{"server"}, Type: "request",
+				Match: MatchSettings{ExcludeTags: map[string]string{"ua": "bot"}}},
+			{Name: "timers.{group}", Tags: []string{"operation"}, Type: "timer", ReqiredTags: []string{"group"}},
+		},
+	}
+	assert.NoError(t, config.Validate())
+	w := &Writer{shards: []*Metrics{NewMetrics(0)}}
+	assert.NoError(t, w.configure(config))
+
+	var out bytes.Buffer
+	w.explain(&out, &pinba.Request{
+		ServerName: "test.ru",
+		ScriptName: "/index.php",
+		Tags:       pinba.Tags{{"ua", "googlebot"}},
+		Timers: []pinba.Timer{
+			{HitCount: 1, Tags: pinba.Tags{{"group", "db"}, {"operation", "select"}}},
+		},
+	})
+	result := out.String()
+	assert.Contains(t, result, `tag "server" set to "test.ru" from server_name`)
+	assert.Contains(t, result, `+ request "requests": php.requests`)
+	assert.Contains(t, result, `+ request "requests": php.requests.cpu`)
+	assert.Contains(t, result, `- request "requests.{server}": no tags from the list [region]`)
+	assert.Contains(t, result, `- request "requests.user": missing required tags user`)
+	assert.Contains(t, result, `- request "requests.api": script "/index.php" doesn't match "^/api/"`)
+	assert.Contains(t, result, `- request "requests.humans": tag "ua"="googlebot" is excluded by "bot"`)
+	assert.Contains(t, result, `+ timer "timers.{group}": php.timers.db`)
+
+	out.Reset()
+	w.explain(&out, &pinba.Request{})
+	assert.Contains(t, out.String(), `skipped: no valid "server" tag`)
+	assert.NotContains(t, out.String(), "requests")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// HistogramSettings describes bucket boundaries of metric histogram. Either
+// explicit list of buckets, or log-linear buckets from min to max with given
+// number of linear steps in every power of ten
+type HistogramSettings struct {
+	Buckets []float64 `yaml:"buckets"`
+
+	Min   float64 `yaml:"min"`
+	Max   float64 `yaml:"max"`
+	Steps int     `yaml:"steps"`
+}
+
+// IsEmpty returns true if histogram is not configured at all
+func (s HistogramSettings) IsEmpty() bool {
+	return len(s.Buckets) == 0 && s.Min == 0 && s.Max == 0 && s.Steps == 0
+}
+
+// Bounds validates settings and returns sorted upper bounds of buckets
+func (s HistogramSettings) Bounds() ([]float64, error) {
+	if len(s.Buckets) > 0 {
+		if s.Min != 0 || s.Max != 0 || s.Steps != 0 {
+			return nil, fmt.Errorf("histogram should have either buckets or min, max and steps")
+		}
+		for i := 1; i < len(s.Buckets); i++ {
+			if s.Buckets[i] <= s.Buckets[i-1] {
+				return nil, fmt.Errorf("histogram buckets should be increasing, got %v after %v",
+					s.Buckets[i], s.Buckets[i-1])
+			}
+		}
+		return s.Buckets, nil
+	}
+
+	if s.Min <= 0 || s.Max <= s.Min {
+		return nil, fmt.Errorf("histogram should have 0 < min < max, got min %v and max %v", s.Min, s.Max)
+	}
+	if s.Steps < 1 {
+		return nil, fmt.Errorf("histogram should have at least one step, got %v", s.Steps)
+	}
+
+	bounds := make([]float64, 0)
+	for decade := math.Pow(10, math.Floor(math.Log10(s.Min))); decade < s.Max; decade *= 10 {
+		for i := 0; i < s.Steps; i++ {
+			// Round to get rid of floating point noise like 0.30000000000000004
+			bound := roundBound(decade * (1 + float64(i)*9/float64(s.Steps)))
+			if bound >= s.Min && bound < s.Max {
+				bounds = append(bounds, bound)
+			}
+		}
+	}
+	return append(bounds, s.Max), nil
+}
+
+func roundBound(value float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'g', 12, 64), 64)
+	return rounded
+}
+
+// Histogram counts values in buckets with fixed boundaries, so counts from
+// different hosts and intervals can be summed up
+type Histogram struct {
+	// Upper bounds of buckets (inclusive)
+	Bounds []float64
+	// Counts of values in buckets, last one is for values above all bounds
+	Counts []int64
+}
+
+// NewHistogram creates new Histogram with given bounds
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		Bounds: bounds,
+		Counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Add increments counter of bucket for given value
+func (h *Histogram) Add(value float64) {
+	h.Counts[sort.SearchFloat64s(h.Bounds, value)]++
+}
+
+// Mergeable checks that other histogram has the same bounds
+func (h *Histogram) Mergeable(other *Histogram) error {
+	if len(h.Bounds) != len(other.Bounds) {
+		return fmt.Errorf("can't merge histograms with different buckets")
+	}
+	for i, bound := range other.Bounds {
+		if h.Bounds[i] != bound {
+			return fmt.Errorf("can't merge histograms with different buckets")
+		}
+	}
+	return nil
+}
+
+// Merge adds counts of other histogram with the same bounds
+func (h *Histogram) Merge(other *Histogram) error {
+	if err := h.Mergeable(other); err != nil {
+		return err
+	}
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+	return nil
+}
+
+// Clone returns copy of histogram with its own counts
+func (h *Histogram) Clone() *Histogram {
+	return &Histogram{Bounds: h.Bounds, Counts: append([]int64(nil), h.Counts...)}
+}
+
+// Cumulative returns number of values less or equal to upper bound of every
+// bucket, last one is total count
+func (h *Histogram) Cumulative() []int64 {
+	result := make([]int64, len(h.Counts))
+	var sum int64
+	for i, count := range h.Counts {
+		sum += count
+		result[i] = sum
+	}
+	return result
+}
+
+// Label returns value of "le" tag for bucket with given index
+func (h *Histogram) Label(i int) string {
+	if i == len(h.Bounds) {
+		return "inf"
+	}
+	return strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+}
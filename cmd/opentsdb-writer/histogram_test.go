@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramBounds(t *testing.T) {
+	bounds, err := HistogramSettings{Buckets: []float64{0.01, 0.1, 1}}.Bounds()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.01, 0.1, 1}, bounds)
+
+	bounds, err = HistogramSettings{Min: 0.01, Max: 1, Steps: 2}.Bounds()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.01, 0.055, 0.1, 0.55, 1}, bounds)
+
+	bounds, err = HistogramSettings{Min: 0.002, Max: 0.05, Steps: 9}.Bounds()
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{0.002, 0.003, 0.004, 0.005, 0.006, 0.007, 0.008, 0.009,
+		0.01, 0.02, 0.03, 0.04, 0.05}, bounds)
+
+	for _, settings := range []HistogramSettings{
+		{Buckets: []float64{0.1, 0.1}},
+		{Buckets: []float64{0.1}, Steps: 2},
+		{Min: 0, Max: 1, Steps: 2},
+		{Min: 1, Max: 0.1, Steps: 2},
+		{Min: 0.1, Max: 1},
+	} {
+		_, err := settings.Bounds()
+		assert.Error(t, err, "%+v", settings)
+	}
+}
+
+func TestHistogramAdd(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 0.5, 1})
+	for _, v := range []float64{0.05, 0.1, 0.2, 0.5, 0.7, 3, 10} {
+		h.Add(v)
+	}
+	assert.Equal(t, []int64{2, 2, 1, 2}, h.Counts)
+	assert.Equal(t, []int64{2, 4, 5, 7}, h.Cumulative())
+	assert.Equal(t, "0.1", h.Label(0))
+	assert.Equal(t, "1", h.Label(2))
+	assert.Equal(t, "inf", h.Label(3))
+}
+
+func TestMetricsAddHistogram(t *testing.T) {
+	settings := &MetricsSettings{newEstimator: func() Estimator { return NewExact() }}
+	tags := pinba.Tags{pinba.Tag{"server", "test.ru"}}
+
+	metrics := NewMetrics(10)
+	metrics.Add(tags, "without", 1, 0.2, settings)
+	settings.buckets = []float64{0.1, 1}
+	metrics.Add(tags, "with", 1, 0.2, settings)
+	metrics.Add(tags, "with", 1, 2, settings)
+
+	for _, m := range metrics.Data {
+		if m.Name == "without" {
+			assert.Nil(t, m.Histogram)
+		} else {
+			assert.Equal(t, []int64{0, 1, 1}, m.Histogram.Counts)
+		}
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Add(0.05)
+	other := h.Clone()
+	other.Add(5)
+
+	assert.NoError(t, h.Merge(other))
+	assert.Equal(t, []int64{2, 0, 1}, h.Counts)
+	assert.Equal(t, []int64{1, 0, 1}, other.Counts)
+
+	assert.Error(t, h.Merge(NewHistogram([]float64{0.1, 2})))
+	assert.Error(t, h.Merge(NewHistogram([]float64{0.1})))
+}
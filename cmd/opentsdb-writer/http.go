@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+)
+
+// Failed batch is retried up to httpRetries times, if there is no fallback
+// for it, with delay doubled after every attempt
+const (
+	httpRetries    = 3
+	httpRetryDelay = time.Second
+)
+
+// HTTPBackend is Backend, that writes to /api/put endpoint of OpenTSDB HTTP
+// API. It asks for details of errors, so rejected data points are logged
+// and counted by reason
+type HTTPBackend struct {
+	url    string
+	gzip   bool
+	client *http.Client
+
+	retries    int
+	retryDelay time.Duration
+
+	queue   chan *opentsdb.DataPoint
+	batches chan Batch
+	errors  chan error
+
+	sent    int64
+	dropped int64
+
+	mu       sync.Mutex
+	rejected map[string]int64
+	fallback func([]*opentsdb.DataPoint) error
+}
+
+// httpPoint is data point as it's sent to /api/put
+type httpPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// httpResponse is response of /api/put?details
+type httpResponse struct {
+	Success int64 `json:"success"`
+	Failed  int64 `json:"failed"`
+	Errors  []struct {
+		Datapoint httpPoint `json:"datapoint"`
+		Error     string    `json:"error"`
+	} `json:"errors"`
+}
+
+// NewHTTPBackend creates backend for OpenTSDB at given host, it can be
+// "host:port" or full URL like "https://tsdb.local"
+func NewHTTPBackend(host string, size int, timeout time.Duration, compress bool) *HTTPBackend {
+	url := host
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	return &HTTPBackend{
+		url:        strings.TrimSuffix(url, "/") + "/api/put?details",
+		gzip:       compress,
+		client:     &http.Client{Timeout: timeout},
+		retries:    httpRetries,
+		retryDelay: httpRetryDelay,
+		queue:      make(chan *opentsdb.DataPoint, size),
+		batches:    make(chan Batch, 100),
+		errors:     make(chan error, 100),
+		rejected:   make(map[string]int64),
+	}
+}
+
+// StartWorkers starts n goroutines, every one of them sends batches of up to
+// batchSize data points, or less if there was nothing new for flush interval
+func (b *HTTPBackend) StartWorkers(n, batchSize int, flush time.Duration) {
+	for i := 0; i < n; i++ {
+		go b.worker(batchSize, flush)
+	}
+}
+
+func (b *HTTPBackend) worker(batchSize int, flush time.Duration) {
+	ticker := time.NewTicker(flush)
+	defer ticker.Stop()
+
+	batch := make([]*opentsdb.DataPoint, 0, batchSize)
+	for {
+		select {
+		case p := <-b.queue:
+			batch = append(batch, p)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		b.deliver(batch)
+		batch = batch[:0]
+	}
+}
+
+// deliver sends batch. Failed batch is handed to fallback, or retried if
+// there is none, and dropped when retries are over. Worker waits after
+// every failure, so OpenTSDB, that is down, is not flooded, and queue fills
+// up, so new data points go to spool
+func (b *HTTPBackend) deliver(batch []*opentsdb.DataPoint) {
+	delay := b.retryDelay
+	for attempt := 0; ; attempt++ {
+		if err := b.send(batch); err == nil {
+			return
+		}
+		if fallback := b.getFallback(); fallback != nil && fallback(batch) == nil {
+			time.Sleep(delay)
+			return
+		}
+		if attempt >= b.retries {
+			atomic.AddInt64(&b.dropped, int64(len(batch)))
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// send posts batch of data points and reports error, if it failed
+func (b *HTTPBackend) send(batch []*opentsdb.DataPoint) error {
+	start := time.Now()
+	if err := b.post(batch); err != nil {
+		b.fail(err)
+		return err
+	}
+	select {
+	case b.batches <- Batch{batch[0].Timestamp, start, time.Now()}:
+	default:
+	}
+	return nil
+}
+
+func (b *HTTPBackend) post(batch []*opentsdb.DataPoint) error {
+	points := make([]httpPoint, len(batch))
+	for i, p := range batch {
+		points[i] = httpPoint{p.Metric, p.Timestamp, p.Value, p.Tags}
+	}
+
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var zw *gzip.Writer
+	if b.gzip {
+		zw = gzip.NewWriter(&body)
+		w = zw
+	}
+	if err := json.NewEncoder(w).Encode(points); err != nil {
+		return fmt.Errorf("failed to encode data points: %v", err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress data points: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest("POST", b.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post data points: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		atomic.AddInt64(&b.sent, int64(len(batch)))
+		return nil
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusBadRequest:
+		// Error of the whole request, like {"error":{...}}, has no counts
+		var result httpResponse
+		if err := json.Unmarshal(data, &result); err != nil || result.Success+result.Failed != int64(len(batch)) {
+			return fmt.Errorf("unexpected response %v: %s", resp.Status, data)
+		}
+		b.reject(result)
+		atomic.AddInt64(&b.sent, result.Success)
+		return nil
+	}
+	return fmt.Errorf("unexpected response %v: %s", resp.Status, data)
+}
+
+// reject logs and counts data points rejected by OpenTSDB
+func (b *HTTPBackend) reject(result httpResponse) {
+	if result.Failed == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range result.Errors {
+		reason := rejectReason(e.Error)
+		b.rejected[reason]++
+		log.Printf("[WARN] OpenTSDB rejected %v %v=%v: %v",
+			e.Datapoint.Metric, e.Datapoint.Tags, e.Datapoint.Value, e.Error)
+	}
+	// OpenTSDB may return details of only some of failed data points
+	if missing := result.Failed - int64(len(result.Errors)); missing > 0 {
+		b.rejected["unknown"] += missing
+	}
+}
+
+// rejectReason returns short reason of rejection by OpenTSDB error message
+func rejectReason(message string) string {
+	message = strings.ToLower(message)
+	switch {
+	case strings.Contains(message, "illegal character"):
+		return "illegal_character"
+	case strings.Contains(message, "too many tags"):
+		return "too_many_tags"
+	case strings.Contains(message, "at least one tag"):
+		return "no_tags"
+	case strings.Contains(message, "no such name"), strings.Contains(message, "unknown metric"):
+		return "unknown_metric"
+	case strings.Contains(message, "timestamp"):
+		return "invalid_timestamp"
+	case strings.Contains(message, "value"):
+		return "invalid_value"
+	}
+	return "other"
+}
+
+// fail reports error to Errors channel, unless nobody reads it
+func (b *HTTPBackend) fail(err error) {
+	select {
+	case b.errors <- err:
+	default:
+	}
+}
+
+func (b *HTTPBackend) Push(p *opentsdb.DataPoint) {
+	select {
+	case b.queue <- p:
+	default:
+		atomic.AddInt64(&b.dropped, 1)
+	}
+}
+
+func (b *HTTPBackend) Queue() (int, int) {
+	return len(b.queue), cap(b.queue)
+}
+
+func (b *HTTPBackend) Stats() (int64, int64) {
+	return atomic.LoadInt64(&b.sent), atomic.LoadInt64(&b.dropped)
+}
+
+func (b *HTTPBackend) Rejected() map[string]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rejected := b.rejected
+	b.rejected = make(map[string]int64)
+	return rejected
+}
+
+func (b *HTTPBackend) Batches() <-chan Batch {
+	return b.batches
+}
+
+func (b *HTTPBackend) Errors() <-chan error {
+	return b.errors
+}
+
+func (b *HTTPBackend) SetFallback(fallback func([]*opentsdb.DataPoint) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fallback = fallback
+}
+
+func (b *HTTPBackend) getFallback() func([]*opentsdb.DataPoint) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.fallback
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTSDB is /api/put endpoint of OpenTSDB, that rejects data points with
+// spaces in metric name and with more than two tags
+type testTSDB struct {
+	sync.Mutex
+	points  []httpPoint
+	batches []int
+	gzipped bool
+}
+
+func (s *testTSDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.URL.Path != "/api/put" || r.URL.Query()["details"] == nil {
+		http.Error(w, "unexpected request "+r.URL.String(), http.StatusNotFound)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		s.gzipped = true
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+
+	var points []httpPoint
+	if err := json.NewDecoder(body).Decode(&points); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.batches = append(s.batches, len(points))
+
+	var result httpResponse
+	for _, p := range points {
+		var message string
+		switch {
+		case strings.Contains(p.Metric, " "):
+			message = fmt.Sprintf("Invalid metric (%q): illegal character:  ", p.Metric)
+		case len(p.Tags) > 2:
+			message = "Too many tags: 3 maximum allowed: 2"
+		default:
+			result.Success++
+			s.points = append(s.points, p)
+			continue
+		}
+		result.Failed++
+		result.Errors = append(result.Errors, struct {
+			Datapoint httpPoint `json:"datapoint"`
+			Error     string    `json:"error"`
+		}{p, message})
+	}
+
+	if result.Failed == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(result)
+}
+
+func waitSent(t *testing.T, b *HTTPBackend, n int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if sent, dropped := b.Stats(); sent+dropped >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("data points were not sent in time")
+}
+
+func TestHTTPBackend(t *testing.T) {
+	tsdb := &testTSDB{}
+	server := httptest.NewServer(tsdb)
+	defer server.Close()
+
+	b := NewHTTPBackend(server.URL, 100, time.Second, true)
+	for i := 0; i < 25; i++ {
+		b.Push(&opentsdb.DataPoint{"php.requests.rps", 1500000000, i, opentsdb.Tags{"server": "test"}})
+	}
+	b.StartWorkers(2, 10, 10*time.Millisecond)
+	waitSent(t, b, 25)
+
+	tsdb.Lock()
+	defer tsdb.Unlock()
+	assert.True(t, tsdb.gzipped)
+	assert.Len(t, tsdb.points, 25)
+	for _, size := range tsdb.batches {
+		assert.True(t, size <= 10)
+	}
+	assert.Equal(t, "php.requests.rps", tsdb.points[0].Metric)
+	assert.Equal(t, map[string]string{"server": "test"}, tsdb.points[0].Tags)
+
+	sent, dropped := b.Stats()
+	assert.Equal(t, int64(25), sent)
+	assert.Equal(t, int64(0), dropped)
+	assert.Empty(t, b.Rejected())
+
+	batch := <-b.Batches()
+	assert.Equal(t, int64(1500000000), batch.Timestamp)
+	assert.False(t, batch.Stop.Before(batch.Start))
+}
+
+func TestHTTPBackendRejected(t *testing.T) {
+	tsdb := &testTSDB{}
+	server := httptest.NewServer(tsdb)
+	defer server.Close()
+
+	b := NewHTTPBackend(strings.TrimPrefix(server.URL, "http://"), 100, time.Second, false)
+	b.Push(&opentsdb.DataPoint{"php.requests.rps", 1500000000, 1, opentsdb.Tags{"server": "test"}})
+	b.Push(&opentsdb.DataPoint{"php.bad name", 1500000000, 1, opentsdb.Tags{"server": "test"}})
+	b.Push(&opentsdb.DataPoint{"php.bad name 2", 1500000000, 1, opentsdb.Tags{"server": "test"}})
+	b.Push(&opentsdb.DataPoint{"php.requests.rps", 1500000000, 1, opentsdb.Tags{"a": "1", "b": "2", "c": "3"}})
+	b.StartWorkers(1, 10, 10*time.Millisecond)
+	waitSent(t, b, 1)
+
+	// Rejected data points are neither sent nor dropped
+	sent, dropped := b.Stats()
+	assert.Equal(t, int64(1), sent)
+	assert.Equal(t, int64(0), dropped)
+	assert.Equal(t, map[string]int64{"illegal_character": 2, "too_many_tags": 1}, b.Rejected())
+	assert.Empty(t, b.Rejected())
+}
+
+func TestHTTPBackendError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "hbase is down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	b := NewHTTPBackend(server.URL, 100, time.Second, false)
+	b.retryDelay = time.Millisecond
+	for i := 0; i < 5; i++ {
+		b.Push(&opentsdb.DataPoint{"php.requests.rps", 1500000000, i, opentsdb.Tags{"server": "test"}})
+	}
+	b.StartWorkers(1, 10, 10*time.Millisecond)
+	waitSent(t, b, 5)
+
+	// Batch is dropped only after all retries
+	sent, dropped := b.Stats()
+	assert.Equal(t, int64(0), sent)
+	assert.Equal(t, int64(5), dropped)
+	assert.Len(t, b.Errors(), httpRetries+1)
+	err := <-b.Errors()
+	assert.Contains(t, err.Error(), "hbase is down")
+}
+
+func TestHTTPBackendRequestError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":{"code":400,"message":"Unable to parse the given JSON"}}`)
+	}))
+	defer server.Close()
+
+	b := NewHTTPBackend(server.URL, 100, time.Second, false)
+	b.retryDelay = time.Millisecond
+	for i := 0; i < 5; i++ {
+		b.Push(&opentsdb.DataPoint{"php.requests.rps", 1500000000, i, opentsdb.Tags{"server": "test"}})
+	}
+	b.StartWorkers(1, 10, 10*time.Millisecond)
+	waitSent(t, b, 5)
+
+	// Batch is neither sent nor rejected, so it's retried and dropped
+	sent, dropped := b.Stats()
+	assert.Equal(t, int64(0), sent)
+	assert.Equal(t, int64(5), dropped)
+	assert.Empty(t, b.Rejected())
+	err := <-b.Errors()
+	assert.Contains(t, err.Error(), "Unable to parse")
+}
+
+func TestHTTPBackendRetry(t *testing.T) {
+	tsdb := &testTSDB{}
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// OpenTSDB is down for the first two attempts
+		if atomic.AddInt64(&requests, 1) <= 2 {
+			http.Error(w, "hbase is down", http.StatusInternalServerError)
+			return
+		}
+		tsdb.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	b := NewHTTPBackend(server.URL, 100, time.Second, false)
+	b.retryDelay = time.Millisecond
+	for i := 0; i < 5; i++ {
+		b.Push(&opentsdb.DataPoint{"php.requests.rps", 1500000000, i, opentsdb.Tags{"server": "test"}})
+	}
+	b.StartWorkers(1, 10, 10*time.Millisecond)
+	waitSent(t, b, 5)
+
+	sent, dropped := b.Stats()
+	assert.Equal(t, int64(5), sent)
+	assert.Equal(t, int64(0), dropped)
+}
+
+func TestHTTPBackendQueue(t *testing.T) {
+	b := NewHTTPBackend("127.0.0.1:4242", 2, time.Second, false)
+	for i := 0; i < 3; i++ {
+		b.Push(&opentsdb.DataPoint{"php.requests.rps", 1500000000, i, opentsdb.Tags{"server": "test"}})
+	}
+	queued, size := b.Queue()
+	assert.Equal(t, 2, queued)
+	assert.Equal(t, 2, size)
+	_, dropped := b.Stats()
+	assert.Equal(t, int64(1), dropped)
+}
+
+func TestRejectReason(t *testing.T) {
+	assert.Equal(t, "illegal_character", rejectReason(`Invalid metric ("a b"): illegal character:  `))
+	assert.Equal(t, "too_many_tags", rejectReason("Too many tags: 9 maximum allowed: 8"))
+	assert.Equal(t, "no_tags", rejectReason("Need at least one tag"))
+	assert.Equal(t, "unknown_metric", rejectReason("No such name for 'metrics': 'php.test'"))
+	assert.Equal(t, "invalid_timestamp", rejectReason("Invalid timestamp"))
+	assert.Equal(t, "invalid_value", rejectReason("Unable to parse value to a number"))
+	assert.Equal(t, "other", rejectReason("Something went wrong"))
+}
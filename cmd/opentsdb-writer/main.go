@@ -4,16 +4,28 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/olegfedoseev/pinba-server/client"
 )
 
 func main() {
+	// opentsdb-writer validate --config config.yml
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:]))
+	}
+	// opentsdb-writer dry-run --config config.yml --in 127.0.0.1:5003
+	if len(os.Args) > 1 && os.Args[1] == "dry-run" {
+		os.Exit(runDryRun(os.Args[2:]))
+	}
+
 	var (
 		inAddr     = flag.String("in", "", "incoming socket")
 		tsdbAddr   = flag.String("tsdb", "", "tsdb host:port")
 		configFile = flag.String("config", "config.yml", "config name, default - config.yml")
+		shardIndex = flag.Int("shard-index", -1, "index of this writer, overrides shard.index from config")
+		shardTotal = flag.Int("shard-total", 0, "number of writers, overrides shard.total from config")
 	)
 	flag.Parse()
 
@@ -21,10 +33,20 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load config from %v: %v", *configFile, err)
 	}
-	// Overwrite OpenTSDB host in config
-	if *tsdbAddr != "" {
-		config.TSDB.Host = *tsdbAddr
+	// Overwrite config with command line flags, so every writer can use
+	// the same config
+	applyFlags := func(config *writerConfig) {
+		if *tsdbAddr != "" {
+			config.TSDB.Host = *tsdbAddr
+		}
+		if *shardIndex >= 0 {
+			config.Shard.Index = *shardIndex
+		}
+		if *shardTotal > 0 {
+			config.Shard.Total = *shardTotal
+		}
 	}
+	applyFlags(config)
 
 	pinba, err := client.New(*inAddr, 5*time.Second, 5*time.Second)
 	if err != nil {
@@ -41,7 +63,12 @@ func main() {
 	fmt.Printf("OpenTSDB at %q\n", config.TSDB.Host)
 	fmt.Printf("Interval is %d\n", config.Interval)
 	fmt.Printf("Prefix is %q\n", config.Prefix)
+	fmt.Printf("Shard is %d of %d, with %d aggregators\n",
+		config.Shard.Index, config.Shard.Total, config.Shard.Aggregators)
 	fmt.Println()
 
+	// Reload metrics on SIGHUP or when config is changed
+	go watchConfig(*configFile, 5*time.Second, applyFlags, writer.Reload)
+
 	writer.Start(pinba.Requests)
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/olegfedoseev/pinba"
+)
+
+// MandatoryTag describes tag, that every request should have, otherwise
+// request is skipped
+type MandatoryTag struct {
+	Tag string `yaml:"tag"`
+	// Reject is list of values, that are treated as missing tag
+	Reject []string `yaml:"reject"`
+	// Default is request field to take value from, if tag is missing or
+	// rejected: "hostname" or "server_name"
+	Default string `yaml:"default"`
+}
+
+// defaultMandatoryTags is used if there is no mandatory_tags in config
+var defaultMandatoryTags = []MandatoryTag{
+	{Tag: "server", Reject: []string{"unknown"}},
+}
+
+// Validate checks that tag and its default are known
+func (t MandatoryTag) Validate() error {
+	if t.Tag == "" {
+		return fmt.Errorf("mandatory tag should have name")
+	}
+	switch t.Default {
+	case "", "hostname", "server_name":
+		return nil
+	}
+	return fmt.Errorf("invalid default %q for mandatory tag %q, should be hostname or server_name",
+		t.Default, t.Tag)
+}
+
+// Apply checks that request has valid value of tag. If it hasn't, it returns
+// copy of request with value set from default field, given request is not
+// changed, so slow log and others see it as it was. Returns false if request
+// should be skipped
+func (t MandatoryTag) Apply(request *pinba.Request) (*pinba.Request, bool) {
+	for i, tag := range request.Tags {
+		if tag.Key != t.Tag {
+			continue
+		}
+		if t.valid(tag.Value) {
+			return request, true
+		}
+		if value := t.defaultValue(request); t.valid(value) {
+			result := withTags(request, len(request.Tags))
+			result.Tags[i].Value = value
+			return result, true
+		}
+		return request, false
+	}
+
+	if value := t.defaultValue(request); t.valid(value) {
+		result := withTags(request, len(request.Tags)+1)
+		result.Tags = append(result.Tags, pinba.Tag{Key: t.Tag, Value: value})
+		return result, true
+	}
+	return request, false
+}
+
+// withTags returns copy of request with its own copy of tags, that has
+// room for given number of them
+func withTags(request *pinba.Request, size int) *pinba.Request {
+	result := *request
+	result.Tags = append(make(pinba.Tags, 0, size), request.Tags...)
+	return &result
+}
+
+func (t MandatoryTag) valid(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, rejected := range t.Reject {
+		if value == rejected {
+			return false
+		}
+	}
+	return true
+}
+
+func (t MandatoryTag) defaultValue(request *pinba.Request) string {
+	switch t.Default {
+	case "hostname":
+		return request.Hostname
+	case "server_name":
+		return request.ServerName
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMandatoryTagValidate(t *testing.T) {
+	assert.NoError(t, MandatoryTag{Tag: "server"}.Validate())
+	assert.NoError(t, MandatoryTag{Tag: "server", Default: "hostname"}.Validate())
+	assert.NoError(t, MandatoryTag{Tag: "server", Default: "server_name"}.Validate())
+	assert.Error(t, MandatoryTag{}.Validate())
+	assert.Error(t, MandatoryTag{Tag: "server", Default: "script_name"}.Validate())
+}
+
+func TestMandatoryTagApply(t *testing.T) {
+	tag := MandatoryTag{Tag: "server", Reject: []string{"unknown"}}
+
+	apply := func(request *pinba.Request) bool {
+		_, ok := tag.Apply(request)
+		return ok
+	}
+	assert.True(t, apply(&pinba.Request{Tags: pinba.Tags{{"server", "test.ru"}}}))
+	assert.False(t, apply(&pinba.Request{Tags: pinba.Tags{{"server", "unknown"}}}))
+	assert.False(t, apply(&pinba.Request{Tags: pinba.Tags{{"server", ""}}}))
+	assert.False(t, apply(&pinba.Request{ServerName: "test.ru"}))
+
+	// Valid request is used as it is
+	request := &pinba.Request{Tags: pinba.Tags{{"server", "test.ru"}}}
+	result, _ := tag.Apply(request)
+	assert.True(t, result == request)
+
+	// Missing tag is filled from request field in copy of request
+	tag.Default = "server_name"
+	request = &pinba.Request{ServerName: "test.ru", Tags: pinba.Tags{{"script", "index.php"}}}
+	result, ok := tag.Apply(request)
+	assert.True(t, ok)
+	assert.Equal(t, pinba.Tags{{"script", "index.php"}, {"server", "test.ru"}}, result.Tags)
+	assert.Equal(t, "test.ru", result.ServerName)
+	assert.Equal(t, pinba.Tags{{"script", "index.php"}}, request.Tags)
+
+	// And so is rejected one
+	tag.Default = "hostname"
+	request = &pinba.Request{Hostname: "web1", Tags: pinba.Tags{{"server", "unknown"}}}
+	result, ok = tag.Apply(request)
+	assert.True(t, ok)
+	assert.Equal(t, pinba.Tags{{"server", "web1"}}, result.Tags)
+	assert.Equal(t, pinba.Tags{{"server", "unknown"}}, request.Tags)
+
+	// Unless default is rejected too
+	request = &pinba.Request{Hostname: "unknown"}
+	assert.False(t, apply(request))
+}
+
+func TestWriterMatchSkipped(t *testing.T) {
+	w := &Writer{
+		prefix:        "php.",
+		shards:        []*Metrics{NewMetrics(10)},
+		mandatoryTags: defaultMandatoryTags,
+		requestsSettings: []MetricsSettings{{
+			Name:         "requests",
+			Tags:         []string{"server"},
+			newEstimator: func() Estimator { return NewExact() },
+			requestValue: requestValues["request_time"],
+		}},
+	}
+
+	samples, skipped := w.match([]*pinba.Request{
+		{Tags: pinba.Tags{{"server", "test.ru"}}},
+		{Tags: pinba.Tags{{"server", "unknown"}}},
+		{Tags: pinba.Tags{{"script", "index.php"}}},
+	})
+	assert.Len(t, samples[0], 1)
+	assert.Equal(t, map[string]int64{"server": 2}, skipped)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olegfedoseev/pinba"
+)
+
+// MatchSettings describes conditions on request, that should be met for
+// request (or its timers) to be counted in metric. Every field is optional,
+// hostname, server and script are regular expressions
+type MatchSettings struct {
+	Hostname string `yaml:"hostname"`
+	Server   string `yaml:"server"`
+	Script   string `yaml:"script"`
+	// Status is list of HTTP status codes or ranges of them, like "500-599"
+	Status []string `yaml:"status"`
+	// Tags should be present and their values should match given regexps.
+	// For timers they are checked against timer tags
+	Tags map[string]string `yaml:"tags"`
+	// ExcludeTags should be absent or their values should not match
+	ExcludeTags map[string]string `yaml:"exclude_tags"`
+}
+
+// IsEmpty returns true if there is no conditions at all
+func (s MatchSettings) IsEmpty() bool {
+	return s.Hostname == "" && s.Server == "" && s.Script == "" &&
+		len(s.Status) == 0 && len(s.Tags) == 0 && len(s.ExcludeTags) == 0
+}
+
+type statusRange struct {
+	from, to int
+}
+
+// Matcher is compiled MatchSettings
+type Matcher struct {
+	hostname    *regexp.Regexp
+	server      *regexp.Regexp
+	script      *regexp.Regexp
+	status      []statusRange
+	tags        map[string]*regexp.Regexp
+	excludeTags map[string]*regexp.Regexp
+	// keys of tags and excludeTags in order, so they are checked and
+	// explained the same way every time
+	tagKeys     []string
+	excludeKeys []string
+}
+
+// Compile validates settings and returns Matcher for them
+func (s MatchSettings) Compile() (*Matcher, error) {
+	var err error
+	m := &Matcher{}
+
+	if m.hostname, err = compileRegexp("hostname", s.Hostname); err != nil {
+		return nil, err
+	}
+	if m.server, err = compileRegexp("server", s.Server); err != nil {
+		return nil, err
+	}
+	if m.script, err = compileRegexp("script", s.Script); err != nil {
+		return nil, err
+	}
+
+	for _, status := range s.Status {
+		r, err := parseStatusRange(status)
+		if err != nil {
+			return nil, err
+		}
+		m.status = append(m.status, r)
+	}
+
+	if m.tags, err = compileTags(s.Tags); err != nil {
+		return nil, err
+	}
+	if m.excludeTags, err = compileTags(s.ExcludeTags); err != nil {
+		return nil, err
+	}
+	m.tagKeys, m.excludeKeys = sortedKeys(s.Tags), sortedKeys(s.ExcludeTags)
+	return m, nil
+}
+
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func compileRegexp(name, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s regexp %q: %v", name, expr, err)
+	}
+	return re, nil
+}
+
+func compileTags(tags map[string]string) (map[string]*regexp.Regexp, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]*regexp.Regexp, len(tags))
+	for _, key := range sortedKeys(tags) {
+		expr := tags[key]
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q for tag %q: %v", expr, key, err)
+		}
+		result[key] = re
+	}
+	return result, nil
+}
+
+func parseStatusRange(status string) (statusRange, error) {
+	parts := strings.SplitN(status, "-", 2)
+	from, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return statusRange{}, fmt.Errorf("invalid status %q", status)
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil || to < from {
+			return statusRange{}, fmt.Errorf("invalid status range %q", status)
+		}
+	}
+	return statusRange{from, to}, nil
+}
+
+// MatchRequest checks conditions on request fields
+func (m *Matcher) MatchRequest(request *pinba.Request) bool {
+	return m.requestMismatch(request) == ""
+}
+
+// requestMismatch returns name of first request field, that doesn't meet
+// conditions, or empty string if all of them are met
+func (m *Matcher) requestMismatch(request *pinba.Request) string {
+	if m.hostname != nil && !m.hostname.MatchString(request.Hostname) {
+		return "hostname"
+	}
+	if m.server != nil && !m.server.MatchString(request.ServerName) {
+		return "server"
+	}
+	if m.script != nil && !m.script.MatchString(request.ScriptName) {
+		return "script"
+	}
+	if len(m.status) > 0 {
+		status := int(request.Status)
+		for _, r := range m.status {
+			if status >= r.from && status <= r.to {
+				return ""
+			}
+		}
+		return "status"
+	}
+	return ""
+}
+
+// MatchTags checks conditions on tags of request or timer
+func (m *Matcher) MatchTags(tags pinba.Tags) bool {
+	return m.tagsMismatch(tags) == ""
+}
+
+// tagsMismatch returns key of first tag in order of keys, that doesn't meet
+// conditions, or empty string if all of them are met
+func (m *Matcher) tagsMismatch(tags pinba.Tags) string {
+	for _, key := range m.tagKeys {
+		value, ok := tagValue(tags, key)
+		if !ok || !m.tags[key].MatchString(value) {
+			return key
+		}
+	}
+	for _, key := range m.excludeKeys {
+		if value, ok := tagValue(tags, key); ok && m.excludeTags[key].MatchString(value) {
+			return key
+		}
+	}
+	return ""
+}
+
+// explainRequest describes why request doesn't meet conditions
+func (m *Matcher) explainRequest(request *pinba.Request) string {
+	switch m.requestMismatch(request) {
+	case "hostname":
+		return fmt.Sprintf("hostname %q doesn't match %q", request.Hostname, m.hostname)
+	case "server":
+		return fmt.Sprintf("server %q doesn't match %q", request.ServerName, m.server)
+	case "script":
+		return fmt.Sprintf("script %q doesn't match %q", request.ScriptName, m.script)
+	case "status":
+		return fmt.Sprintf("status %v isn't in %v", request.Status, m.status)
+	}
+	return ""
+}
+
+// explainTags describes why tags don't meet conditions
+func (m *Matcher) explainTags(tags pinba.Tags) string {
+	key := m.tagsMismatch(tags)
+	if key == "" {
+		return ""
+	}
+	value, ok := tagValue(tags, key)
+	if re, found := m.tags[key]; found && (!ok || !re.MatchString(value)) {
+		if !ok {
+			return fmt.Sprintf("tag %q is missing", key)
+		}
+		return fmt.Sprintf("tag %q=%q doesn't match %q", key, value, re)
+	}
+	return fmt.Sprintf("tag %q=%q is excluded by %q", key, value, m.excludeTags[key])
+}
+
+func (r statusRange) String() string {
+	if r.from == r.to {
+		return strconv.Itoa(r.from)
+	}
+	return fmt.Sprintf("%d-%d", r.from, r.to)
+}
+
+func tagValue(tags pinba.Tags, key string) (string, bool) {
+	for _, tag := range tags {
+		if tag.Key == key {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
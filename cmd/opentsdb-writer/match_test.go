@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchSettingsCompile(t *testing.T) {
+	assert.True(t, MatchSettings{}.IsEmpty())
+	assert.False(t, MatchSettings{Status: []string{"500"}}.IsEmpty())
+
+	_, err := MatchSettings{Script: "^/api/", Status: []string{"500-599", "404"}}.Compile()
+	assert.NoError(t, err)
+
+	for _, settings := range []MatchSettings{
+		{Hostname: "("},
+		{Script: "[a-"},
+		{Status: []string{"5xx"}},
+		{Status: []string{"599-500"}},
+		{Status: []string{"500-"}},
+		{Tags: map[string]string{"user": "("}},
+		{ExcludeTags: map[string]string{"user": "("}},
+	} {
+		_, err := settings.Compile()
+		assert.Error(t, err, "%+v", settings)
+	}
+}
+
+func TestMatcherMatchRequest(t *testing.T) {
+	request := &pinba.Request{
+		Hostname:   "web1",
+		ServerName: "api.test.ru",
+		ScriptName: "/api/v1/users",
+		Status:     503,
+	}
+
+	for _, c := range []struct {
+		settings MatchSettings
+		expected bool
+	}{
+		{MatchSettings{}, true},
+		{MatchSettings{Hostname: "^web"}, true},
+		{MatchSettings{Hostname: "^db"}, false},
+		{MatchSettings{Server: `^api\.`}, true},
+		{MatchSettings{Server: `^www\.`}, false},
+		{MatchSettings{Script: "^/api/"}, true},
+		{MatchSettings{Script: "^/admin/"}, false},
+		{MatchSettings{Status: []string{"500-599"}}, true},
+		{MatchSettings{Status: []string{"404", "503"}}, true},
+		{MatchSettings{Status: []string{"200-299", "404"}}, false},
+		{MatchSettings{Script: "^/api/", Status: []string{"200"}}, false},
+	} {
+		m, err := c.settings.Compile()
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, m.MatchRequest(request), "%+v", c.settings)
+	}
+}
+
+func TestMatcherMatchTags(t *testing.T) {
+	tags := pinba.Tags{{"server", "test.ru"}, {"user", "bot42"}}
+
+	for _, c := range []struct {
+		settings MatchSettings
+		expected bool
+	}{
+		{MatchSettings{}, true},
+		{MatchSettings{Tags: map[string]string{"user": "^bot"}}, true},
+		{MatchSettings{Tags: map[string]string{"user": "^human"}}, false},
+		{MatchSettings{Tags: map[string]string{"region": ".*"}}, false},
+		{MatchSettings{ExcludeTags: map[string]string{"user": "^bot"}}, false},
+		{MatchSettings{ExcludeTags: map[string]string{"user": "^human"}}, true},
+		{MatchSettings{ExcludeTags: map[string]string{"region": ".*"}}, true},
+	} {
+		m, err := c.settings.Compile()
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, m.MatchTags(tags), "%+v", c.settings)
+	}
+}
+
+func TestMatcherExplainTagsOrder(t *testing.T) {
+	tags := pinba.Tags{{"server", "test.ru"}, {"user", "bot42"}}
+	m, err := MatchSettings{
+		Tags:        map[string]string{"user": "^human", "region": ".*", "server": "^www"},
+		ExcludeTags: map[string]string{"user": "^bot"},
+	}.Compile()
+	assert.NoError(t, err)
+
+	// The first failed tag in order of keys is explained every time
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, `tag "region" is missing`, m.explainTags(tags))
+	}
+	m, err = MatchSettings{ExcludeTags: map[string]string{"user": "^bot", "server": "test"}}.Compile()
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, `tag "server"="test.ru" is excluded by "test"`, m.explainTags(tags))
+	}
+}
+
+func TestWriterMatch(t *testing.T) {
+	matcher, _ := MatchSettings{Script: "^/api/", Status: []string{"500-599"}}.Compile()
+	w := &Writer{
+		prefix: "php.",
+		shards: []*Metrics{NewMetrics(10)},
+		requestsSettings: []MetricsSettings{{
+			Name:         "errors",
+			Tags:         []string{"server"},
+			matcher:      matcher,
+			newEstimator: func() Estimator { return NewExact() },
+			requestValue: requestValues["request_time"],
+		}},
+	}
+
+	tags := pinba.Tags{{"server", "test.ru"}}
+	samples, _ := w.match([]*pinba.Request{
+		{ScriptName: "/api/users", Status: 500, Tags: tags},
+		{ScriptName: "/api/users", Status: 200, Tags: tags},
+		{ScriptName: "/index.php", Status: 502, Tags: tags},
+		{ScriptName: "/api/posts", Status: 504, Tags: tags},
+	})
+	assert.Len(t, samples[0], 2)
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"math"
-	"sort"
+	"strings"
 
 	"github.com/olegfedoseev/opentsdb"
 	"github.com/olegfedoseev/pinba"
@@ -14,38 +15,312 @@ type MetricsSettings struct {
 	Type        string   `yaml:"type"`
 	ReqiredTags []string `yaml:"required"`
 	CPUTime     bool     `yaml:"cpu"`
+	// Value is which field of request (or timer) is metric value, see
+	// requestValues, default is request_time for requests and value for timers
+	Value string `yaml:"value"`
+	// StatusCodes enables counters of requests by HTTP status class and rate
+	// of 5xx errors
+	StatusCodes bool `yaml:"status_codes"`
+	// GroupBy is timer tags, which values are series of breakdown metric:
+	// values of timers of request with the same values are summed up
+	GroupBy []string `yaml:"group_by"`
+	// Unaccounted adds series of breakdown with "unaccounted" values of
+	// GroupBy tags, it's value of request minus sum of all its timers
+	Unaccounted bool `yaml:"unaccounted"`
+
+	requestValue func(r *pinba.Request) float32
+
+	// Match is additional conditions on request fields and tags
+	Match   MatchSettings `yaml:"match"`
+	matcher *Matcher
+
+	Estimator    EstimatorSettings `yaml:"estimator"`
+	newEstimator func() Estimator
+
+	Histogram HistogramSettings `yaml:"histogram"`
+	buckets   []float64
+
+	// SLO enables Apdex score, good and bad counters and burn rates
+	SLO SLOSettings `yaml:"slo"`
+	slo *SLOSettings
+
+	// MaxSeries is limit of unique tags combinations for every metric name
+	// of this settings in one interval, zero is unlimited
+	MaxSeries   int `yaml:"max_series"`
+	seriesLimit int
+	// keepTags are required and mandatory tags, their values are kept in
+	// series over the limit, so totals by them are still right
+	keepTags []string
+	// otherName is full name of metric with OtherTagValue in every
+	// placeholder, series are limited by it, not by rendered name
+	otherName string
+}
+
+// Validate checks metric name, type and tags. Every placeholder in name should
+// be guaranteed to be present: it should be in required tags, or, for request
+// and breakdown metrics, in mandatory tags
+func (s MetricsSettings) Validate(mandatoryTags []string) error {
+	if s.Name == "" {
+		return fmt.Errorf("name is empty")
+	}
+	if s.Type != "request" && s.Type != "timer" && s.Type != "breakdown" {
+		return fmt.Errorf("type should be request, timer or breakdown, got %q", s.Type)
+	}
+	if len(s.Tags) == 0 {
+		return fmt.Errorf("there is no tags, OpenTSDB needs at least one")
+	}
+	if s.Type == "breakdown" && len(s.GroupBy) == 0 {
+		return fmt.Errorf("breakdown metric needs group_by tags")
+	}
+	if s.Type != "breakdown" && (len(s.GroupBy) > 0 || s.Unaccounted) {
+		return fmt.Errorf("group_by and unaccounted are only for breakdown metrics")
+	}
+	for _, tag := range s.GroupBy {
+		if contains(s.Tags, tag) {
+			return fmt.Errorf("tag %q is both in tags and group_by", tag)
+		}
+	}
+
+	placeholders, err := templateTags(s.Name)
+	if err != nil {
+		return err
+	}
+	guaranteed := s.ReqiredTags
+	if s.Type != "timer" {
+		guaranteed = append(guaranteed[:len(guaranteed):len(guaranteed)], mandatoryTags...)
+	}
+	for _, tag := range placeholders {
+		if !contains(guaranteed, tag) {
+			return fmt.Errorf("tag %q from name should be in required tags", tag)
+		}
+	}
+	return nil
+}
+
+// Reasons why metric settings skipped request or timer
+const (
+	skipNoTags   = "no tags from the list"
+	skipRequired = "missing required tags"
+	skipTags     = "tags don't match"
+)
+
+// filter returns tags of series for given tags of request or timer, or reason
+// why they should be skipped
+func (s *MetricsSettings) filter(tags pinba.Tags) (pinba.Tags, string) {
+	// We can't have metrics without tags
+	filtered := tags.Filter(s.Tags)
+	if len(filtered) == 0 {
+		return nil, skipNoTags
+	}
+
+	if len(s.ReqiredTags) > 0 && len(tags.Filter(s.ReqiredTags)) != len(s.ReqiredTags) {
+		return nil, skipRequired
+	}
+
+	if s.matcher != nil && !s.matcher.MatchTags(tags) {
+		return nil, skipTags
+	}
+	return filtered, ""
+}
+
+// templateTags returns tags used as {placeholders} in metric name template
+func templateTags(name string) ([]string, error) {
+	tags := make([]string, 0)
+	for rest := name; ; {
+		start := strings.IndexAny(rest, "{}")
+		if start == -1 {
+			return tags, nil
+		}
+		end := strings.IndexByte(rest[start+1:], '}')
+		if rest[start] == '}' || end == -1 {
+			return nil, fmt.Errorf("unbalanced braces in name %q", name)
+		}
+		tag := rest[start+1 : start+1+end]
+		if tag == "" || strings.ContainsAny(tag, "{") {
+			return nil, fmt.Errorf("invalid placeholder in name %q", name)
+		}
+		tags = append(tags, tag)
+		rest = rest[start+end+2:]
+	}
+}
+
+// foldName returns name template with OtherTagValue in every placeholder
+func foldName(name string) string {
+	placeholders, _ := templateTags(name)
+	tags := make(pinba.Tags, len(placeholders))
+	for i, tag := range placeholders {
+		tags[i] = pinba.Tag{Key: tag, Value: OtherTagValue}
+	}
+	return tags.Stringf(name)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// OtherTagValue replaces values of tags of series over the limit, except
+// required and mandatory ones, until they have too many values too
+const OtherTagValue = "__other__"
+
+// sample is one value for series, that some metric settings matched. Status
+// is HTTP status of request, zero if unknown or not needed. Rule is name of
+// metric settings with folded placeholders, series are limited by it
+type sample struct {
+	id       string
+	name     string
+	rule     string
+	tags     pinba.Tags
+	count    int64
+	value    float32
+	status   int
+	settings *MetricsSettings
 }
 
 type Metrics struct {
 	size  int
 	Count int64
 	Data  map[string]*Metric
+
+	// Limit is limit of unique series in one interval, zero is unlimited
+	Limit int
+	// Overflow is number of values folded into "__other__" series
+	Overflow int64
+	// number of series for every rule, and number of series over the limit
+	// with values of kept tags, for every rule and in total
+	series      map[string]int
+	folded      map[string]int
+	foldedTotal int
 }
 
 func NewMetrics(size int) (m *Metrics) {
-	return &Metrics{Count: 0, Data: make(map[string]*Metric, size), size: size}
+	return &Metrics{
+		Count:  0,
+		Data:   make(map[string]*Metric, size),
+		size:   size,
+		series: make(map[string]int),
+		folded: make(map[string]int),
+	}
 }
 
-func (m *Metrics) Add(tags pinba.Tags, name string, count int64, value float32) {
-	id := name + tags.String()
-	if _, ok := m.Data[id]; !ok {
-		m.Data[id] = NewMetric(name, tags)
+func (m *Metrics) Add(tags pinba.Tags, name string, count int64, value float32, settings *MetricsSettings) {
+	m.add(sample{name + tags.String(), name, name, tags, count, value, 0, settings})
+}
+
+// add adds sample with precomputed id of series. Sample over the limit goes
+// to series with values of kept tags only, and when there are as many of
+// them as the limit, to series with every tag and placeholder folded, so
+// kept tags with too many values can't explode number of series either
+func (m *Metrics) add(s sample) {
+	id, name, tags, settings := s.id, s.name, s.tags, s.settings
+
+	_, ok := m.Data[id]
+	if !ok && m.overLimit(s.rule, settings.seriesLimit) {
+		m.Overflow++
+		tags = foldTags(tags, settings.keepTags)
+		id = name + tags.String()
+		_, ok = m.Data[id]
+		if !ok && m.foldedOverLimit(s.rule, settings.seriesLimit) {
+			name, tags = s.rule, foldTags(tags, nil)
+			id = name + tags.String()
+			_, ok = m.Data[id]
+		} else if !ok {
+			m.folded[s.rule]++
+			m.foldedTotal++
+		}
+	}
+
+	if !ok {
+		m.Data[id] = NewMetric(name, tags, settings.newEstimator())
+		if settings.buckets != nil {
+			m.Data[id].Histogram = NewHistogram(settings.buckets)
+		}
+		// CPU time has nothing to do with latency threshold
+		if settings.slo != nil && !strings.HasSuffix(name, ".cpu") {
+			m.Data[id].Apdex = NewApdex(settings.slo)
+		}
+		m.series[s.rule]++
+	}
+	m.Data[id].Add(s.count, float64(s.value))
+	if settings.StatusCodes && s.status > 0 {
+		m.Data[id].AddStatus(s.count, s.status)
 	}
-	m.Data[id].Add(count, float64(value))
 	m.Count += 1
 }
 
+// overLimit returns true if there is no room for another series of given
+// rule, either in total or for this rule
+func (m *Metrics) overLimit(rule string, limit int) bool {
+	if m.Limit > 0 && len(m.Data) >= m.Limit {
+		return true
+	}
+	return limit > 0 && m.series[rule] >= limit
+}
+
+// foldedOverLimit returns true if there is no room for another series over
+// the limit with values of kept tags, the limit is the same
+func (m *Metrics) foldedOverLimit(rule string, limit int) bool {
+	if m.Limit > 0 && m.foldedTotal >= m.Limit {
+		return true
+	}
+	return limit > 0 && m.folded[rule] >= limit
+}
+
+// foldTags returns same tags with OtherTagValue as values, except values
+// of tags to keep
+func foldTags(tags pinba.Tags, keep []string) pinba.Tags {
+	folded := make(pinba.Tags, len(tags))
+	for i, tag := range tags {
+		folded[i] = pinba.Tag{Key: tag.Key, Value: OtherTagValue}
+		if contains(keep, tag.Key) {
+			folded[i].Value = tag.Value
+		}
+	}
+	return folded
+}
+
+// Swap returns collected series and starts new empty buffer, so returned
+// series can be used by another goroutine
+func (m *Metrics) Swap() map[string]*Metric {
+	data := m.Data
+	m.Reset()
+	return data
+}
+
 func (m *Metrics) Reset() {
 	m.Count = 0
+	m.Overflow = 0
 	m.Data = make(map[string]*Metric, m.size)
+	m.series = make(map[string]int)
+	m.folded = make(map[string]int)
+	m.foldedTotal = 0
 }
 
 type Metric struct {
-	Name   string
-	Count  int64
-	Values []float64
-	Tags   opentsdb.Tags
-	sorted bool
+	Name  string
+	Count int64
+	Tags  opentsdb.Tags
+	// Histogram is optional, it's nil if metric has no buckets configured
+	Histogram *Histogram
+	// Statuses are counts by HTTP status class: 1xx, 2xx, ..., 5xx, they are
+	// nil if metric has no status codes enabled
+	Statuses []int64
+	// Apdex is nil if metric has no SLO
+	Apdex *Apdex
+
+	values Estimator
+	// Number of values, their min, max and first one, running mean and sum
+	// of squares of differences from the mean (Welford's algorithm)
+	n     int64
+	min   float64
+	max   float64
+	first float64
+	mean  float64
+	m2    float64
 }
 
 func sum(values []float64) (sum float64) {
@@ -55,72 +330,146 @@ func sum(values []float64) (sum float64) {
 	return
 }
 
-func NewMetric(name string, tags pinba.Tags) (m *Metric) {
+func NewMetric(name string, tags pinba.Tags, values Estimator) (m *Metric) {
 	tagsMap := make(opentsdb.Tags)
 	for _, tag := range tags {
 		tagsMap.Set(tag.Key, tag.Value)
 	}
 
 	return &Metric{
-		Name:  name,
-		Tags:  tagsMap,
-		Count: 0,
+		Name:   name,
+		Tags:   tagsMap,
+		Count:  0,
+		values: values,
 	}
 }
 
 func (m *Metric) Add(cnt int64, val float64) {
 	m.Count += cnt
-	m.Values = append(m.Values, val)
-	m.sorted = false
+	m.values.Add(val)
+	if m.Histogram != nil {
+		m.Histogram.Add(val)
+	}
+	if m.Apdex != nil {
+		m.Apdex.Add(val)
+	}
+
+	m.n++
+	if m.n == 1 {
+		m.min, m.max, m.first = val, val, val
+	}
+	m.min = math.Min(m.min, val)
+	m.max = math.Max(m.max, val)
+
+	delta := val - m.mean
+	m.mean += delta / float64(m.n)
+	m.m2 += delta * (val - m.mean)
+}
+
+// Merge adds values, counts and statuses of other metric of the same series,
+// as they were added to this one. Metric isn't changed, if other one can't
+// be merged into it
+func (m *Metric) Merge(other *Metric) error {
+	if m.Histogram != nil && other.Histogram != nil {
+		if err := m.Histogram.Mergeable(other.Histogram); err != nil {
+			return err
+		}
+	}
+	if m.Apdex != nil && other.Apdex != nil {
+		if err := m.Apdex.Mergeable(other.Apdex); err != nil {
+			return err
+		}
+	}
+	// Estimators check that they are compatible before any change
+	if err := m.values.Merge(other.values); err != nil {
+		return err
+	}
+	if m.Histogram != nil && other.Histogram != nil {
+		m.Histogram.Merge(other.Histogram)
+	}
+	if m.Apdex != nil && other.Apdex != nil {
+		m.Apdex.Merge(other.Apdex)
+	}
+	if other.Statuses != nil {
+		if m.Statuses == nil {
+			m.Statuses = make([]int64, 5)
+		}
+		for i, count := range other.Statuses {
+			m.Statuses[i] += count
+		}
+	}
+	m.Count += other.Count
+
+	if other.n == 0 {
+		return nil
+	}
+	if m.n == 0 {
+		m.n, m.min, m.max, m.first, m.mean, m.m2 = other.n, other.min, other.max, other.first, other.mean, other.m2
+		return nil
+	}
+	// Combine running means and sums of squares (Chan et al.)
+	n := m.n + other.n
+	delta := other.mean - m.mean
+	m.m2 += other.m2 + delta*delta*float64(m.n)*float64(other.n)/float64(n)
+	m.mean += delta * float64(other.n) / float64(n)
+	m.n = n
+	m.min = math.Min(m.min, other.min)
+	m.max = math.Max(m.max, other.max)
+	return nil
+}
+
+// Clone returns independent copy of metric
+func (m *Metric) Clone() *Metric {
+	c := *m
+	c.Tags = make(opentsdb.Tags, len(m.Tags))
+	for k, v := range m.Tags {
+		c.Tags[k] = v
+	}
+	if m.Histogram != nil {
+		c.Histogram = m.Histogram.Clone()
+	}
+	if m.Statuses != nil {
+		c.Statuses = append([]int64(nil), m.Statuses...)
+	}
+	if m.Apdex != nil {
+		c.Apdex = m.Apdex.Clone()
+	}
+	c.values = m.values.Clone()
+	return &c
+}
+
+// AddStatus counts HTTP status in its class, unknown statuses are ignored
+func (m *Metric) AddStatus(cnt int64, status int) {
+	class := status / 100
+	if class < 1 || class > 5 {
+		return
+	}
+	if m.Statuses == nil {
+		m.Statuses = make([]int64, 5)
+	}
+	m.Statuses[class-1] += cnt
 }
 
 func (m *Metric) IsEmpty() bool {
-	return len(m.Values) == 0
+	return m.n == 0
 }
 
 func (m *Metric) Max() float64 {
-	m.sort()
-	return m.Values[len(m.Values)-1]
+	return m.max
 }
 
 func (m *Metric) Median() float64 {
-	m.sort()
-	return m.Values[len(m.Values)/2]
+	return m.values.Quantile(0.5)
 }
 
 func (m *Metric) Stdev() float64 {
-	avg := sum(m.Values) / float64(len(m.Values))
-
-	var variance float64
-	for _, val := range m.Values {
-		variance += (val - avg) * (val - avg)
-	}
-
-	return math.Sqrt(variance / float64(len(m.Values)))
+	return math.Sqrt(m.m2 / float64(m.n))
 }
 
 func (m *Metric) Percentile(rank int) float64 {
-	m.sort()
-	percent := float64(rank) / 100
-	k := float64(len(m.Values)-1) * percent
-	f := math.Floor(k)
-	c := math.Ceil(k)
-
-	if f == c {
-		return m.Values[int(k)]
-	}
-	d0 := m.Values[int(f)] * (c - k)
-	d1 := m.Values[int(c)] * (k - f)
-	return d0 + d1
+	return m.values.Quantile(float64(rank) / 100)
 }
 
 func (m *Metric) Value() float64 {
-	return m.Values[0]
-}
-
-func (m *Metric) sort() {
-	if !m.sorted {
-		sort.Float64s(m.Values)
-		m.sorted = true
-	}
+	return m.first
 }
@@ -16,7 +16,7 @@ func TestSum(t *testing.T) {
 }
 
 func TestMetricAdd(t *testing.T) {
-	metric := NewMetric("test.metric", pinba.Tags{pinba.Tag{"aaa", "val_1"}, pinba.Tag{"bbb", "val_2"}})
+	metric := NewMetric("test.metric", pinba.Tags{pinba.Tag{"aaa", "val_1"}, pinba.Tag{"bbb", "val_2"}}, NewExact())
 	assert.EqualValues(t, 0, metric.Count)
 
 	metric.Add(1, 0.1)
@@ -29,7 +29,7 @@ func TestMetricAdd(t *testing.T) {
 }
 
 func TestMetricPercentile(t *testing.T) {
-	metric := NewMetric("test.metric", pinba.Tags{pinba.Tag{"aaa", "val_1"}, pinba.Tag{"bbb", "val_2"}})
+	metric := NewMetric("test.metric", pinba.Tags{pinba.Tag{"aaa", "val_1"}, pinba.Tag{"bbb", "val_2"}}, NewExact())
 
 	// 1.3,2.2,2.7,3.1,3.3,3.7
 
@@ -46,3 +46,47 @@ func TestMetricPercentile(t *testing.T) {
 	assert.InDelta(t, 3.250, metric.Percentile(75), 0.001, "Percentile(75)")
 	assert.InDelta(t, 3.700, metric.Percentile(100), 0.001, "Percentile(100)")
 }
+
+func TestMetricMerge(t *testing.T) {
+	tags := pinba.Tags{pinba.Tag{"server", "test.ru"}}
+	whole := NewMetric("test.metric", tags, NewExact())
+	merged := NewMetric("test.metric", tags, NewExact())
+	for i := 0; i < 3; i++ {
+		part := NewMetric("test.metric", tags, NewExact())
+		part.Histogram = NewHistogram([]float64{1, 2})
+		for _, v := range []float64{0.5, 1.5, 2.5, float64(i)} {
+			part.Add(2, v)
+			whole.Add(2, v)
+		}
+		part.AddStatus(2, 200+i*100)
+		if i == 0 {
+			// Metric without histogram gets it from the first merged one
+			merged = part.Clone()
+			continue
+		}
+		assert.NoError(t, merged.Merge(part))
+	}
+
+	assert.EqualValues(t, whole.Count, merged.Count)
+	assert.EqualValues(t, whole.Max(), merged.Max())
+	assert.EqualValues(t, 0, merged.min)
+	assert.InDelta(t, whole.Stdev(), merged.Stdev(), 1e-9)
+	assert.InDelta(t, whole.Percentile(75), merged.Percentile(75), 1e-9)
+	assert.EqualValues(t, 0.5, merged.Value())
+	assert.Equal(t, []int64{5, 4, 3}, merged.Histogram.Counts)
+	assert.Equal(t, []int64{0, 2, 2, 2, 0}, merged.Statuses)
+}
+
+func TestMetricClone(t *testing.T) {
+	m := NewMetric("test.metric", pinba.Tags{pinba.Tag{"server", "test.ru"}}, NewExact())
+	m.Add(1, 1)
+	c := m.Clone()
+	c.Add(1, 2)
+	c.Tags.Set("rollup", "1m")
+
+	assert.EqualValues(t, 1, m.Count)
+	assert.EqualValues(t, 1, m.Max())
+	assert.Len(t, m.Tags, 1)
+	assert.EqualValues(t, 2, c.Count)
+	assert.EqualValues(t, 2, c.Max())
+}
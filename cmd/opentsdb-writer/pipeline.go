@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+	"github.com/olegfedoseev/pinba-server/client"
+)
+
+// snapshot is aggregated data of one interval (or window of rollup tier).
+// Once it's queued for sending, it's owned by sender only: aggregating
+// goroutines swap their buffers and never touch it again
+type snapshot struct {
+	requests *client.PinbaRequests
+	data     []map[string]*Metric
+}
+
+// startSenders allows up to n snapshots to be sent at the same time
+func (w *Writer) startSenders(n int) {
+	if n < 1 {
+		n = 1
+	}
+	w.senders = make(chan struct{}, n)
+}
+
+// enqueue passes snapshot to free sender. If all of them are busy with
+// previous intervals, sending is behind, and it waits for one of them
+func (w *Writer) enqueue(s *snapshot) {
+	select {
+	case w.senders <- struct{}{}:
+	default:
+		t := time.Now()
+		w.senders <- struct{}{}
+		d := time.Since(t)
+		atomic.AddInt64(&w.stalls, 1)
+		log.Printf("[WARN][%d] Sending is behind, waited %v for free sender",
+			s.requests.Timestamp, d-d%time.Millisecond)
+	}
+
+	w.inFlight.Add(1)
+	go func() {
+		defer w.inFlight.Done()
+		w.sendSnapshot(s)
+		<-w.senders
+	}()
+}
+
+func (w *Writer) sendSnapshot(s *snapshot) {
+	t := time.Now()
+	for _, data := range s.data {
+		w.send(s.requests, data)
+	}
+	if d := time.Since(t); d > w.interval {
+		atomic.AddInt64(&w.late, 1)
+		log.Printf("[WARN][%d] Sending took %v, longer than interval %v",
+			s.requests.Timestamp, d-d%time.Millisecond, w.interval)
+	}
+}
+
+// sendPipeline sends number of intervals, that waited for free sender, and
+// number of sends, that took longer than interval, since the last call
+func (w *Writer) sendPipeline(ts int64, statsTag opentsdb.Tags) {
+	w.push("pinba.aggregator.stalls", ts, atomic.SwapInt64(&w.stalls, 0), statsTag)
+	w.push("pinba.aggregator.late", ts, atomic.SwapInt64(&w.late, 0), statsTag)
+}
+
+// watchBackend logs batches sent by backend and its errors, so they are not
+// delayed by aggregation
+func (w *Writer) watchBackend() {
+	for {
+		select {
+		case timer := <-w.client.Batches():
+			log.Printf("[INFO][%d] POSTed to OpenTSDB in %v", timer.Timestamp, timer.Stop.Sub(timer.Start))
+			w.push(
+				"pinba.aggregator.time",
+				timer.Timestamp,
+				timer.Stop.Sub(timer.Start),
+				w.statsTag.Load().(opentsdb.Tags),
+			)
+
+		case err := <-w.client.Errors():
+			log.Printf("[ERROR] OpenTSDB Client error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPipelineWriter(t *testing.T, backend Backend, senders int) *Writer {
+	w := &Writer{
+		client:     backend,
+		shards:     []*Metrics{NewMetrics(10), NewMetrics(10)},
+		shardsRing: NewRing(2),
+		interval:   10 * time.Second,
+		rollups:    []*Rollup{NewRollup(RollupSettings{Interval: 60, Suffix: ".1m"})},
+	}
+	config := &writerConfig{
+		Prefix: "php.",
+		Metrics: []MetricsSettings{
+			{Name: "requests", Tags: []string{"server"}, Type: "request", Histogram: HistogramSettings{Buckets: []float64{0.1, 1}}},
+		},
+	}
+	assert.NoError(t, w.configure(config))
+	w.startSenders(senders)
+	return w
+}
+
+func testIntervalRequests(ts int64) *client.PinbaRequests {
+	requests := &client.PinbaRequests{Timestamp: ts, Span: 10}
+	for i := 0; i < 100; i++ {
+		requests.Requests = append(requests.Requests, &pinba.Request{
+			RequestTime: float32(i) / 100,
+			Tags:        pinba.Tags{{Key: "server", Value: fmt.Sprintf("www%d.test.ru", i%2)}},
+		})
+	}
+	return requests
+}
+
+func TestWriterPipeline(t *testing.T) {
+	backend := NewHTTPBackend("127.0.0.1:4242", 100000, time.Second, false)
+	w := testPipelineWriter(t, backend, 2)
+
+	// Intervals are aggregated while previous ones are being sent
+	for i := int64(0); i < 12; i++ {
+		w.process(testIntervalRequests(1500000000 + i*10))
+	}
+	w.inFlight.Wait()
+
+	counts := make(map[string]int)
+	for len(backend.queue) > 0 {
+		p := <-backend.queue
+		if strings.HasPrefix(p.Metric, "php.requests") {
+			counts[p.Metric]++
+		}
+	}
+	// Two servers in every interval and in one closed minute of rollup
+	assert.Equal(t, 24, counts["php.requests.p95"])
+	assert.Equal(t, 72, counts["php.requests.hist"])
+	assert.Equal(t, 2, counts["php.requests.1m.p95"])
+	assert.Equal(t, 6, counts["php.requests.1m.hist"])
+	for _, shard := range w.shards {
+		assert.Empty(t, shard.Data)
+	}
+}
+
+func TestWriterRollupPartialWindow(t *testing.T) {
+	backend := NewHTTPBackend("127.0.0.1:4242", 100000, time.Second, false)
+	w := testPipelineWriter(t, backend, 1)
+
+	// Writer started in the middle of minute, so window covers 40 seconds
+	for ts := int64(1500000020); ts <= 1500000060; ts += 10 {
+		w.process(testIntervalRequests(ts))
+	}
+	w.inFlight.Wait()
+
+	rates := make([]interface{}, 0)
+	for len(backend.queue) > 0 {
+		p := <-backend.queue
+		if p.Metric == "php.requests.1m.rps" {
+			rates = append(rates, p.Value)
+		}
+	}
+	// 50 requests of every server in each of four intervals
+	assert.Equal(t, []interface{}{5.0, 5.0}, rates)
+}
+
+// gatedBackend doesn't take data points until gate is opened
+type gatedBackend struct {
+	*HTTPBackend
+	gate   chan struct{}
+	pushed int64
+}
+
+func (b *gatedBackend) Push(p *opentsdb.DataPoint) {
+	<-b.gate
+	atomic.AddInt64(&b.pushed, 1)
+}
+
+func TestWriterPipelineBehind(t *testing.T) {
+	backend := &gatedBackend{
+		HTTPBackend: NewHTTPBackend("127.0.0.1:4242", 10, time.Second, false),
+		gate:        make(chan struct{}),
+	}
+	w := testPipelineWriter(t, backend, 1)
+	w.interval = time.Millisecond
+
+	data := map[string]*Metric{"php.test": NewMetric("php.test", pinba.Tags{{Key: "server", Value: "test"}}, NewExact())}
+	data["php.test"].Add(1, 1)
+	w.enqueue(&snapshot{&client.PinbaRequests{Timestamp: 1}, []map[string]*Metric{data}})
+
+	// The only sender is busy, so the next interval waits for it
+	done := make(chan struct{})
+	go func() {
+		w.enqueue(&snapshot{&client.PinbaRequests{Timestamp: 2}, []map[string]*Metric{{}}})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("snapshot should wait for free sender")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.gate)
+	<-done
+	w.inFlight.Wait()
+
+	assert.EqualValues(t, 1, atomic.LoadInt64(&w.stalls))
+	assert.EqualValues(t, 1, atomic.LoadInt64(&w.late))
+	assert.EqualValues(t, 6, atomic.LoadInt64(&backend.pushed))
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Estimator is streaming estimator of quantiles for metric values
+type Estimator interface {
+	// Add adds another observed value
+	Add(value float64)
+	// Quantile returns (estimated) value for given quantile in [0, 1]
+	Quantile(q float64) float64
+	// Merge adds all values of other estimator of the same type and settings
+	Merge(other Estimator) error
+	// Clone returns independent copy of estimator
+	Clone() Estimator
+}
+
+func mergeError(e, other Estimator) error {
+	return fmt.Errorf("can't merge %T into %T", other, e)
+}
+
+// EstimatorSettings describes which estimator to use for metric and how
+// accurate it should be
+type EstimatorSettings struct {
+	// Type is one of "tdigest", "ddsketch" or "exact", default is "tdigest".
+	// Exact keeps every value, so it should be chosen explicitly
+	Type string `yaml:"type"`
+	// Compression of t-digest, more is more accurate, default is 100
+	Compression float64 `yaml:"compression"`
+	// Accuracy is relative accuracy of DDSketch, default is 0.01 (1%)
+	Accuracy float64 `yaml:"accuracy"`
+}
+
+const (
+	defaultEstimator   = "tdigest"
+	defaultCompression = 100
+	defaultAccuracy    = 0.01
+)
+
+// Name returns type of estimator, default one if it's not set
+func (s EstimatorSettings) Name() string {
+	if s.Type == "" {
+		return defaultEstimator
+	}
+	return s.Type
+}
+
+// Factory validates settings and returns constructor of estimators
+func (s EstimatorSettings) Factory() (func() Estimator, error) {
+	switch s.Name() {
+	case "exact":
+		return func() Estimator { return NewExact() }, nil
+
+	case "tdigest":
+		compression := s.Compression
+		if compression == 0 {
+			compression = defaultCompression
+		}
+		if compression < 10 {
+			return nil, fmt.Errorf("tdigest compression should be at least 10, got %v", compression)
+		}
+		return func() Estimator { return NewTDigest(compression) }, nil
+
+	case "ddsketch":
+		accuracy := s.Accuracy
+		if accuracy == 0 {
+			accuracy = defaultAccuracy
+		}
+		if accuracy <= 0 || accuracy >= 1 {
+			return nil, fmt.Errorf("ddsketch accuracy should be in (0, 1), got %v", accuracy)
+		}
+		return func() Estimator { return NewDDSketch(accuracy) }, nil
+	}
+	return nil, fmt.Errorf("unknown estimator type %q", s.Type)
+}
+
+// Exact keeps every value, so it's accurate, but memory grows with number
+// of requests
+type Exact struct {
+	values []float64
+	sorted bool
+}
+
+// NewExact creates new Exact estimator
+func NewExact() *Exact {
+	return &Exact{}
+}
+
+// Add appends value to the list
+func (e *Exact) Add(value float64) {
+	e.values = append(e.values, value)
+	e.sorted = false
+}
+
+// Merge appends values of other Exact estimator
+func (e *Exact) Merge(other Estimator) error {
+	o, ok := other.(*Exact)
+	if !ok {
+		return mergeError(e, other)
+	}
+	e.values = append(e.values, o.values...)
+	e.sorted = false
+	return nil
+}
+
+// Clone returns copy of estimator with its own values
+func (e *Exact) Clone() Estimator {
+	return &Exact{values: append([]float64(nil), e.values...), sorted: e.sorted}
+}
+
+// Quantile returns linear interpolation between closest ranks
+func (e *Exact) Quantile(q float64) float64 {
+	if len(e.values) == 0 {
+		return 0
+	}
+	if !e.sorted {
+		sort.Float64s(e.values)
+		e.sorted = true
+	}
+
+	k := float64(len(e.values)-1) * q
+	f := math.Floor(k)
+	c := math.Ceil(k)
+
+	if f == c {
+		return e.values[int(k)]
+	}
+	d0 := e.values[int(f)] * (c - k)
+	d1 := e.values[int(c)] * (k - f)
+	return d0 + d1
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigest is merging t-digest by Ted Dunning. It keeps around compression
+// centroids, that are smaller at the tails, so extreme quantiles are more
+// accurate than median
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	weight      float64
+	min         float64
+	max         float64
+}
+
+// NewTDigest creates new TDigest with given compression
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{
+		compression: compression,
+		centroids:   make([]centroid, 0, int(compression)),
+		buffer:      make([]centroid, 0, int(compression)*5),
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Add puts value to buffer and merges buffer into centroids when it's full
+func (t *TDigest) Add(value float64) {
+	t.buffer = append(t.buffer, centroid{value, 1})
+	if value < t.min {
+		t.min = value
+	}
+	if value > t.max {
+		t.max = value
+	}
+	if len(t.buffer) == cap(t.buffer) {
+		t.compress()
+	}
+}
+
+// Merge adds centroids of other TDigest as they were values with weights
+func (t *TDigest) Merge(other Estimator) error {
+	o, ok := other.(*TDigest)
+	if !ok || o.compression != t.compression {
+		return mergeError(t, other)
+	}
+	for _, list := range [][]centroid{o.centroids, o.buffer} {
+		for _, c := range list {
+			t.buffer = append(t.buffer, c)
+			if len(t.buffer) == cap(t.buffer) {
+				t.compress()
+			}
+		}
+	}
+	t.min = math.Min(t.min, o.min)
+	t.max = math.Max(t.max, o.max)
+	return nil
+}
+
+// Clone returns copy of digest with its own centroids
+func (t *TDigest) Clone() Estimator {
+	c := *t
+	c.centroids = append(make([]centroid, 0, cap(t.centroids)), t.centroids...)
+	c.buffer = append(make([]centroid, 0, cap(t.buffer)), t.buffer...)
+	return &c
+}
+
+func (t *TDigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+
+	all := append(t.buffer, t.centroids...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	var total float64
+	for _, c := range all {
+		total += c.weight
+	}
+
+	// Centroid can grow while it spans no more than one unit of k1 scale,
+	// so there is no more than compression centroids
+	merged := make([]centroid, 0, cap(t.centroids))
+	current := all[0]
+	var before float64
+	for _, c := range all[1:] {
+		proposed := current.weight + c.weight
+		if t.scale((before+proposed)/total)-t.scale(before/total) <= 1 {
+			current.mean += (c.mean - current.mean) * c.weight / proposed
+			current.weight = proposed
+			continue
+		}
+		before += current.weight
+		merged = append(merged, current)
+		current = c
+	}
+	merged = append(merged, current)
+
+	t.centroids = merged
+	t.buffer = t.buffer[:0]
+	t.weight = total
+}
+
+// scale is k1 scale function of t-digest
+func (t *TDigest) scale(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*math.Min(q, 1)-1)
+}
+
+// Quantile interpolates between centers of neighbouring centroids
+func (t *TDigest) Quantile(q float64) float64 {
+	t.compress()
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].mean
+	}
+
+	// Same rank as Exact uses, shifted to centroid centers, so singletons
+	// give exactly the same answer
+	index := q*(t.weight-1) + 0.5
+
+	first := t.centroids[0]
+	if index <= first.weight/2 {
+		return interpolate(index, 0.5, t.min, first.weight/2, first.mean)
+	}
+
+	var before float64
+	for i := 0; i < len(t.centroids)-1; i++ {
+		left, right := t.centroids[i], t.centroids[i+1]
+		leftCenter := before + left.weight/2
+		rightCenter := before + left.weight + right.weight/2
+		if index <= rightCenter {
+			return interpolate(index, leftCenter, left.mean, rightCenter, right.mean)
+		}
+		before += left.weight
+	}
+
+	last := t.centroids[len(t.centroids)-1]
+	return interpolate(index, t.weight-last.weight/2, last.mean, t.weight-0.5, t.max)
+}
+
+// interpolate returns y for x on line between (x0, y0) and (x1, y1)
+func interpolate(x, x0, y0, x1, y1 float64) float64 {
+	if x1 <= x0 {
+		return y0
+	}
+	return y0 + (y1-y0)*(x-x0)/(x1-x0)
+}
+
+// DDSketch keeps counts of values in logarithmic buckets, so every quantile
+// is within given relative accuracy. Values less than minIndexable (including
+// negative ones, which we don't expect for timings) are counted as zeros
+type DDSketch struct {
+	gamma    float64
+	logGamma float64
+	maxBins  int
+
+	bins  map[int]int64
+	zeros int64
+	count int64
+	min   float64
+	max   float64
+}
+
+const (
+	ddsketchMinIndexable = 1e-9
+	ddsketchMaxBins      = 2048
+)
+
+// NewDDSketch creates new DDSketch with given relative accuracy
+func NewDDSketch(accuracy float64) *DDSketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &DDSketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		maxBins:  ddsketchMaxBins,
+		bins:     make(map[int]int64),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+// Add increments counter of bucket for given value
+func (s *DDSketch) Add(value float64) {
+	s.count++
+	if value < s.min {
+		s.min = value
+	}
+	if value > s.max {
+		s.max = value
+	}
+	if value < ddsketchMinIndexable {
+		s.zeros++
+		return
+	}
+
+	s.bins[int(math.Ceil(math.Log(value)/s.logGamma))]++
+	if len(s.bins) > s.maxBins {
+		s.collapse()
+	}
+}
+
+// Merge adds counts of buckets of other DDSketch with the same accuracy
+func (s *DDSketch) Merge(other Estimator) error {
+	o, ok := other.(*DDSketch)
+	if !ok || o.gamma != s.gamma {
+		return mergeError(s, other)
+	}
+	for key, count := range o.bins {
+		s.bins[key] += count
+	}
+	for len(s.bins) > s.maxBins {
+		s.collapse()
+	}
+	s.zeros += o.zeros
+	s.count += o.count
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+	return nil
+}
+
+// Clone returns copy of sketch with its own buckets
+func (s *DDSketch) Clone() Estimator {
+	c := *s
+	c.bins = make(map[int]int64, len(s.bins))
+	for key, count := range s.bins {
+		c.bins[key] = count
+	}
+	return &c
+}
+
+// collapse merges two lowest buckets, so memory stays bounded and accuracy
+// of high quantiles (which we care about) stays the same
+func (s *DDSketch) collapse() {
+	keys := s.keys()
+	s.bins[keys[1]] += s.bins[keys[0]]
+	delete(s.bins, keys[0])
+}
+
+func (s *DDSketch) keys() []int {
+	keys := make([]int, 0, len(s.bins))
+	for key := range s.bins {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Quantile returns value of bucket, where value with given rank falls
+func (s *DDSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+
+	rank := q * float64(s.count-1)
+	if float64(s.zeros) > rank {
+		return math.Max(s.min, 0)
+	}
+
+	counted := s.zeros
+	for _, key := range s.keys() {
+		counted += s.bins[key]
+		if float64(counted) > rank {
+			value := 2 * math.Pow(s.gamma, float64(key)) / (s.gamma + 1)
+			return math.Min(math.Max(value, s.min), s.max)
+		}
+	}
+	return s.max
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testQuantiles = []float64{0, 0.25, 0.5, 0.75, 0.95, 0.99, 1}
+
+// requestTimes generates log-normal distributed values, that look like
+// request times in seconds
+func requestTimes(n int) []float64 {
+	r := rand.New(rand.NewSource(42))
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = 0.05 * (1 + r.ExpFloat64()) * (1 + r.NormFloat64()*r.NormFloat64())
+		if values[i] < 0 {
+			values[i] = -values[i]
+		}
+	}
+	return values
+}
+
+func TestEstimatorFactory(t *testing.T) {
+	for _, settings := range []EstimatorSettings{
+		{},
+		{Type: "exact"},
+		{Type: "tdigest"},
+		{Type: "tdigest", Compression: 200},
+		{Type: "ddsketch"},
+		{Type: "ddsketch", Accuracy: 0.05},
+	} {
+		factory, err := settings.Factory()
+		assert.NoError(t, err, "%+v", settings)
+		assert.NotNil(t, factory())
+	}
+
+	for _, settings := range []EstimatorSettings{
+		{Type: "hdr"},
+		{Type: "tdigest", Compression: 1},
+		{Type: "ddsketch", Accuracy: 1},
+		{Type: "ddsketch", Accuracy: -0.1},
+	} {
+		_, err := settings.Factory()
+		assert.Error(t, err, "%+v", settings)
+	}
+}
+
+func TestExactQuantile(t *testing.T) {
+	e := NewExact()
+	assert.EqualValues(t, 0, e.Quantile(0.5))
+
+	for _, v := range []float64{3.7, 2.7, 3.3, 1.3, 2.2, 3.1} {
+		e.Add(v)
+	}
+	assert.InDelta(t, 1.300, e.Quantile(0), 0.001)
+	assert.InDelta(t, 2.325, e.Quantile(0.25), 0.001)
+	assert.InDelta(t, 2.900, e.Quantile(0.5), 0.001)
+	assert.InDelta(t, 3.700, e.Quantile(1), 0.001)
+}
+
+func TestTDigestSmallIsExact(t *testing.T) {
+	exact := NewExact()
+	digest := NewTDigest(100)
+	for _, v := range []float64{3.7, 2.7, 3.3, 1.3, 2.2, 3.1} {
+		exact.Add(v)
+		digest.Add(v)
+	}
+	for _, q := range testQuantiles {
+		assert.InDelta(t, exact.Quantile(q), digest.Quantile(q), 1e-9, "q=%v", q)
+	}
+}
+
+func TestTDigestAccuracy(t *testing.T) {
+	exact := NewExact()
+	digest := NewTDigest(100)
+	for _, v := range requestTimes(100000) {
+		exact.Add(v)
+		digest.Add(v)
+	}
+
+	// t-digest error is in rank, so compare by rank of estimated value
+	sorted := requestTimes(100000)
+	for _, q := range testQuantiles {
+		estimated := digest.Quantile(q)
+		rank := float64(countBelow(sorted, estimated)) / float64(len(sorted))
+		assert.InDelta(t, q, rank, 0.01, "q=%v exact=%v estimated=%v", q, exact.Quantile(q), estimated)
+	}
+	assert.True(t, len(digest.centroids) < 300, "too many centroids: %v", len(digest.centroids))
+}
+
+func TestDDSketchAccuracy(t *testing.T) {
+	for _, accuracy := range []float64{0.01, 0.05} {
+		exact := NewExact()
+		sketch := NewDDSketch(accuracy)
+		for _, v := range requestTimes(100000) {
+			exact.Add(v)
+			sketch.Add(v)
+		}
+
+		// DDSketch error is relative to value, but it estimates value of
+		// nearest rank, not interpolation between ranks like Exact does
+		for _, q := range testQuantiles {
+			expected := exact.Quantile(q)
+			assert.InEpsilon(t, expected, sketch.Quantile(q), accuracy+0.001, "q=%v accuracy=%v", q, accuracy)
+		}
+	}
+}
+
+func TestDDSketchBoundedBins(t *testing.T) {
+	sketch := NewDDSketch(0.01)
+	sketch.maxBins = 100
+	for _, v := range requestTimes(10000) {
+		sketch.Add(v * 1000)
+	}
+	assert.True(t, len(sketch.bins) <= 100)
+
+	exact := NewExact()
+	for _, v := range requestTimes(10000) {
+		exact.Add(v * 1000)
+	}
+	// High quantiles are still accurate after collapsing low buckets
+	assert.InEpsilon(t, exact.Quantile(0.99), sketch.Quantile(0.99), 0.011)
+}
+
+func TestDDSketchZeros(t *testing.T) {
+	sketch := NewDDSketch(0.01)
+	sketch.Add(0)
+	sketch.Add(0)
+	sketch.Add(1)
+	assert.EqualValues(t, 0, sketch.Quantile(0.5))
+	assert.InEpsilon(t, 1, sketch.Quantile(1), 0.01)
+}
+
+func countBelow(values []float64, limit float64) (n int) {
+	for _, v := range values {
+		if v <= limit {
+			n++
+		}
+	}
+	return
+}
+
+func BenchmarkTDigestAdd(b *testing.B) {
+	values := requestTimes(1000)
+	digest := NewTDigest(100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		digest.Add(values[i%len(values)])
+	}
+}
+
+func BenchmarkDDSketchAdd(b *testing.B) {
+	values := requestTimes(1000)
+	sketch := NewDDSketch(0.01)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sketch.Add(values[i%len(values)])
+	}
+}
+
+func TestEstimatorMerge(t *testing.T) {
+	values := requestTimes(10000)
+	for _, settings := range []EstimatorSettings{
+		{Type: "exact"},
+		{Type: "tdigest"},
+		{Type: "ddsketch"},
+	} {
+		factory, _ := settings.Factory()
+		whole, merged := factory(), factory()
+		for i := 0; i < 10; i++ {
+			part := factory()
+			for _, v := range values[i*1000 : (i+1)*1000] {
+				part.Add(v)
+				whole.Add(v)
+			}
+			assert.NoError(t, merged.Merge(part))
+		}
+
+		for _, q := range testQuantiles {
+			expected := whole.Quantile(q)
+			assert.InEpsilon(t, expected, merged.Quantile(q), 0.02, "%v q=%v", settings.Type, q)
+		}
+	}
+
+	assert.Error(t, NewExact().Merge(NewDDSketch(0.01)))
+	assert.Error(t, NewTDigest(100).Merge(NewTDigest(200)))
+	assert.Error(t, NewDDSketch(0.01).Merge(NewDDSketch(0.05)))
+}
+
+func TestEstimatorClone(t *testing.T) {
+	for _, e := range []Estimator{NewExact(), NewTDigest(100), NewDDSketch(0.01)} {
+		e.Add(1)
+		c := e.Clone()
+		e.Add(100)
+		e.Add(100)
+		assert.EqualValues(t, 1, c.Quantile(1), "%T", e)
+		assert.EqualValues(t, 100, e.Quantile(1), "%T", e)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RollupSettings describes tier of coarser series. Data of every interval is
+// merged into tier until its window is closed, and then it's sent as usual,
+// so percentiles are computed over all values of window
+type RollupSettings struct {
+	// Interval is size of window in seconds, it should be multiple of writer
+	// interval. Windows are aligned to wall clock
+	Interval int64 `yaml:"interval"`
+	// Suffix is added to metric names of this tier, like "php.requests.1m",
+	// for cpu metrics it goes before ".cpu"
+	Suffix string `yaml:"suffix"`
+	// Tags are added to tags of every series of this tier
+	Tags map[string]string `yaml:"tags"`
+}
+
+// Validate checks that tier series can be told from others
+func (s RollupSettings) Validate(interval int64) error {
+	if s.Interval <= interval || s.Interval%interval != 0 {
+		return fmt.Errorf("rollup interval should be multiple of interval %d, got %d", interval, s.Interval)
+	}
+	if s.Suffix == "" && len(s.Tags) == 0 {
+		return fmt.Errorf("rollup %d needs suffix or tags", s.Interval)
+	}
+	return nil
+}
+
+// validateRollups checks that values of every metric can be merged into
+// rollup windows. Exact estimator keeps every value of window, so it's not
+// allowed with rollups
+func validateRollups(config *writerConfig) error {
+	if len(config.Rollups) == 0 {
+		return nil
+	}
+	for i, metric := range config.Metrics {
+		estimator := metric.Estimator
+		if estimator.Type == "" {
+			estimator = config.Estimator
+		}
+		if estimator.Name() == "exact" {
+			return fmt.Errorf("metric #%d %q: exact estimator can't be used with rollups, use tdigest or ddsketch",
+				i+1, metric.Name)
+		}
+	}
+	return nil
+}
+
+// Rollup keeps merged series of current window of tier
+type Rollup struct {
+	RollupSettings
+	// Start of current window, zero if nothing is added yet
+	Start int64
+	// Span is number of seconds, that added intervals actually cover, it's
+	// less than Interval for partial window
+	Span int64
+	Data map[string]*Metric
+}
+
+// NewRollup creates empty tier with given settings
+func NewRollup(settings RollupSettings) *Rollup {
+	return &Rollup{
+		RollupSettings: settings,
+		Data:           make(map[string]*Metric),
+	}
+}
+
+// window returns start of window for given timestamp
+func (r *Rollup) window(ts int64) int64 {
+	return ts - ts%r.Interval
+}
+
+// Flush returns start, span and series of current window, if given
+// timestamp is out of it, and starts new window. Returns nil if window is
+// still open. Series are named and tagged for this tier
+func (r *Rollup) Flush(ts int64) (int64, int64, map[string]*Metric) {
+	if r.Start == 0 || r.window(ts) == r.Start {
+		return 0, 0, nil
+	}
+	start, span, data := r.Start, r.Span, r.Data
+	r.Start, r.Span, r.Data = 0, 0, make(map[string]*Metric, len(data))
+
+	for _, m := range data {
+		m.Name = rollupName(m.Name, r.Suffix)
+		for k, v := range r.Tags {
+			m.Tags.Set(k, v)
+		}
+	}
+	return start, span, data
+}
+
+// Add merges series of one interval, that covers span seconds, from every
+// shard into current window. Given series are copied, so they can be sent
+// and changed after that. Series, that can't be merged (settings of metric
+// are changed by reload), are skipped until the window is closed, and the
+// first error is returned
+func (r *Rollup) Add(ts, span int64, shards ...map[string]*Metric) error {
+	if r.Start == 0 {
+		r.Start = r.window(ts)
+	}
+	r.Span += span
+	var err error
+	for _, data := range shards {
+		for id, m := range data {
+			current, ok := r.Data[id]
+			if !ok {
+				r.Data[id] = m.Clone()
+				continue
+			}
+			if e := current.Merge(m); e != nil {
+				if err == nil {
+					err = fmt.Errorf("series %q: %v", id, e)
+				}
+			}
+		}
+	}
+	return err
+}
+
+// rollupName adds suffix to metric name, before ".cpu" for cpu metrics, so
+// they are still sent as cpu metrics
+func rollupName(name, suffix string) string {
+	if strings.HasSuffix(name, ".cpu") {
+		return strings.TrimSuffix(name, ".cpu") + suffix + ".cpu"
+	}
+	return name + suffix
+}
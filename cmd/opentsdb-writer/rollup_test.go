@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/olegfedoseev/opentsdb"
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollupSettingsValidate(t *testing.T) {
+	assert.NoError(t, RollupSettings{Interval: 60, Suffix: ".1m"}.Validate(10))
+	assert.NoError(t, RollupSettings{Interval: 3600, Tags: map[string]string{"rollup": "1h"}}.Validate(10))
+
+	assert.Error(t, RollupSettings{Interval: 60}.Validate(10))
+	assert.Error(t, RollupSettings{Interval: 10, Suffix: ".10s"}.Validate(10))
+	assert.Error(t, RollupSettings{Interval: 65, Suffix: ".1m"}.Validate(10))
+}
+
+func TestRollupName(t *testing.T) {
+	assert.Equal(t, "php.requests.1m", rollupName("php.requests", ".1m"))
+	assert.Equal(t, "php.requests.1m.cpu", rollupName("php.requests.cpu", ".1m"))
+	assert.Equal(t, "php.requests", rollupName("php.requests", ""))
+}
+
+func TestRollup(t *testing.T) {
+	settings := &MetricsSettings{newEstimator: func() Estimator { return NewTDigest(100) }}
+	tags := pinba.Tags{pinba.Tag{"server", "test.ru"}}
+	rollup := NewRollup(RollupSettings{Interval: 60, Suffix: ".1m", Tags: map[string]string{"rollup": "1m"}})
+
+	whole := NewTDigest(100)
+	for ts := int64(1500000000); ts < 1500000040; ts += 10 {
+		start, _, data := rollup.Flush(ts)
+		assert.Nil(t, data, "%d", ts)
+		assert.EqualValues(t, 0, start)
+
+		metrics := NewMetrics(10)
+		for i := 0; i < 100; i++ {
+			value := float32(ts-1500000000) + float32(i)/100
+			metrics.Add(tags, "php.requests", 1, value, settings)
+			metrics.Add(tags, "php.requests.cpu", 1, value, settings)
+			whole.Add(float64(value))
+		}
+		assert.NoError(t, rollup.Add(ts, 10, metrics.Data))
+		assert.EqualValues(t, 1500000000, rollup.Start)
+	}
+
+	// Still the same minute
+	_, _, data := rollup.Flush(1500000050)
+	assert.Nil(t, data)
+
+	// Window is partial, there were only four intervals
+	start, span, data := rollup.Flush(1500000060)
+	assert.EqualValues(t, 1500000000, start)
+	assert.EqualValues(t, 40, span)
+	assert.Len(t, data, 2)
+	assert.Empty(t, rollup.Data)
+
+	for _, m := range data {
+		assert.Contains(t, []string{"php.requests.1m", "php.requests.1m.cpu"}, m.Name)
+		assert.Equal(t, opentsdb.Tags{"server": "test.ru", "rollup": "1m"}, m.Tags)
+		assert.EqualValues(t, 400, m.Count)
+		assert.InDelta(t, whole.Quantile(0.95), m.Percentile(95), 0.01)
+		assert.InDelta(t, 30.99, m.Max(), 0.001)
+	}
+
+	// Next window starts with the next added interval
+	_, _, data = rollup.Flush(1500000070)
+	assert.Nil(t, data)
+	assert.NoError(t, rollup.Add(1500000070, 10, map[string]*Metric{}))
+	assert.EqualValues(t, 1500000060, rollup.Start)
+	assert.EqualValues(t, 10, rollup.Span)
+}
+
+func TestRollupCopiesSeries(t *testing.T) {
+	settings := &MetricsSettings{newEstimator: func() Estimator { return NewExact() }}
+	tags := pinba.Tags{pinba.Tag{"server", "test.ru"}}
+	rollup := NewRollup(RollupSettings{Interval: 60, Suffix: ".1m"})
+
+	metrics := NewMetrics(10)
+	metrics.Add(tags, "php.requests", 1, 1, settings)
+	assert.NoError(t, rollup.Add(1500000000, 10, metrics.Data))
+	assert.NoError(t, rollup.Add(1500000010, 10, metrics.Data))
+
+	// Series of interval are not changed by rollup, so they can be sent
+	for _, m := range metrics.Data {
+		assert.EqualValues(t, 1, m.Count)
+		assert.Equal(t, "php.requests", m.Name)
+	}
+	_, _, data := rollup.Flush(1500000100)
+	for _, m := range data {
+		assert.EqualValues(t, 2, m.Count)
+		assert.Equal(t, "php.requests.1m", m.Name)
+	}
+}
+
+func TestRollupMergeError(t *testing.T) {
+	tags := pinba.Tags{pinba.Tag{"server", "test.ru"}}
+	rollup := NewRollup(RollupSettings{Interval: 60, Suffix: ".1m"})
+
+	metrics := NewMetrics(10)
+	metrics.Add(tags, "php.requests", 1, 1, &MetricsSettings{newEstimator: func() Estimator { return NewExact() }})
+	assert.NoError(t, rollup.Add(1500000000, 10, metrics.Data))
+
+	// Estimator of metric is changed by config reload
+	metrics = NewMetrics(10)
+	metrics.Add(tags, "php.requests", 1, 2, &MetricsSettings{newEstimator: func() Estimator { return NewDDSketch(0.01) }})
+	assert.Error(t, rollup.Add(1500000010, 10, metrics.Data))
+
+	// Window is kept as it was, series of new settings are skipped
+	_, _, data := rollup.Flush(1500000100)
+	for _, m := range data {
+		assert.EqualValues(t, 1, m.Count)
+		assert.InDelta(t, 1, m.Max(), 0.001)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/olegfedoseev/pinba"
+)
+
+// SanitizeSettings describes how metric names and tag values are cleaned
+// from characters, that OpenTSDB doesn't accept
+type SanitizeSettings struct {
+	// Mode is "replace" (default) to replace illegal characters, "strip" to
+	// remove them or "off" to send names and values as is
+	Mode string `yaml:"mode"`
+	// Replacement for illegal characters, default is "_"
+	Replacement string `yaml:"replacement"`
+	// Allowed are legal characters besides ASCII letters and digits, default
+	// is "-_./", as in OpenTSDB
+	Allowed string `yaml:"allowed"`
+	// Unicode allows unicode letters, OpenTSDB accepts them too
+	Unicode bool `yaml:"unicode"`
+	// MaxLength of tag value in characters, longer ones are truncated, zero
+	// is unlimited
+	MaxLength int `yaml:"max_length"`
+}
+
+// Rules of Sanitizer, they are counted every time they change something
+const (
+	sanitizeReplaced = iota
+	sanitizeStripped
+	sanitizeTruncated
+	sanitizeDropped
+	sanitizeRules
+)
+
+var sanitizeRuleNames = [sanitizeRules]string{"replaced", "stripped", "truncated", "dropped"}
+
+// Sanitizer is compiled SanitizeSettings, nil Sanitizer doesn't change anything
+type Sanitizer struct {
+	strip       bool
+	replacement string
+	allowed     string
+	unicode     bool
+	maxLength   int
+
+	counts [sanitizeRules]int64
+}
+
+// Compile validates settings and returns Sanitizer for them, or nil if it's off
+func (s SanitizeSettings) Compile() (*Sanitizer, error) {
+	if s.Mode == "off" {
+		return nil, nil
+	}
+	if s.Mode != "" && s.Mode != "replace" && s.Mode != "strip" {
+		return nil, fmt.Errorf("sanitize mode should be replace, strip or off, got %q", s.Mode)
+	}
+	if s.MaxLength < 0 {
+		return nil, fmt.Errorf("sanitize max_length should be positive")
+	}
+
+	sanitizer := &Sanitizer{
+		strip:       s.Mode == "strip",
+		replacement: s.Replacement,
+		allowed:     s.Allowed,
+		unicode:     s.Unicode,
+		maxLength:   s.MaxLength,
+	}
+	if sanitizer.replacement == "" {
+		sanitizer.replacement = "_"
+	}
+	if sanitizer.allowed == "" {
+		sanitizer.allowed = "-_./"
+	}
+	for _, r := range sanitizer.replacement {
+		if !sanitizer.legal(r) {
+			return nil, fmt.Errorf("sanitize replacement %q has illegal characters", sanitizer.replacement)
+		}
+	}
+	return sanitizer, nil
+}
+
+func (s *Sanitizer) legal(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	case r < utf8.RuneSelf:
+		return strings.ContainsRune(s.allowed, r)
+	}
+	return s.unicode && unicode.IsLetter(r)
+}
+
+// clean replaces or strips illegal characters, returns value as is if there
+// is nothing to change
+func (s *Sanitizer) clean(value string) string {
+	i := strings.IndexFunc(value, func(r rune) bool { return !s.legal(r) })
+	if i == -1 {
+		return value
+	}
+
+	var b strings.Builder
+	b.WriteString(value[:i])
+	for _, r := range value[i:] {
+		switch {
+		case s.legal(r):
+			b.WriteRune(r)
+		case !s.strip:
+			b.WriteString(s.replacement)
+		}
+	}
+	if s.strip {
+		atomic.AddInt64(&s.counts[sanitizeStripped], 1)
+	} else {
+		atomic.AddInt64(&s.counts[sanitizeReplaced], 1)
+	}
+	return b.String()
+}
+
+// Name returns metric name without illegal characters
+func (s *Sanitizer) Name(name string) string {
+	if s == nil {
+		return name
+	}
+	return s.clean(name)
+}
+
+// Tags returns tags without illegal characters in values, with too long
+// values truncated and empty ones dropped. Given tags are not changed
+func (s *Sanitizer) Tags(tags pinba.Tags) pinba.Tags {
+	if s == nil {
+		return tags
+	}
+
+	var result pinba.Tags
+	for i, tag := range tags {
+		value := s.clean(tag.Value)
+		if s.maxLength > 0 && utf8.RuneCountInString(value) > s.maxLength {
+			value = string([]rune(value)[:s.maxLength])
+			atomic.AddInt64(&s.counts[sanitizeTruncated], 1)
+		}
+		if value == "" {
+			atomic.AddInt64(&s.counts[sanitizeDropped], 1)
+		}
+
+		if result == nil {
+			if value == tag.Value && value != "" {
+				continue
+			}
+			// Copy tags only if something is changed
+			result = make(pinba.Tags, i, len(tags))
+			copy(result, tags[:i])
+		}
+		if value != "" {
+			result = append(result, pinba.Tag{Key: tag.Key, Value: value})
+		}
+	}
+	if result == nil {
+		return tags
+	}
+	return result
+}
+
+// Counts returns how many times every rule changed something since the last
+// call, only rules that did are returned
+func (s *Sanitizer) Counts() map[string]int64 {
+	counts := make(map[string]int64)
+	if s == nil {
+		return counts
+	}
+	for i := range s.counts {
+		if n := atomic.SwapInt64(&s.counts[i], 0); n > 0 {
+			counts[sanitizeRuleNames[i]] = n
+		}
+	}
+	return counts
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeSettingsCompile(t *testing.T) {
+	s, err := SanitizeSettings{}.Compile()
+	assert.NoError(t, err)
+	assert.NotNil(t, s)
+
+	s, err = SanitizeSettings{Mode: "off"}.Compile()
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	_, err = SanitizeSettings{Mode: "fix"}.Compile()
+	assert.Error(t, err)
+	_, err = SanitizeSettings{Replacement: " "}.Compile()
+	assert.Error(t, err)
+	_, err = SanitizeSettings{MaxLength: -1}.Compile()
+	assert.Error(t, err)
+}
+
+func TestSanitizerName(t *testing.T) {
+	s, _ := SanitizeSettings{}.Compile()
+	assert.Equal(t, "php.timers.www.test.ru.db", s.Name("php.timers.www.test.ru.db"))
+	assert.Equal(t, "php.timers.my_server.db_read", s.Name("php.timers.my server.db:read"))
+	assert.Equal(t, "php.____", s.Name("php.тест"))
+	assert.Equal(t, map[string]int64{"replaced": 2}, s.Counts())
+	assert.Empty(t, s.Counts())
+
+	s, _ = SanitizeSettings{Mode: "strip", Unicode: true}.Compile()
+	assert.Equal(t, "php.timers.myserver.dbread", s.Name("php.timers.my server.db:read"))
+	assert.Equal(t, "php.тест", s.Name("php.тест"))
+	assert.Equal(t, map[string]int64{"stripped": 1}, s.Counts())
+
+	s = nil
+	assert.Equal(t, "php.my server", s.Name("php.my server"))
+	assert.Empty(t, s.Counts())
+}
+
+func TestSanitizerTags(t *testing.T) {
+	s, _ := SanitizeSettings{MaxLength: 10, Allowed: "-_."}.Compile()
+
+	tags := pinba.Tags{{Key: "server", Value: "test.ru"}, {Key: "script", Value: "index.php"}}
+	assert.Equal(t, tags, s.Tags(tags))
+
+	tags = pinba.Tags{
+		{Key: "script", Value: "/api/v1/user"},
+		{Key: "server", Value: "test.ru"},
+		{Key: "group", Value: ""},
+		{Key: "operation", Value: "SELECT * FROM users WHERE id = 1"},
+	}
+	assert.Equal(t, pinba.Tags{
+		{Key: "script", Value: "_api_v1_us"},
+		{Key: "server", Value: "test.ru"},
+		{Key: "operation", Value: "SELECT___F"},
+	}, s.Tags(tags))
+	// Original tags are not changed
+	assert.Equal(t, "/api/v1/user", tags[0].Value)
+	assert.Equal(t, map[string]int64{"replaced": 2, "truncated": 2, "dropped": 1}, s.Counts())
+
+	s, _ = SanitizeSettings{Mode: "strip"}.Compile()
+	assert.Empty(t, s.Tags(pinba.Tags{{Key: "user", Value: "тест"}}))
+	assert.Equal(t, map[string]int64{"stripped": 1, "dropped": 1}, s.Counts())
+}
+
+func TestMatchSanitized(t *testing.T) {
+	sanitizer, _ := SanitizeSettings{}.Compile()
+	w := &Writer{
+		prefix:    "php.",
+		shards:    []*Metrics{NewMetrics(10)},
+		sanitizer: sanitizer,
+		timersSettings: []MetricsSettings{
+			{Name: "timers.{group}", Tags: []string{"operation"}, Type: "timer", ReqiredTags: []string{"group"}},
+		},
+	}
+	request := &pinba.Request{
+		Tags: pinba.Tags{{Key: "server", Value: "test"}},
+		Timers: []pinba.Timer{
+			{HitCount: 1, Value: 0.1, Tags: pinba.Tags{{Key: "group", Value: "db:read"}, {Key: "operation", Value: "select users"}}},
+			{HitCount: 1, Value: 0.2, Tags: pinba.Tags{{Key: "group", Value: "db"}, {Key: "operation", Value: "!!!"}}},
+		},
+	}
+
+	samples, _ := w.match([]*pinba.Request{request})
+	assert.Len(t, samples[0], 2)
+	assert.Equal(t, "php.timers.db_read", samples[0][0].name)
+	assert.Equal(t, pinba.Tags{{Key: "operation", Value: "select_users"}}, samples[0][0].tags)
+	assert.Equal(t, pinba.Tags{{Key: "operation", Value: "___"}}, samples[0][1].tags)
+}
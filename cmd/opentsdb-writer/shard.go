@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ShardSettings describes how series are split between writer processes and
+// between aggregating goroutines inside of one process
+type ShardSettings struct {
+	// Total is number of writer processes, every one of them subscribes to
+	// collector and aggregates only its own part of series, default is 1
+	Total int `yaml:"total"`
+	// Index of this process, from 0 to Total-1
+	Index int `yaml:"index"`
+	// Aggregators is number of goroutines aggregating series in parallel,
+	// default is 1
+	Aggregators int `yaml:"aggregators"`
+}
+
+// Validate checks settings and sets defaults
+func (s *ShardSettings) Validate() error {
+	if s.Total == 0 {
+		s.Total = 1
+	}
+	if s.Aggregators == 0 {
+		s.Aggregators = 1
+	}
+	if s.Total < 0 || s.Aggregators < 0 {
+		return fmt.Errorf("shard total and aggregators should be positive")
+	}
+	if s.Index < 0 || s.Index >= s.Total {
+		return fmt.Errorf("shard index should be from 0 to %d, got %d", s.Total-1, s.Index)
+	}
+	return nil
+}
+
+// ringReplicas is number of points on the ring for every shard, more points
+// give more even distribution of keys
+const ringReplicas = 128
+
+// Ring is consistent hash ring, it maps series to shards so that changing
+// number of shards moves as few series as possible
+type Ring struct {
+	hashes []uint64
+	shards map[uint64]int
+}
+
+// NewRing creates ring for given number of shards
+func NewRing(size int) *Ring {
+	r := &Ring{
+		hashes: make([]uint64, 0, size*ringReplicas),
+		shards: make(map[uint64]int, size*ringReplicas),
+	}
+	for shard := 0; shard < size; shard++ {
+		for replica := 0; replica < ringReplicas; replica++ {
+			h := hash(strconv.Itoa(shard) + "-" + strconv.Itoa(replica))
+			r.hashes = append(r.hashes, h)
+			r.shards[h] = shard
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Get returns shard that owns given key
+func (r *Ring) Get(key string) int {
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.shards[r.hashes[i]]
+}
+
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// fnv is poor at mixing short keys, so finalize it like murmur3 does
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/olegfedoseev/opentsdb"
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardSettingsValidate(t *testing.T) {
+	s := ShardSettings{}
+	assert.NoError(t, s.Validate())
+	assert.Equal(t, ShardSettings{Total: 1, Index: 0, Aggregators: 1}, s)
+
+	s = ShardSettings{Total: 3, Index: 2}
+	assert.NoError(t, s.Validate())
+
+	s = ShardSettings{Total: 3, Index: 3}
+	assert.Error(t, s.Validate())
+
+	s = ShardSettings{Aggregators: -1}
+	assert.Error(t, s.Validate())
+}
+
+func TestRingDistribution(t *testing.T) {
+	ring := NewRing(4)
+	counts := make([]int, 4)
+	for i := 0; i < 10000; i++ {
+		counts[ring.Get(fmt.Sprintf("php.requests server=www%d.test.ru", i))]++
+	}
+	for shard, count := range counts {
+		assert.InDelta(t, 2500, count, 500, "shard %d", shard)
+	}
+}
+
+func TestRingConsistency(t *testing.T) {
+	before, after := NewRing(4), NewRing(5)
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("php.requests script=/page%d.php", i)
+		// Same key always goes to the same shard
+		assert.Equal(t, before.Get(key), before.Get(key))
+
+		if before.Get(key) != after.Get(key) {
+			moved++
+		}
+	}
+	// Only keys for new shard should move, about 1/5 of them
+	assert.InDelta(t, 2000, moved, 500)
+}
+
+func TestWriterAggregateShards(t *testing.T) {
+	settings := MetricsSettings{
+		Name:         "requests",
+		Tags:         []string{"script"},
+		newEstimator: func() Estimator { return NewExact() },
+		requestValue: requestValues["request_time"],
+	}
+	requests := make([]*pinba.Request, 0)
+	for i := 0; i < 1000; i++ {
+		requests = append(requests, &pinba.Request{
+			RequestTime: 0.1,
+			Tags: pinba.Tags{
+				{"server", "test.ru"},
+				{"script", fmt.Sprintf("/page%d.php", i%100)},
+			},
+		})
+	}
+
+	// All series in one process, split between 4 goroutines
+	w := &Writer{
+		prefix:           "php.",
+		shards:           []*Metrics{NewMetrics(10), NewMetrics(10), NewMetrics(10), NewMetrics(10)},
+		shardsRing:       NewRing(4),
+		requestsSettings: []MetricsSettings{settings},
+	}
+	w.aggregate(requests)
+
+	var series, count int64
+	for _, shard := range w.shards {
+		assert.NotEmpty(t, shard.Data)
+		for _, m := range shard.Data {
+			series++
+			count += m.Count
+		}
+	}
+	assert.EqualValues(t, 100, series)
+	assert.EqualValues(t, 1000, count)
+
+	// Same series split between two processes
+	series = 0
+	for index := 0; index < 2; index++ {
+		w := &Writer{
+			prefix:           "php.",
+			shards:           []*Metrics{NewMetrics(10)},
+			ring:             NewRing(2),
+			shard:            index,
+			requestsSettings: []MetricsSettings{settings},
+		}
+		w.aggregate(requests)
+		assert.NotEmpty(t, w.shards[0].Data)
+		series += int64(len(w.shards[0].Data))
+	}
+	assert.EqualValues(t, 100, series)
+}
+
+func TestWriterStatsTags(t *testing.T) {
+	w := &Writer{prefix: "php."}
+	assert.Equal(t, opentsdb.Tags{"type": "php."}, w.statsTags())
+
+	// Every process of ring sends its own series of self-metrics
+	w = &Writer{prefix: "php.", ring: NewRing(2), shard: 1}
+	assert.Equal(t, opentsdb.Tags{"type": "php.", "shard": "1"}, w.statsTags())
+	assert.Equal(t, opentsdb.Tags{"type": "php.", "shard": "1", "tag": "server"},
+		withTag(w.statsTags(), "tag", "server"))
+}
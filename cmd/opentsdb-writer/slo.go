@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/olegfedoseev/opentsdb"
+)
+
+// SLOSettings describes latency objective of metric. Values up to threshold
+// T are good (satisfied in terms of Apdex), values up to 4T are tolerating
+// and the rest are frustrated. Both tolerating and frustrated are bad
+type SLOSettings struct {
+	// Threshold T in units of metric value, seconds for request time
+	Threshold float64 `yaml:"threshold"`
+	// Objective is target share of good values, like 0.999. Burn rates are
+	// sent only if it's set
+	Objective float64 `yaml:"objective"`
+	// Windows of burn rates in seconds, default is 5 minutes and 1 hour
+	Windows []int64 `yaml:"windows"`
+}
+
+var defaultBurnWindows = []int64{300, 3600}
+
+// IsEmpty returns true if there is no threshold, so no SLO metrics
+func (s SLOSettings) IsEmpty() bool {
+	return s.Threshold == 0
+}
+
+// Validate checks settings and sets defaults, windows should be at least
+// one interval long
+func (s *SLOSettings) Validate(interval int64) error {
+	if s.Threshold < 0 {
+		return fmt.Errorf("slo threshold should be positive")
+	}
+	if s.Objective < 0 || s.Objective >= 1 {
+		return fmt.Errorf("slo objective should be in [0, 1), got %v", s.Objective)
+	}
+	if s.Objective > 0 && len(s.Windows) == 0 {
+		s.Windows = defaultBurnWindows
+	}
+	for _, window := range s.Windows {
+		if window < interval {
+			return fmt.Errorf("slo window %d is shorter than interval %d", window, interval)
+		}
+	}
+	return nil
+}
+
+// Apdex counts values by threshold of SLO
+type Apdex struct {
+	settings *SLOSettings
+
+	Satisfied  int64
+	Tolerating int64
+	Frustrated int64
+}
+
+// NewApdex creates empty counters for given settings
+func NewApdex(settings *SLOSettings) *Apdex {
+	return &Apdex{settings: settings}
+}
+
+// Add counts value as satisfied, tolerating or frustrated
+func (a *Apdex) Add(value float64) {
+	switch {
+	case value <= a.settings.Threshold:
+		a.Satisfied++
+	case value <= 4*a.settings.Threshold:
+		a.Tolerating++
+	default:
+		a.Frustrated++
+	}
+}
+
+// Good returns number of values within threshold
+func (a *Apdex) Good() int64 {
+	return a.Satisfied
+}
+
+// Bad returns number of values over threshold
+func (a *Apdex) Bad() int64 {
+	return a.Tolerating + a.Frustrated
+}
+
+// Score returns Apdex score from 0 to 1, it's 1 if there is no values
+func (a *Apdex) Score() float64 {
+	total := a.Satisfied + a.Tolerating + a.Frustrated
+	if total == 0 {
+		return 1
+	}
+	return (float64(a.Satisfied) + float64(a.Tolerating)/2) / float64(total)
+}
+
+// Mergeable checks that other Apdex has the same threshold
+func (a *Apdex) Mergeable(other *Apdex) error {
+	if a.settings.Threshold != other.settings.Threshold {
+		return fmt.Errorf("can't merge apdex with threshold %v into %v",
+			other.settings.Threshold, a.settings.Threshold)
+	}
+	return nil
+}
+
+// Merge adds counters of other Apdex with the same threshold
+func (a *Apdex) Merge(other *Apdex) error {
+	if err := a.Mergeable(other); err != nil {
+		return err
+	}
+	a.Satisfied += other.Satisfied
+	a.Tolerating += other.Tolerating
+	a.Frustrated += other.Frustrated
+	return nil
+}
+
+// Clone returns copy of counters
+func (a *Apdex) Clone() *Apdex {
+	c := *a
+	return &c
+}
+
+// burnBuckets is number of buckets in every window of burn rate, so window
+// slides with step of 1/burnBuckets of its size (but not less than interval)
+const burnBuckets = 60
+
+type burnBucket struct {
+	start     int64
+	good, bad int64
+}
+
+// burnWindow keeps numbers of good and bad values in ring of buckets
+type burnWindow struct {
+	size    int64
+	step    int64
+	buckets []burnBucket
+}
+
+func newBurnWindow(size, interval int64) *burnWindow {
+	step := size / burnBuckets
+	if step < interval {
+		step = interval
+	}
+	return &burnWindow{
+		size:    size,
+		step:    step,
+		buckets: make([]burnBucket, (size+step-1)/step),
+	}
+}
+
+func (w *burnWindow) add(ts int64, good, bad int64) {
+	start := ts - ts%w.step
+	b := &w.buckets[(start/w.step)%int64(len(w.buckets))]
+	if b.start != start {
+		*b = burnBucket{start: start}
+	}
+	b.good += good
+	b.bad += bad
+}
+
+// sum returns numbers of good and bad values in window ending at ts
+func (w *burnWindow) sum(ts int64) (good, bad int64) {
+	for _, b := range w.buckets {
+		if b.start > ts-w.size && b.start <= ts {
+			good += b.good
+			bad += b.bad
+		}
+	}
+	return
+}
+
+type burnSeries struct {
+	name      string
+	tags      opentsdb.Tags
+	objective float64
+	windows   []*burnWindow
+	seen      int64
+}
+
+// BurnRates tracks good and bad values of series with SLO objective over
+// several windows. Burn rate is ratio of bad values in window to error
+// budget, 1 means that budget is spent exactly in SLO period
+type BurnRates struct {
+	interval int64
+	series   map[string]*burnSeries
+}
+
+// NewBurnRates creates tracker for given aggregation interval in seconds
+func NewBurnRates(interval int64) *BurnRates {
+	return &BurnRates{interval: interval, series: make(map[string]*burnSeries)}
+}
+
+// Add counts values of series of one interval, that have SLO objective
+func (b *BurnRates) Add(ts int64, data map[string]*Metric) {
+	for id, m := range data {
+		if m.Apdex == nil || m.Apdex.settings.Objective == 0 {
+			continue
+		}
+		settings := m.Apdex.settings
+
+		s, ok := b.series[id]
+		if !ok || !sameWindows(s.windows, settings.Windows) {
+			s = &burnSeries{name: m.Name, tags: m.Tags}
+			for _, size := range settings.Windows {
+				s.windows = append(s.windows, newBurnWindow(size, b.interval))
+			}
+			b.series[id] = s
+		}
+		s.objective = settings.Objective
+		s.seen = ts
+		for _, w := range s.windows {
+			w.add(ts, m.Apdex.Good(), m.Apdex.Bad())
+		}
+	}
+}
+
+// Expire forgets series, that weren't seen for the longest of their windows
+func (b *BurnRates) Expire(ts int64) {
+	for id, s := range b.series {
+		var longest int64
+		for _, w := range s.windows {
+			if w.size > longest {
+				longest = w.size
+			}
+		}
+		if ts-s.seen >= longest {
+			delete(b.series, id)
+		}
+	}
+}
+
+func sameWindows(windows []*burnWindow, sizes []int64) bool {
+	if len(windows) != len(sizes) {
+		return false
+	}
+	for i, w := range windows {
+		if w.size != sizes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Each calls fn with burn rate of every series and window at ts, windows
+// without values are skipped
+func (b *BurnRates) Each(ts int64, fn func(name string, tags opentsdb.Tags, window string, rate float64)) {
+	for _, s := range b.series {
+		for _, w := range s.windows {
+			good, bad := w.sum(ts)
+			if good+bad == 0 {
+				continue
+			}
+			rate := float64(bad) / float64(good+bad) / (1 - s.objective)
+			fn(s.name, s.tags, windowLabel(w.size), rate)
+		}
+	}
+}
+
+// windowLabel returns short name of window, like "5m" or "1h"
+func windowLabel(seconds int64) string {
+	switch {
+	case seconds%86400 == 0:
+		return strconv.FormatInt(seconds/86400, 10) + "d"
+	case seconds%3600 == 0:
+		return strconv.FormatInt(seconds/3600, 10) + "h"
+	case seconds%60 == 0:
+		return strconv.FormatInt(seconds/60, 10) + "m"
+	}
+	return strconv.FormatInt(seconds, 10) + "s"
+}
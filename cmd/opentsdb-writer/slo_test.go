@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSLOSettingsValidate(t *testing.T) {
+	s := SLOSettings{Threshold: 0.3}
+	assert.NoError(t, s.Validate(10))
+	assert.Empty(t, s.Windows)
+
+	s = SLOSettings{Threshold: 0.3, Objective: 0.999}
+	assert.NoError(t, s.Validate(10))
+	assert.Equal(t, []int64{300, 3600}, s.Windows)
+
+	for _, s := range []SLOSettings{
+		{Threshold: -1},
+		{Threshold: 0.3, Objective: 1},
+		{Threshold: 0.3, Objective: 0.99, Windows: []int64{5}},
+	} {
+		assert.Error(t, s.Validate(10), "%+v", s)
+	}
+}
+
+func TestApdex(t *testing.T) {
+	a := NewApdex(&SLOSettings{Threshold: 0.5})
+	assert.EqualValues(t, 1, a.Score())
+
+	for _, v := range []float64{0.1, 0.5, 0.6, 2, 2.1, 10} {
+		a.Add(v)
+	}
+	assert.EqualValues(t, 2, a.Good())
+	assert.EqualValues(t, 4, a.Bad())
+	assert.EqualValues(t, 2, a.Tolerating)
+	assert.InDelta(t, 0.5, a.Score(), 1e-9)
+
+	b := a.Clone()
+	b.Add(0.1)
+	assert.NoError(t, a.Merge(b))
+	assert.EqualValues(t, 5, a.Good())
+	assert.EqualValues(t, 8, a.Bad())
+	assert.Error(t, a.Merge(NewApdex(&SLOSettings{Threshold: 1})))
+}
+
+func TestMetricsAddApdex(t *testing.T) {
+	settings := &MetricsSettings{
+		newEstimator: func() Estimator { return NewExact() },
+		slo:          &SLOSettings{Threshold: 0.3},
+	}
+	tags := pinba.Tags{pinba.Tag{"server", "test.ru"}}
+
+	metrics := NewMetrics(10)
+	metrics.Add(tags, "php.requests", 1, 0.2, settings)
+	metrics.Add(tags, "php.requests", 1, 0.4, settings)
+	metrics.Add(tags, "php.requests.cpu", 1, 0.4, settings)
+
+	for _, m := range metrics.Data {
+		if m.Name == "php.requests.cpu" {
+			assert.Nil(t, m.Apdex)
+			continue
+		}
+		assert.EqualValues(t, 1, m.Apdex.Good())
+		assert.EqualValues(t, 1, m.Apdex.Bad())
+	}
+}
+
+func TestBurnWindow(t *testing.T) {
+	w := newBurnWindow(60, 10)
+	assert.EqualValues(t, 10, w.step)
+	assert.Len(t, w.buckets, 6)
+
+	for ts := int64(1500000000); ts < 1500000120; ts += 10 {
+		w.add(ts, 9, 1)
+	}
+	good, bad := w.sum(1500000110)
+	assert.EqualValues(t, 54, good)
+	assert.EqualValues(t, 6, bad)
+
+	// Old buckets are out of window
+	good, bad = w.sum(1500000150)
+	assert.EqualValues(t, 18, good)
+	assert.EqualValues(t, 2, bad)
+
+	w = newBurnWindow(3600, 10)
+	assert.EqualValues(t, 60, w.step)
+	assert.Len(t, w.buckets, 60)
+}
+
+func TestBurnRates(t *testing.T) {
+	slo := &SLOSettings{Threshold: 0.3, Objective: 0.99, Windows: []int64{60, 300}}
+	tags := pinba.Tags{pinba.Tag{"server", "test.ru"}}
+	b := NewBurnRates(10)
+
+	rates := func(ts int64) map[string]float64 {
+		result := make(map[string]float64)
+		b.Each(ts, func(name string, tags opentsdb.Tags, window string, rate float64) {
+			assert.Equal(t, "php.requests", name)
+			assert.Equal(t, opentsdb.Tags{"server": "test.ru"}, tags)
+			result[window] = rate
+		})
+		return result
+	}
+
+	// 1% of bad values for 4 minutes and then 5% for 1 minute
+	ts := int64(1500000000)
+	for ; ts < 1500000300; ts += 10 {
+		m := NewMetric("php.requests", tags, NewExact())
+		m.Apdex = NewApdex(slo)
+		bad := 1
+		if ts >= 1500000240 {
+			bad = 5
+		}
+		for i := 0; i < 100; i++ {
+			if i < bad {
+				m.Add(1, 1)
+			} else {
+				m.Add(1, 0.1)
+			}
+		}
+		b.Add(ts, map[string]*Metric{"php.requests server=test.ru": m})
+	}
+
+	result := rates(ts - 10)
+	assert.InDelta(t, 5, result["1m"], 1e-9)
+	assert.InDelta(t, 1.8, result["5m"], 1e-9)
+
+	// Series without objective are not tracked
+	m := NewMetric("php.other", tags, NewExact())
+	m.Apdex = NewApdex(&SLOSettings{Threshold: 0.3})
+	m.Add(1, 1)
+	b.Add(ts, map[string]*Metric{"php.other server=test.ru": m})
+	assert.Len(t, b.series, 1)
+
+	b.Expire(ts + 200)
+	assert.Len(t, b.series, 1)
+	b.Expire(ts + 300)
+	assert.Empty(t, b.series)
+}
+
+func TestWindowLabel(t *testing.T) {
+	assert.Equal(t, "5m", windowLabel(300))
+	assert.Equal(t, "1h", windowLabel(3600))
+	assert.Equal(t, "6h", windowLabel(21600))
+	assert.Equal(t, "3d", windowLabel(259200))
+	assert.Equal(t, "90s", windowLabel(90))
+}
+
+func TestSendApdex(t *testing.T) {
+	backend := NewHTTPBackend("127.0.0.1:4242", 100, time.Second, false)
+	w := &Writer{client: backend}
+
+	m := NewMetric("php.requests", pinba.Tags{pinba.Tag{"server", "test.ru"}}, NewExact())
+	m.Apdex = NewApdex(&SLOSettings{Threshold: 0.3})
+	m.Add(1, 0.1)
+	m.Add(1, 0.5)
+	w.send(&client.PinbaRequests{Timestamp: 1500000000, Span: 10}, map[string]*Metric{"id": m})
+
+	values := make(map[string]interface{})
+	for len(backend.queue) > 0 {
+		p := <-backend.queue
+		values[p.Metric] = p.Value
+	}
+	assert.Equal(t, 0.75, values["php.requests.apdex"])
+	assert.EqualValues(t, 1, values["php.requests.good"])
+	assert.EqualValues(t, 1, values["php.requests.bad"])
+}
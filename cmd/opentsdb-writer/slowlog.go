@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+)
+
+// SlowLogSettings describes log of the slowest requests of every series in
+// every interval, with all their tags and timers
+type SlowLogSettings struct {
+	// By is tags of requests, which values are series, default is server and
+	// script
+	By []string `yaml:"by"`
+	// Top is number of the slowest requests of series kept in interval
+	Top int `yaml:"top"`
+	// MinTime is request time in seconds, faster requests are not logged
+	MinTime float64 `yaml:"min_time"`
+	// MaxSeries limits number of series in interval, requests of the rest of
+	// them are not logged
+	MaxSeries int `yaml:"max_series"`
+
+	// File gets samples as JSON lines, it's renamed to "<file>.1" when it
+	// reaches MaxSize in MB
+	File    string `yaml:"file"`
+	MaxSize int64  `yaml:"max_size"`
+	// Ring is number of the latest samples kept in memory and served as JSON
+	// over HTTP at Listen address
+	Ring   int    `yaml:"ring"`
+	Listen string `yaml:"listen"`
+}
+
+// Defaults of slow log settings
+const (
+	defaultSlowTop       = 3
+	defaultSlowMaxSeries = 10000
+	defaultSlowMaxSize   = 100
+	defaultSlowRing      = 10000
+)
+
+var defaultSlowBy = []string{"server", "script"}
+
+// IsEmpty returns true if samples go nowhere, so slow log is disabled
+func (s SlowLogSettings) IsEmpty() bool {
+	return s.File == "" && s.Listen == ""
+}
+
+// Validate checks settings and sets defaults
+func (s *SlowLogSettings) Validate() error {
+	if s.IsEmpty() {
+		return nil
+	}
+	if s.Top < 0 || s.MinTime < 0 || s.MaxSeries < 0 || s.MaxSize < 0 || s.Ring < 0 {
+		return fmt.Errorf("slow_log top, min_time, max_series, max_size and ring should be positive")
+	}
+	if len(s.By) == 0 {
+		s.By = defaultSlowBy
+	}
+	if s.Top == 0 {
+		s.Top = defaultSlowTop
+	}
+	if s.MaxSeries == 0 {
+		s.MaxSeries = defaultSlowMaxSeries
+	}
+	if s.MaxSize == 0 {
+		s.MaxSize = defaultSlowMaxSize
+	}
+	if s.Ring == 0 {
+		s.Ring = defaultSlowRing
+	}
+	return nil
+}
+
+// slowHeap is min-heap of requests by request time, so the fastest of kept
+// requests is replaced by slower one
+type slowHeap []*pinba.Request
+
+func (h slowHeap) Len() int            { return len(h) }
+func (h slowHeap) Less(i, j int) bool  { return h[i].RequestTime < h[j].RequestTime }
+func (h slowHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *slowHeap) Push(x interface{}) { *h = append(*h, x.(*pinba.Request)) }
+func (h *slowHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// SlowLog keeps the slowest requests of every series in interval and writes
+// them to file and ring of the latest samples. Methods are safe to call on
+// nil SlowLog, it does nothing then
+type SlowLog struct {
+	settings SlowLogSettings
+
+	// file, its buffer and size, nil if samples are not written to file.
+	// Buffer is flushed once per interval
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+
+	mu   sync.Mutex
+	ring []client.Record
+	next int
+	full bool
+}
+
+// NewSlowLog creates slow log for validated settings, it returns nil if
+// they are empty
+func NewSlowLog(settings SlowLogSettings) (*SlowLog, error) {
+	if settings.IsEmpty() {
+		return nil, nil
+	}
+	l := &SlowLog{settings: settings}
+	if settings.Listen != "" {
+		l.ring = make([]client.Record, settings.Ring)
+	}
+	if settings.File != "" {
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *SlowLog) open() error {
+	f, err := os.OpenFile(l.settings.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open slow log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open slow log: %v", err)
+	}
+	l.file, l.buf, l.size = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+// Listen starts HTTP server of samples in ring, if address is set
+func (l *SlowLog) Listen() error {
+	if l == nil || l.settings.Listen == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", l.settings.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen for slow log: %v", err)
+	}
+	go func() {
+		if err := http.Serve(listener, l); err != nil {
+			log.Printf("[ERROR] Slow log HTTP server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Log picks the slowest requests of every series, writes them and returns
+// their number
+func (l *SlowLog) Log(ts int64, requests []*pinba.Request) int {
+	if l == nil {
+		return 0
+	}
+
+	series := make(map[string]*slowHeap)
+	for _, r := range requests {
+		if float64(r.RequestTime) < l.settings.MinTime {
+			continue
+		}
+		key := l.key(r)
+		h, ok := series[key]
+		if !ok {
+			if len(series) >= l.settings.MaxSeries {
+				continue
+			}
+			h = &slowHeap{}
+			series[key] = h
+		}
+		if h.Len() < l.settings.Top {
+			heap.Push(h, r)
+		} else if r.RequestTime > (*h)[0].RequestTime {
+			(*h)[0] = r
+			heap.Fix(h, 0)
+		}
+	}
+
+	samples := make([]client.Record, 0, len(series)*l.settings.Top)
+	for _, h := range series {
+		for _, r := range *h {
+			samples = append(samples, client.NewRecord(ts, r))
+		}
+	}
+	l.write(samples)
+	return len(samples)
+}
+
+func (l *SlowLog) key(r *pinba.Request) string {
+	values := make([]string, len(l.settings.By))
+	for i, tag := range l.settings.By {
+		values[i], _ = tagValue(r.Tags, tag)
+	}
+	return strings.Join(values, "\x00")
+}
+
+func (l *SlowLog) write(samples []client.Record) {
+	if l.file != nil {
+		for _, s := range samples {
+			data, err := json.Marshal(s)
+			if err != nil {
+				log.Printf("[ERROR] Failed to encode slow log sample: %v", err)
+				continue
+			}
+			if err := l.writeLine(data); err != nil {
+				log.Printf("[ERROR] Failed to write slow log: %v", err)
+				break
+			}
+		}
+		if l.buf != nil {
+			if err := l.buf.Flush(); err != nil {
+				log.Printf("[ERROR] Failed to write slow log: %v", err)
+			}
+		}
+	}
+
+	if l.ring == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range samples {
+		l.ring[l.next] = s
+		l.next = (l.next + 1) % len(l.ring)
+		l.full = l.full || l.next == 0
+	}
+}
+
+// writeLine appends line to buffer of file, rotating file first if it's full
+func (l *SlowLog) writeLine(data []byte) error {
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && l.size+int64(len(data))+1 > l.settings.MaxSize<<20 {
+		err := l.buf.Flush()
+		l.file.Close()
+		l.file, l.buf = nil, nil
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(l.settings.File, l.settings.File+".1"); err != nil {
+			return err
+		}
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	n, err := l.buf.Write(append(data, '\n'))
+	l.size += int64(n)
+	return err
+}
+
+// Recent returns up to limit of the latest samples from ring, which tags
+// have given values, the newest first
+func (l *SlowLog) Recent(tags map[string]string, limit int) []client.Record {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := make([]client.Record, 0)
+	n := l.next
+	if l.full {
+		n = len(l.ring)
+	}
+	for i := 0; i < n && len(result) < limit; i++ {
+		s := l.ring[(l.next-1-i+len(l.ring))%len(l.ring)]
+		if matchSample(s, tags) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func matchSample(s client.Record, tags map[string]string) bool {
+	for key, value := range tags {
+		if s.Tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP returns the latest samples as JSON array. Query parameters are
+// tags, that samples should have, except "limit", which is 100 by default
+func (l *SlowLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	tags := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		if key != "limit" {
+			tags[key] = values[0]
+			continue
+		}
+		n, err := strconv.Atoi(values[0])
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l.Recent(tags, limit)); err != nil {
+		log.Printf("[ERROR] Failed to send slow log: %v", err)
+	}
+}
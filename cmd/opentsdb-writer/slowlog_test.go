@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowLogSettingsValidate(t *testing.T) {
+	s := SlowLogSettings{}
+	assert.NoError(t, s.Validate())
+	assert.True(t, s.IsEmpty())
+
+	s = SlowLogSettings{Listen: "127.0.0.1:0"}
+	assert.NoError(t, s.Validate())
+	assert.Equal(t, []string{"server", "script"}, s.By)
+	assert.Equal(t, defaultSlowTop, s.Top)
+	assert.Equal(t, defaultSlowRing, s.Ring)
+
+	s = SlowLogSettings{File: "slow.jsonl", Top: -1}
+	assert.Error(t, s.Validate())
+}
+
+func testSlowRequests() []*pinba.Request {
+	var requests []*pinba.Request
+	for i := 0; i < 20; i++ {
+		requests = append(requests, &pinba.Request{
+			Hostname:    "web1",
+			ScriptName:  fmt.Sprintf("/%d.php", i%2),
+			RequestTime: float32(i) / 10,
+			Tags: pinba.Tags{
+				{Key: "server", Value: "test.ru"},
+				{Key: "script", Value: fmt.Sprintf("/%d.php", i%2)},
+			},
+			Timers: []pinba.Timer{{HitCount: 1, Value: float32(i) / 20, Tags: pinba.Tags{{Key: "group", Value: "db"}}}},
+		})
+	}
+	return requests
+}
+
+func TestSlowLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slowlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	settings := SlowLogSettings{File: filepath.Join(dir, "slow.jsonl"), Listen: "127.0.0.1:0", Top: 2, MinTime: 0.5, Ring: 5}
+	assert.NoError(t, settings.Validate())
+	l, err := NewSlowLog(settings)
+	assert.NoError(t, err)
+
+	// Two the slowest requests of both scripts
+	assert.Equal(t, 4, l.Log(1500000000, testSlowRequests()))
+
+	f, err := os.Open(settings.File)
+	assert.NoError(t, err)
+	defer f.Close()
+	var times []float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s client.Record
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &s))
+		assert.EqualValues(t, 1500000000, s.Timestamp)
+		assert.Equal(t, "test.ru", s.Tags["server"])
+		assert.Equal(t, "db", s.Timers[0].Tags["group"])
+		times = append(times, float64(s.RequestTime))
+	}
+	sort.Float64s(times)
+	assert.InDeltaSlice(t, []float64{1.6, 1.7, 1.8, 1.9}, times, 1e-6)
+
+	// Nothing is slow enough
+	assert.Equal(t, 0, l.Log(1500000010, testSlowRequests()[:5]))
+
+	recent := l.Recent(map[string]string{"script": "/1.php"}, 10)
+	assert.Len(t, recent, 2)
+	assert.Len(t, l.Recent(nil, 3), 3)
+
+	// Ring keeps only the latest samples
+	l.Log(1500000020, testSlowRequests())
+	assert.Len(t, l.Recent(nil, 10), 5)
+	assert.EqualValues(t, 1500000020, l.Recent(nil, 10)[0].Timestamp)
+
+	var nilLog *SlowLog
+	assert.Equal(t, 0, nilLog.Log(1500000000, testSlowRequests()))
+	assert.NoError(t, nilLog.Listen())
+}
+
+func TestSlowLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slowlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	settings := SlowLogSettings{File: filepath.Join(dir, "slow.jsonl"), MaxSize: 1}
+	assert.NoError(t, settings.Validate())
+	l, err := NewSlowLog(settings)
+	assert.NoError(t, err)
+	l.size = 1<<20 - 10
+
+	l.Log(1500000000, testSlowRequests())
+	_, err = os.Stat(settings.File + ".1")
+	assert.NoError(t, err)
+	assert.True(t, l.size > 0 && l.size < 1<<20)
+}
+
+func TestSlowLogHTTP(t *testing.T) {
+	l, err := NewSlowLog(SlowLogSettings{Listen: "127.0.0.1:0", Top: 1, By: []string{"script"}, MaxSeries: 10, Ring: 10})
+	assert.NoError(t, err)
+	l.Log(1500000000, testSlowRequests())
+
+	server := httptest.NewServer(l)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?script=/0.php")
+	assert.NoError(t, err)
+	var samples []client.Record
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&samples))
+	resp.Body.Close()
+	assert.Len(t, samples, 1)
+	assert.Equal(t, "/0.php", samples[0].ScriptName)
+	assert.InDelta(t, 1.8, samples[0].RequestTime, 1e-6)
+
+	resp, err = http.Get(server.URL + "/?limit=x")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
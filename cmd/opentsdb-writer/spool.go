@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+)
+
+// SpoolSettings describes on-disk queue for data points, that OpenTSDB
+// client can't take right now
+type SpoolSettings struct {
+	// Dir for spool files, spool is disabled if it's empty
+	Dir string `yaml:"dir"`
+	// MaxSize of all spool files in megabytes, default is 1024
+	MaxSize int64 `yaml:"max_size"`
+	// SegmentSize is size of one spool file in megabytes, default is 16
+	SegmentSize int64 `yaml:"segment_size"`
+}
+
+// Validate checks settings and sets defaults
+func (s *SpoolSettings) Validate() error {
+	if s.Dir == "" {
+		return nil
+	}
+	if s.MaxSize == 0 {
+		s.MaxSize = defaultSpoolSize
+	}
+	if s.SegmentSize == 0 {
+		s.SegmentSize = defaultSegmentSize
+	}
+	if s.MaxSize < 0 || s.SegmentSize < 0 {
+		return fmt.Errorf("spool max_size and segment_size should be positive")
+	}
+	if s.SegmentSize > s.MaxSize {
+		return fmt.Errorf("spool segment_size should not be greater than max_size")
+	}
+	return nil
+}
+
+// spoolPoint is data point as it's stored in spool
+type spoolPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type spoolSegment struct {
+	seq    int64
+	size   int64
+	points int64
+}
+
+// Spool is bounded FIFO queue of data points on disk. It's split in segment
+// files, and when it's full, the oldest segments are evicted
+type Spool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mu       sync.Mutex
+	segments []*spoolSegment // oldest first, last one is being written
+	size     int64
+	points   int64
+	evicted  int64
+
+	writer *os.File
+	reader *bufio.Reader
+	file   *os.File // file of reader, it's always the oldest segment
+	// offset is number of bytes of the oldest segment, that are already
+	// popped, it's saved to offset file, so they are not replayed again
+	offset int64
+}
+
+// spoolOffsetFile keeps sequence number of the oldest segment and offset of
+// its first data point, that is not popped yet
+const spoolOffsetFile = "offset"
+
+// NewSpool opens spool in given dir, with data points left from previous run
+func NewSpool(dir string, maxSize, segmentSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool dir: %v", err)
+	}
+
+	s := &Spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		segments:    make([]*spoolSegment, 0),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool dir: %v", err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".spool") {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, ".spool"), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{seq: seq, size: file.Size()})
+		s.size += file.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	if len(s.segments) > 0 {
+		seq, offset, err := s.readOffset()
+		if err != nil {
+			return nil, err
+		}
+		if seq == s.segments[0].seq && offset <= s.segments[0].size {
+			s.offset = offset
+		}
+	}
+	for i, segment := range s.segments {
+		var offset int64
+		if i == 0 {
+			offset = s.offset
+		}
+		segment.points, err = countLines(s.filename(segment.seq), offset)
+		if err != nil {
+			return nil, err
+		}
+		s.points += segment.points
+	}
+
+	var next int64
+	if len(s.segments) > 0 {
+		next = s.segments[len(s.segments)-1].seq + 1
+	}
+	if err := s.rotate(next); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// countLines returns number of lines in file after given offset
+func countLines(filename string, offset int64) (int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var lines int64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines, scanner.Err()
+}
+
+func (s *Spool) filename(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.spool", seq))
+}
+
+// readOffset returns sequence number of segment and offset in it from
+// offset file, -1 if there is no file
+func (s *Spool) readOffset() (int64, int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolOffsetFile))
+	if os.IsNotExist(err) {
+		return -1, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read spool offset: %v", err)
+	}
+	var seq, offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err != nil {
+		return -1, 0, nil // broken file, replay whole segment
+	}
+	return seq, offset, nil
+}
+
+// saveOffset writes sequence number of the oldest segment and offset in it
+// to offset file, it's replaced at once, so it's never half written
+func (s *Spool) saveOffset() error {
+	filename := filepath.Join(s.dir, spoolOffsetFile)
+	data := fmt.Sprintf("%d %d\n", s.segments[0].seq, s.offset)
+	if err := ioutil.WriteFile(filename+".tmp", []byte(data), 0644); err != nil {
+		return fmt.Errorf("failed to save spool offset: %v", err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return fmt.Errorf("failed to save spool offset: %v", err)
+	}
+	return nil
+}
+
+// rotate starts new segment with given sequence number for writing
+func (s *Spool) rotate(seq int64) error {
+	if s.writer != nil {
+		s.writer.Close()
+	}
+	writer, err := os.OpenFile(s.filename(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %v", err)
+	}
+	s.writer = writer
+	s.segments = append(s.segments, &spoolSegment{seq: seq})
+	return nil
+}
+
+// Push appends data point to the end of spool, evicting the oldest segments
+// if spool is full
+func (s *Spool) Push(point spoolPoint) error {
+	line, err := json.Marshal(point)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.segments[len(s.segments)-1]
+	if current.size > 0 && current.size+int64(len(line)) > s.segmentSize {
+		if err := s.rotate(current.seq + 1); err != nil {
+			return err
+		}
+		current = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := s.writer.Write(line); err != nil {
+		return err
+	}
+	current.size += int64(len(line))
+	current.points++
+	s.size += int64(len(line))
+	s.points++
+
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		s.evicted += s.segments[0].points
+		s.removeOldest()
+	}
+	return nil
+}
+
+// removeOldest deletes the oldest segment, it should not be the current one
+func (s *Spool) removeOldest() {
+	oldest := s.segments[0]
+	if s.file != nil {
+		s.file.Close()
+		s.file, s.reader = nil, nil
+	}
+	os.Remove(s.filename(oldest.seq))
+	s.size -= oldest.size
+	s.points -= oldest.points
+	s.segments = s.segments[1:]
+	s.offset = 0
+}
+
+// Pop returns up to n the oldest data points and removes them from spool.
+// Offset of the next data point is saved, so popped ones are not returned
+// after restart
+func (s *Spool) Pop(n int) ([]spoolPoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	points := make([]spoolPoint, 0, n)
+	offset := s.offset
+	for len(points) < n && s.points > 0 {
+		oldest := s.segments[0]
+		if s.reader == nil {
+			file, err := os.Open(s.filename(oldest.seq))
+			if err != nil {
+				return points, err
+			}
+			if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+				file.Close()
+				return points, err
+			}
+			s.file, s.reader = file, bufio.NewReader(file)
+		}
+
+		line, err := s.reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			if len(s.segments) == 1 {
+				break // nothing more is written yet
+			}
+			s.removeOldest()
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return points, err
+		}
+
+		s.offset += int64(len(line))
+		oldest.points--
+		s.points--
+		var point spoolPoint
+		if err := json.Unmarshal(line, &point); err != nil {
+			continue // broken line, for example after crash
+		}
+		points = append(points, point)
+	}
+	if s.offset == offset && len(points) == 0 {
+		return points, nil
+	}
+	return points, s.saveOffset()
+}
+
+// Size returns size of spool on disk in bytes
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Len returns number of data points in spool
+func (s *Spool) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.points
+}
+
+// Evicted returns number of data points evicted since the last call
+func (s *Spool) Evicted() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evicted := s.evicted
+	s.evicted = 0
+	return evicted
+}
+
+// Close closes spool files, data points stay on disk for the next run
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+	}
+	return s.writer.Close()
+}
+
+// newSpoolPoint converts value of data point to float64, so it can be
+// stored, values of other types are rejected
+func newSpoolPoint(metric string, ts int64, value interface{}, tags opentsdb.Tags) (spoolPoint, error) {
+	var v float64
+	switch value := value.(type) {
+	case float64:
+		v = value
+	case float32:
+		v = float64(value)
+	case int:
+		v = float64(value)
+	case int64:
+		v = float64(value)
+	case int32:
+		v = float64(value)
+	case uint64:
+		v = float64(value)
+	case uint32:
+		v = float64(value)
+	case time.Duration:
+		v = float64(value)
+	default:
+		return spoolPoint{}, fmt.Errorf("can't spool value %v of type %T", value, value)
+	}
+	return spoolPoint{metric, ts, v, tags}, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/olegfedoseev/opentsdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSpool(t *testing.T, maxSize, segmentSize int64) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	spool, err := NewSpool(dir, maxSize, segmentSize)
+	assert.NoError(t, err)
+	return spool, dir
+}
+
+func testPoint(i int) spoolPoint {
+	return spoolPoint{"php.requests.rps", int64(1500000000 + i), float64(i), map[string]string{"server": "test"}}
+}
+
+func TestSpoolSettingsValidate(t *testing.T) {
+	s := SpoolSettings{}
+	assert.NoError(t, s.Validate())
+	assert.Equal(t, SpoolSettings{}, s)
+
+	s = SpoolSettings{Dir: "/tmp/spool"}
+	assert.NoError(t, s.Validate())
+	assert.Equal(t, SpoolSettings{Dir: "/tmp/spool", MaxSize: 1024, SegmentSize: 16}, s)
+
+	s = SpoolSettings{Dir: "/tmp/spool", MaxSize: 10, SegmentSize: 20}
+	assert.Error(t, s.Validate())
+}
+
+func TestSpoolOrder(t *testing.T) {
+	spool, dir := testSpool(t, 1<<20, 500)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, spool.Push(testPoint(i)))
+	}
+	assert.Equal(t, int64(100), spool.Len())
+	assert.True(t, len(spool.segments) > 1)
+
+	var popped []spoolPoint
+	for spool.Len() > 0 {
+		points, err := spool.Pop(7)
+		assert.NoError(t, err)
+		popped = append(popped, points...)
+
+		// New points are appended while spool is replayed
+		if len(popped) == 49 {
+			assert.NoError(t, spool.Push(testPoint(100)))
+		}
+	}
+	assert.Len(t, popped, 101)
+	for i, p := range popped {
+		assert.Equal(t, testPoint(i), p)
+	}
+	assert.Len(t, spool.segments, 1)
+
+	points, err := spool.Pop(10)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+}
+
+func TestSpoolEviction(t *testing.T) {
+	spool, dir := testSpool(t, 1000, 200)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, spool.Push(testPoint(i)))
+	}
+	assert.True(t, spool.Size() <= 1000)
+	evicted := spool.Evicted()
+	assert.True(t, evicted > 0)
+	assert.Equal(t, int64(0), spool.Evicted())
+	assert.Equal(t, 100-evicted, spool.Len())
+
+	// The oldest points are evicted, the newest are kept
+	points, err := spool.Pop(1000)
+	assert.NoError(t, err)
+	assert.Len(t, points, int(100-evicted))
+	assert.Equal(t, testPoint(int(evicted)), points[0])
+	assert.Equal(t, testPoint(99), points[len(points)-1])
+}
+
+func TestSpoolReopen(t *testing.T) {
+	spool, dir := testSpool(t, 1<<20, 500)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, spool.Push(testPoint(i)))
+	}
+	assert.NoError(t, spool.Close())
+
+	spool, err := NewSpool(dir, 1<<20, 500)
+	assert.NoError(t, err)
+	defer spool.Close()
+	assert.Equal(t, int64(20), spool.Len())
+
+	assert.NoError(t, spool.Push(testPoint(20)))
+	points, err := spool.Pop(100)
+	assert.NoError(t, err)
+	assert.Len(t, points, 21)
+	for i, p := range points {
+		assert.Equal(t, testPoint(i), p)
+	}
+}
+
+func TestNewSpoolPoint(t *testing.T) {
+	tags := opentsdb.Tags{"type": "php."}
+	for value, expected := range map[interface{}]float64{
+		float32(1.5):     1.5,
+		42:               42,
+		int64(42):        42,
+		time.Millisecond: 1e6,
+	} {
+		point, err := newSpoolPoint("m", 1, value, tags)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, point.Value)
+		assert.Equal(t, map[string]string{"type": "php."}, point.Tags)
+	}
+
+	_, err := newSpoolPoint("m", 1, "42", tags)
+	assert.Error(t, err)
+}
+
+func TestSpoolReopenAfterPop(t *testing.T) {
+	spool, dir := testSpool(t, 1<<20, 1<<10)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, spool.Push(testPoint(i)))
+	}
+	points, err := spool.Pop(5)
+	assert.NoError(t, err)
+	assert.Len(t, points, 5)
+	assert.NoError(t, spool.Close())
+
+	// Popped points are not replayed again
+	spool, err = NewSpool(dir, 1<<20, 1<<10)
+	assert.NoError(t, err)
+	defer spool.Close()
+	assert.Equal(t, int64(15), spool.Len())
+	points, err = spool.Pop(100)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 15) {
+		assert.Equal(t, testPoint(5), points[0])
+	}
+}
+
+func TestWriterSpool(t *testing.T) {
+	spool, dir := testSpool(t, 1<<20, 1<<10)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	// Workers are not started, so nothing is sent from queue
+	backend := NewHTTPBackend("127.0.0.1:4242", 10, time.Second, false)
+	w := &Writer{client: backend, spool: spool}
+
+	// Queue is filled up to high watermark, the rest goes to spool
+	for i := 0; i < 15; i++ {
+		w.push(fmt.Sprintf("m%d", i), 1, i, opentsdb.Tags{})
+	}
+	assert.Len(t, backend.queue, 9)
+	assert.Equal(t, int64(6), spool.Len())
+
+	// Nothing is replayed until queue is drained under low watermark
+	assert.Equal(t, 0, w.replaySpool())
+	for i := 0; i < 9; i++ {
+		assert.Equal(t, fmt.Sprintf("m%d", i), (<-backend.queue).Metric)
+	}
+
+	// While spool is not empty, new points go there to keep order
+	w.push("m15", 1, 15, opentsdb.Tags{})
+	assert.Equal(t, int64(7), spool.Len())
+
+	assert.Equal(t, 5, w.replaySpool())
+	assert.Equal(t, 0, w.replaySpool())
+	for i := 9; i < 14; i++ {
+		assert.Equal(t, fmt.Sprintf("m%d", i), (<-backend.queue).Metric)
+	}
+	assert.Equal(t, 2, w.replaySpool())
+	assert.Equal(t, "m14", (<-backend.queue).Metric)
+	assert.Equal(t, "m15", (<-backend.queue).Metric)
+	assert.Equal(t, int64(0), spool.Len())
+}
+
+func TestWriterSpoolFailed(t *testing.T) {
+	spool, dir := testSpool(t, 1<<20, 1<<10)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "hbase is down", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	backend := NewHTTPBackend(server.URL, 100, time.Second, false)
+	w := &Writer{client: backend, spool: spool}
+	backend.SetFallback(w.spoolFailed)
+	for i := 0; i < 5; i++ {
+		w.push(fmt.Sprintf("m%d", i), 1, i, opentsdb.Tags{"server": "test"})
+	}
+	backend.StartWorkers(1, 10, 10*time.Millisecond)
+	<-backend.Errors()
+
+	// Failed batch is not lost, it waits in spool for OpenTSDB to recover
+	deadline := time.Now().Add(5 * time.Second)
+	for spool.Len() < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(5), spool.Len())
+	_, dropped := backend.Stats()
+	assert.Equal(t, int64(0), dropped)
+
+	points, err := spool.Pop(5)
+	assert.NoError(t, err)
+	assert.Equal(t, "m0", points[0].Metric)
+	assert.Equal(t, map[string]string{"server": "test"}, points[0].Tags)
+}
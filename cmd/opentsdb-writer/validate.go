@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/olegfedoseev/pinba"
+)
+
+// runValidate is "opentsdb-writer validate" command. It loads config, checks
+// it and prints metrics from it and series they would produce for sample
+// request. Returns exit code
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	var (
+		configFile = flags.String("config", "config.yml", "config name, default - config.yml")
+		hostname   = flags.String("hostname", "web1", "hostname of sample request")
+		serverName = flags.String("server-name", "test.ru", "server name of sample request")
+		script     = flags.String("script", "/index.php", "script name of sample request")
+		status     = flags.Int("status", 200, "HTTP status of sample request")
+		tags       = flags.String("tags", "server=test.ru,script=/index.php", "tags of sample request, k=v,...")
+		timerTags  = flags.String("timer-tags", "server=test.ru,group=db,operation=select", "tags of sample timer, k=v,...")
+	)
+	flags.Parse(args)
+
+	config, err := getConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config from %v: %v\n", *configFile, err)
+		return 1
+	}
+
+	request := &pinba.Request{
+		Hostname:    *hostname,
+		ServerName:  *serverName,
+		ScriptName:  *script,
+		Status:      uint32(*status),
+		RequestTime: 0.1,
+		Tags:        parseTags(*tags),
+		Timers: []pinba.Timer{
+			{HitCount: 1, Value: 0.05, Tags: parseTags(*timerTags)},
+		},
+	}
+	if err := validate(os.Stdout, config, request); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config %v: %v\n", *configFile, err)
+		return 1
+	}
+	return 0
+}
+
+// validate compiles metrics settings from config and prints them, along with
+// series, that they produce for given request
+func validate(out io.Writer, config *writerConfig, request *pinba.Request) error {
+	w := &Writer{shards: []*Metrics{NewMetrics(0)}}
+	if err := w.configure(config); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Config is valid: %d request, %d timer and %d breakdown metrics, prefix %q, interval %d\n",
+		len(w.requestsSettings), len(w.timersSettings), len(w.breakdownSettings), w.prefix, config.Interval)
+
+	samples, skipped := w.match([]*pinba.Request{request})
+	for tag := range skipped {
+		fmt.Fprintf(out, "\nSample request is skipped: no valid %q tag\n", tag)
+	}
+
+	fmt.Fprintf(out, "\nSample request: hostname=%v server=%v script=%v status=%v tags:%v\n",
+		request.Hostname, request.ServerName, request.ScriptName, request.Status, request.Tags.String())
+	for _, timer := range request.Timers {
+		fmt.Fprintf(out, "Sample timer: tags:%v\n", timer.Tags.String())
+	}
+
+	for _, settings := range [][]MetricsSettings{w.requestsSettings, w.timersSettings, w.breakdownSettings} {
+		for i := range settings {
+			config := &settings[i]
+			fmt.Fprintf(out, "\n%s %q\n", config.Type, config.Name)
+			fmt.Fprintf(out, "  tags: %v, required: %v, value: %v, estimator: %v\n",
+				config.Tags, config.ReqiredTags, config.Value, config.Estimator.Name())
+
+			series := 0
+			for _, s := range samples[0] {
+				if s.settings != config {
+					continue
+				}
+				series++
+				fmt.Fprintf(out, "  %v{%v}%v\n", s.name, strings.Join(suffixes(s.name, config), ","), s.tags.String())
+			}
+			if series == 0 {
+				fmt.Fprintf(out, "  no series for sample request\n")
+			}
+		}
+	}
+	return nil
+}
+
+// suffixes returns suffixes of names of data points sent for series
+func suffixes(name string, settings *MetricsSettings) []string {
+	result := []string{".rps", ".p25", ".p50", ".p75", ".p95", ".max"}
+	if strings.HasSuffix(name, ".cpu") {
+		result = []string{""}
+	}
+	if settings.buckets != nil {
+		result = append(result, ".hist")
+	}
+	if settings.StatusCodes && !strings.HasSuffix(name, ".cpu") {
+		result = append(result, ".status", ".errors", ".error_rate")
+	}
+	if settings.slo != nil && !strings.HasSuffix(name, ".cpu") {
+		result = append(result, ".apdex", ".good", ".bad")
+		if settings.slo.Objective > 0 {
+			result = append(result, ".burn_rate")
+		}
+	}
+	return result
+}
+
+// parseTags parses tags in "key=value,key=value" format
+func parseTags(s string) pinba.Tags {
+	tags := make(pinba.Tags, 0)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		tags = append(tags, pinba.Tag{Key: kv[0], Value: kv[1]})
+	}
+	return tags
+}
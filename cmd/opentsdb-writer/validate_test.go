@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	config := &writerConfig{
+		Prefix: "php.",
+		Metrics: []MetricsSettings{
+			{Name: "requests", Tags: []string{"server"}, Type: "request", CPUTime: true},
+			{Name: "requests.{server}", Tags: []string{"script"}, Type: "request", StatusCodes: true},
+			{Name: "requests.api", Tags: []string{"script"}, Type: "request",
+				Match: MatchSettings{Script: "^/api/"}},
+			{Name: "requests.slo", Tags: []string{"server"}, Type: "request", CPUTime: true,
+				SLO: SLOSettings{Threshold: 0.5, Objective: 0.99}},
+			{Name: "timers.{group}", Tags: []string{"operation"}, Type: "timer", ReqiredTags: []string{"group"}},
+			{Name: "breakdown", Tags: []string{"server"}, Type: "breakdown", GroupBy: []string{"group"}},
+		},
+	}
+	assert.NoError(t, config.Validate())
+
+	request := &pinba.Request{
+		ScriptName: "/index.php",
+		Tags:       parseTags("server=test.ru,script=/index.php"),
+		Timers: []pinba.Timer{
+			{HitCount: 1, Tags: parseTags("group=db,operation=select")},
+		},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, validate(&out, config, request))
+	assert.Contains(t, out.String(), "Config is valid: 4 request, 1 timer and 1 breakdown metrics")
+	assert.Contains(t, out.String(), "php.requests{.rps,.p25,.p50,.p75,.p95,.max}")
+	assert.Contains(t, out.String(), "php.requests.cpu{}")
+	assert.Contains(t, out.String(), "php.requests.test.ru{.rps,.p25,.p50,.p75,.p95,.max,.status,.errors,.error_rate}")
+	assert.Contains(t, out.String(), "php.requests.slo{.rps,.p25,.p50,.p75,.p95,.max,.apdex,.good,.bad,.burn_rate}")
+	assert.Contains(t, out.String(), "php.requests.slo.cpu{}")
+	assert.Contains(t, out.String(), "php.timers.db{")
+	assert.Contains(t, out.String(), "no series for sample request")
+
+	config.Metrics[0].Value = "unknown"
+	assert.Error(t, validate(&out, config, request))
+}
+
+func TestParseTags(t *testing.T) {
+	assert.Equal(t, pinba.Tags{{"server", "test.ru"}, {"script", "/a=b"}}, parseTags("server=test.ru,script=/a=b"))
+	assert.Equal(t, pinba.Tags{}, parseTags(""))
+	assert.Equal(t, pinba.Tags{{"server", ""}}, parseTags("server=,=x,broken"))
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/olegfedoseev/pinba"
+)
+
+// requestValues are fields of request, that can be used as value of metric
+var requestValues = map[string]func(r *pinba.Request) float32{
+	"request_time":  func(r *pinba.Request) float32 { return r.RequestTime },
+	"cpu":           func(r *pinba.Request) float32 { return r.RuUtime + r.RuStime },
+	"memory_peak":   func(r *pinba.Request) float32 { return float32(r.MemoryPeak) },
+	"document_size": func(r *pinba.Request) float32 { return float32(r.DocumentSize) },
+	"request_count": func(r *pinba.Request) float32 { return float32(r.RequestCount) },
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestValues(t *testing.T) {
+	request := &pinba.Request{
+		RequestTime:  0.25,
+		RuUtime:      0.1,
+		RuStime:      0.05,
+		MemoryPeak:   2097152,
+		DocumentSize: 1024,
+		RequestCount: 3,
+	}
+	assert.EqualValues(t, 0.25, requestValues["request_time"](request))
+	assert.InDelta(t, 0.15, requestValues["cpu"](request), 1e-6)
+	assert.EqualValues(t, 2097152, requestValues["memory_peak"](request))
+	assert.EqualValues(t, 1024, requestValues["document_size"](request))
+	assert.EqualValues(t, 3, requestValues["request_count"](request))
+}
+
+func TestMetricsStatusCodes(t *testing.T) {
+	settings := &MetricsSettings{
+		newEstimator: func() Estimator { return NewExact() },
+		StatusCodes:  true,
+	}
+	tags := pinba.Tags{{"server", "test.ru"}}
+
+	metrics := NewMetrics(10)
+	for _, status := range []int{200, 200, 301, 404, 500, 503, 0} {
+		metrics.add(sample{"requests", "requests", "requests", tags, 1, 0.1, status, settings})
+	}
+	m := metrics.Data["requests"]
+	assert.Equal(t, []int64{0, 2, 1, 1, 2}, m.Statuses)
+	assert.EqualValues(t, 7, m.Count)
+
+	// No statuses for metrics without them
+	metrics.add(sample{"requests.cpu", "requests.cpu", "requests.cpu", tags, 1, 0.1, 0, settings})
+	assert.Nil(t, metrics.Data["requests.cpu"].Statuses)
+}
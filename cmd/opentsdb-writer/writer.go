@@ -4,155 +4,808 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/olegfedoseev/opentsdb"
+	"github.com/olegfedoseev/pinba"
 	"github.com/olegfedoseev/pinba-server/client"
 )
 
 type Writer struct {
-	config        *writerConfig
-	metricsBuffer *Metrics
-	prefix        string
-	client        *opentsdb.Client
+	// numbers of intervals, that waited for free sender, and of sends, that
+	// took longer than interval. They are first for 64-bit alignment
+	stalls int64
+	late   int64
 
-	timersSettings   []MetricsSettings
-	requestsSettings []MetricsSettings
+	// Reload receives new config, it's applied between intervals
+	Reload chan *writerConfig
+
+	config *writerConfig
+	prefix string
+	// statsTag is opentsdb.Tags of self-metrics, it's changed by reload
+	statsTag atomic.Value
+	client   Backend
+	// spool for data points, that client can't take or failed to send, nil
+	// if it's disabled. Whether data point goes to spool or client is
+	// decided under spoolMu, so they are sent in order
+	spool   *Spool
+	spoolMu sync.Mutex
+
+	// shards of metrics buffer, one per aggregating goroutine
+	shards     []*Metrics
+	shardsRing *Ring
+	// ring of writer processes and index of this one, nil if we are alone
+	ring  *Ring
+	shard int
+	// tiers of coarser series
+	rollups []*Rollup
+	// history of good and bad values of series with SLO objective
+	burnRates *BurnRates
+	// alert rules with their state and where to send events, notifier is
+	// nil if alerts are only logged
+	alerts   *Alerts
+	notifier *Notifier
+	// the slowest requests of every interval, nil if it's disabled
+	slowLog *SlowLog
+	// slots of senders of snapshots, snapshots being sent and interval of
+	// aggregation
+	senders  chan struct{}
+	inFlight sync.WaitGroup
+	interval time.Duration
+	// how many metrics and tags with most series to report
+	cardinalityTop int
+	// requests without any of this tags are skipped
+	mandatoryTags []MandatoryTag
+	// cleans metric names and tag values, nil if it's off
+	sanitizer *Sanitizer
+
+	timersSettings    []MetricsSettings
+	requestsSettings  []MetricsSettings
+	breakdownSettings []MetricsSettings
 }
 
 func NewWriter(config *writerConfig) (*Writer, error) {
+	client, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.Shard.Validate(); err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		config:   config,
+		client:   client,
+		shard:    config.Shard.Index,
+		interval: time.Duration(config.Interval) * time.Second,
+		Reload:   make(chan *writerConfig),
+	}
+	w.startSenders(config.MaxInFlight)
+
+	w.shards = make([]*Metrics, config.Shard.Aggregators)
+	for i := range w.shards {
+		w.shards[i] = NewMetrics(config.BufferSize / config.Shard.Aggregators)
+	}
+	if config.Shard.Aggregators > 1 {
+		w.shardsRing = NewRing(config.Shard.Aggregators)
+	}
+	if config.Shard.Total > 1 {
+		w.ring = NewRing(config.Shard.Total)
+	}
+	for _, settings := range config.Rollups {
+		w.rollups = append(w.rollups, NewRollup(settings))
+	}
+	w.burnRates = NewBurnRates(config.Interval)
+	w.alerts = NewAlerts(config.Interval)
+	w.notifier = NewNotifier(config.Alerts.Webhook, config.Alerts.File,
+		time.Duration(config.TSDB.Timeout)*time.Millisecond)
+
+	if err := w.configure(config); err != nil {
+		return nil, err
+	}
+
+	if w.slowLog, err = NewSlowLog(config.SlowLog); err != nil {
+		return nil, err
+	}
+	if err := w.slowLog.Listen(); err != nil {
+		return nil, err
+	}
+
+	if config.Spool.Dir != "" {
+		w.spool, err = NewSpool(config.Spool.Dir, config.Spool.MaxSize<<20, config.Spool.SegmentSize<<20)
+		if err != nil {
+			return nil, err
+		}
+		if n := w.spool.Len(); n > 0 {
+			log.Printf("[INFO] %v data points left in spool, replaying them", n)
+		}
+		w.client.SetFallback(w.spoolFailed)
+		go w.replay(100 * time.Millisecond)
+	}
+
+	return w, nil
+}
+
+// newBackend creates OpenTSDB backend by protocol from config
+func newBackend(config *writerConfig) (Backend, error) {
+	timeout := time.Duration(config.TSDB.Timeout*1000) * time.Microsecond
+	if config.TSDB.Protocol == "http" {
+		backend := NewHTTPBackend(config.TSDB.Host, config.BufferSize, timeout, config.TSDB.Gzip)
+		backend.StartWorkers(config.Workers, config.BatchSize, 100*time.Millisecond)
+		return backend, nil
+	}
+
 	_, err := net.ResolveTCPAddr("tcp4", config.TSDB.Host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve %q: %v", config.TSDB.Host, err)
 	}
-
-	client, err := opentsdb.NewClient(
-		config.TSDB.Host,
-		config.BufferSize,
-		time.Duration(config.TSDB.Timeout*1000)*time.Microsecond,
-	)
+	backend, err := NewTelnetBackend(config.TSDB.Host, config.BufferSize, timeout, config.Workers, config.BatchSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create OpenTSDB client: %v", err)
 	}
-	client.StartWorkers(config.Workers, config.BatchSize, 100*time.Millisecond)
+	return backend, nil
+}
 
-	w := &Writer{
-		prefix:           config.Prefix,
-		metricsBuffer:    NewMetrics(config.BufferSize),
-		client:           client,
-		timersSettings:   make([]MetricsSettings, 0),
-		requestsSettings: make([]MetricsSettings, 0),
+// configure validates metrics settings from config and applies them. Nothing
+// is changed if config is invalid, so it's safe to reload config with it
+func (w *Writer) configure(config *writerConfig) error {
+	var err error
+
+	mandatoryTags := config.MandatoryTags
+	if mandatoryTags == nil {
+		mandatoryTags = defaultMandatoryTags
+	}
+	for _, tag := range mandatoryTags {
+		if err := tag.Validate(); err != nil {
+			return err
+		}
 	}
 
+	sanitizer, err := config.Sanitize.Compile()
+	if err != nil {
+		return err
+	}
+
+	alertRules := make([]*AlertRule, 0, len(config.Alerts.Rules))
+	alertNames := make(map[string]bool, len(config.Alerts.Rules))
+	for _, settings := range config.Alerts.Rules {
+		rule, err := settings.Compile()
+		if err != nil {
+			return err
+		}
+		if alertNames[rule.Name] {
+			return fmt.Errorf("duplicate alert rule %q", rule.Name)
+		}
+		alertNames[rule.Name] = true
+		alertRules = append(alertRules, rule)
+	}
+
+	cardinalityTop := config.Cardinality.Top
+	if cardinalityTop == 0 {
+		cardinalityTop = 10
+	}
+
+	// Series are spread evenly between shards, so are limits
+	n := len(w.shards)
+	timersSettings := make([]MetricsSettings, 0)
+	requestsSettings := make([]MetricsSettings, 0)
+	breakdownSettings := make([]MetricsSettings, 0)
 	for _, metric := range config.Metrics {
+		if metric.Estimator.Type == "" {
+			metric.Estimator = config.Estimator
+		}
+		metric.newEstimator, err = metric.Estimator.Factory()
+		if err != nil {
+			return fmt.Errorf("invalid estimator for metric %q: %v", metric.Name, err)
+		}
+		if !metric.Match.IsEmpty() {
+			metric.matcher, err = metric.Match.Compile()
+			if err != nil {
+				return fmt.Errorf("invalid match for metric %q: %v", metric.Name, err)
+			}
+		}
+		metric.seriesLimit = perShard(metric.MaxSeries, n)
+		metric.keepTags = append([]string(nil), metric.ReqiredTags...)
+		for _, tag := range mandatoryTags {
+			metric.keepTags = append(metric.keepTags, tag.Tag)
+		}
+		metric.otherName = sanitizer.Name(config.Prefix + foldName(metric.Name))
+		if !metric.SLO.IsEmpty() {
+			slo := metric.SLO
+			if err := slo.Validate(config.Interval); err != nil {
+				return fmt.Errorf("invalid slo for metric %q: %v", metric.Name, err)
+			}
+			metric.slo = &slo
+		}
+		if !metric.Histogram.IsEmpty() {
+			metric.buckets, err = metric.Histogram.Bounds()
+			if err != nil {
+				return fmt.Errorf("invalid histogram for metric %q: %v", metric.Name, err)
+			}
+		}
+
 		if metric.Type == "request" {
-			w.requestsSettings = append(w.requestsSettings, metric)
+			if metric.Value == "" {
+				metric.Value = "request_time"
+			}
+			if metric.requestValue = requestValues[metric.Value]; metric.requestValue == nil {
+				return fmt.Errorf("invalid value %q for request metric %q", metric.Value, metric.Name)
+			}
+			requestsSettings = append(requestsSettings, metric)
 		}
 		if metric.Type == "timer" {
-			w.timersSettings = append(w.timersSettings, metric)
+			if metric.Value == "" {
+				metric.Value = "value"
+			}
+			if metric.Value != "value" && metric.Value != "cpu" {
+				return fmt.Errorf("invalid value %q for timer metric %q", metric.Value, metric.Name)
+			}
+			if metric.StatusCodes {
+				return fmt.Errorf("timer metric %q can't have status codes", metric.Name)
+			}
+			timersSettings = append(timersSettings, metric)
+		}
+		if metric.Type == "breakdown" {
+			if metric.Value == "" {
+				metric.Value = "value"
+			}
+			if metric.Value != "value" && metric.Value != "cpu" {
+				return fmt.Errorf("invalid value %q for breakdown metric %q", metric.Value, metric.Name)
+			}
+			if metric.StatusCodes {
+				return fmt.Errorf("breakdown metric %q can't have status codes", metric.Name)
+			}
+			breakdownSettings = append(breakdownSettings, metric)
 		}
 	}
 
-	return w, nil
+	w.prefix = config.Prefix
+	w.statsTag.Store(w.statsTags())
+	w.mandatoryTags = mandatoryTags
+	w.sanitizer = sanitizer
+	if w.alerts != nil {
+		w.alerts.SetRules(alertRules)
+	}
+	w.cardinalityTop = cardinalityTop
+	w.requestsSettings = requestsSettings
+	w.timersSettings = timersSettings
+	w.breakdownSettings = breakdownSettings
+	for _, shard := range w.shards {
+		shard.Limit = perShard(config.Cardinality.MaxSeries, n)
+	}
+	return nil
+}
+
+// reload applies metrics settings from new config, or keeps old ones if it's
+// invalid. Settings that can't be changed without restart are reported and
+// running ones are kept, so they are reported by every reload until restart
+func (w *Writer) reload(config *writerConfig) {
+	ignored := restartRequired(w.config, config)
+	keepRunning(w.config, config)
+	if err := w.configure(config); err != nil {
+		log.Printf("[ERROR] Failed to reload config, keeping old one: %v", err)
+		return
+	}
+
+	for _, name := range ignored {
+		log.Printf("[WARN] Changes of %q in config require restart, ignored", name)
+	}
+	w.config = config
+	log.Printf("[INFO] Config reloaded: %d request, %d timer and %d breakdown metrics",
+		len(w.requestsSettings), len(w.timersSettings), len(w.breakdownSettings))
+}
+
+// restartRequired returns names of settings, that can't be reloaded and
+// differ in given configs
+func restartRequired(old, new *writerConfig) (names []string) {
+	if old.Interval != new.Interval {
+		names = append(names, "interval")
+	}
+	if old.Workers != new.Workers {
+		names = append(names, "workers")
+	}
+	if old.BatchSize != new.BatchSize {
+		names = append(names, "batch_size")
+	}
+	if old.BufferSize != new.BufferSize {
+		names = append(names, "buffer_size")
+	}
+	if old.TSDB != new.TSDB {
+		names = append(names, "tsdb")
+	}
+	if old.Shard != new.Shard {
+		names = append(names, "shard")
+	}
+	if old.MaxInFlight != new.MaxInFlight {
+		names = append(names, "max_in_flight")
+	}
+	if old.Spool != new.Spool {
+		names = append(names, "spool")
+	}
+	if !reflect.DeepEqual(old.Rollups, new.Rollups) {
+		names = append(names, "rollups")
+	}
+	if !reflect.DeepEqual(old.SlowLog, new.SlowLog) {
+		names = append(names, "slow_log")
+	}
+	if old.Alerts.Webhook != new.Alerts.Webhook || old.Alerts.File != new.Alerts.File {
+		names = append(names, "alerts")
+	}
+	return
+}
+
+// keepRunning copies settings, that can't be reloaded, from running config
+// to new one
+func keepRunning(running, config *writerConfig) {
+	config.Interval = running.Interval
+	config.Workers = running.Workers
+	config.BatchSize = running.BatchSize
+	config.BufferSize = running.BufferSize
+	config.TSDB = running.TSDB
+	config.Shard = running.Shard
+	config.MaxInFlight = running.MaxInFlight
+	config.Spool = running.Spool
+	config.Rollups = running.Rollups
+	config.SlowLog = running.SlowLog
+	config.Alerts.Webhook = running.Alerts.Webhook
+	config.Alerts.File = running.Alerts.File
 }
 
 func (w *Writer) Start(requestsChan chan *client.PinbaRequests) {
-	statsTag := opentsdb.Tags{"type": w.prefix}
+	go w.watchBackend()
 
 	for {
 		select {
-		case timer := <-w.client.Clock:
-			log.Printf("[INFO][%d] POSTed to OpenTSDB in %v", timer.Timestamp, timer.Stop.Sub(timer.Start))
-			w.client.Push(&opentsdb.DataPoint{
-				"pinba.aggregator.time",
-				timer.Timestamp,
-				timer.Stop.Sub(timer.Start),
-				statsTag,
-			})
-
-		case err := <-w.client.Errors:
-			log.Printf("[ERROR] OpenTSDB Client error: %v", err)
+		case config := <-w.Reload:
+			w.reload(config)
 
 		case requests := <-requestsChan:
-			t := time.Now()
-			for _, request := range requests.Requests {
-				// server tag is mandatory
-				server, _ := request.Tags.Get("server")
-				if server == "" || server == "unknown" {
-					continue // no server tag :(
+			w.process(requests)
+		}
+	}
+}
+
+// statsTags returns tags of metrics about writer itself. With several writer
+// processes every one has its own series, otherwise they overwrite each other
+func (w *Writer) statsTags() opentsdb.Tags {
+	tags := opentsdb.Tags{"type": w.prefix}
+	if w.ring != nil {
+		tags.Set("shard", strconv.Itoa(w.shard))
+	}
+	return tags
+}
+
+// withTag returns copy of tags with another one
+func withTag(tags opentsdb.Tags, key, value string) opentsdb.Tags {
+	result := make(opentsdb.Tags, len(tags)+1)
+	for k, v := range tags {
+		result[k] = v
+	}
+	result.Set(key, value)
+	return result
+}
+
+// process aggregates requests of one interval and queues snapshot of it
+// for sending, along with closed windows of rollup tiers
+func (w *Writer) process(requests *client.PinbaRequests) {
+	statsTag := w.statsTag.Load().(opentsdb.Tags)
+	t := time.Now()
+	skipped := w.aggregate(requests.Requests)
+	w.sendSkipped(requests.Timestamp, skipped, statsTag)
+	w.sendSanitized(requests.Timestamp, statsTag)
+	if w.slowLog != nil {
+		w.push("pinba.aggregator.slow_log", requests.Timestamp,
+			w.slowLog.Log(requests.Timestamp, requests.Requests), statsTag)
+	}
+
+	queued, _ := w.client.Queue()
+	sent, dropped := w.client.Stats()
+	log.Printf("[DEBUG] Queue: %v, Sent: %v, Dropped: %v", queued, sent, dropped)
+	w.sendRejected(requests.Timestamp, statsTag)
+	w.sendSpool(requests.Timestamp, dropped, statsTag)
+	w.sendPipeline(requests.Timestamp, statsTag)
+
+	w.sendCardinality(requests.Timestamp, statsTag)
+	w.flushRollups(requests.Timestamp)
+	s := &snapshot{requests: requests, data: make([]map[string]*Metric, len(w.shards))}
+	for i, shard := range w.shards {
+		s.data[i] = shard.Swap()
+	}
+	w.addRollups(requests.Timestamp, requests.Span, s.data)
+	w.sendBurnRates(requests.Timestamp, s.data)
+	w.checkAlerts(requests.Timestamp, requests.Span, s.data)
+	w.enqueue(s)
+
+	d := time.Since(t)
+	log.Printf("[INFO][%d] Get %v metrics, appended in %v",
+		requests.Timestamp, len(requests.Requests), d-d%time.Millisecond)
+
+	w.push(
+		"pinba.aggregator.metrics",
+		requests.Timestamp,
+		len(requests.Requests),
+		statsTag,
+	)
+}
+
+// Client queue fill levels: over spoolHighWatermark new data points go to
+// spool, and they are replayed while queue is under spoolLowWatermark
+const (
+	spoolHighWatermark = 0.9
+	spoolLowWatermark  = 0.5
+)
+
+// push sends data point to OpenTSDB client, or to spool if client queue is
+// almost full. While spool is not empty new data points go there too, so
+// they are sent in order. It's called by aggregator and senders at once
+func (w *Writer) push(metric string, ts int64, value interface{}, tags opentsdb.Tags) {
+	if w.spool != nil {
+		w.spoolMu.Lock()
+		defer w.spoolMu.Unlock()
+		queued, size := w.client.Queue()
+		full := float64(queued) >= spoolHighWatermark*float64(size)
+		if full || w.spool.Len() > 0 {
+			point, err := newSpoolPoint(metric, ts, value, tags)
+			if err == nil {
+				err = w.spool.Push(point)
+			}
+			if err == nil {
+				return
+			}
+			log.Printf("[ERROR] Failed to spool data point: %v", err)
+		}
+	}
+	w.client.Push(&opentsdb.DataPoint{metric, ts, value, tags})
+}
+
+// spoolFailed appends data points, that client failed to send, to spool, so
+// they are replayed when OpenTSDB recovers
+func (w *Writer) spoolFailed(points []*opentsdb.DataPoint) error {
+	w.spoolMu.Lock()
+	defer w.spoolMu.Unlock()
+	for _, p := range points {
+		point, err := newSpoolPoint(p.Metric, p.Timestamp, p.Value, p.Tags)
+		if err == nil {
+			err = w.spool.Push(point)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to spool data point: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// replay moves data points from spool to client, while there is room in its
+// queue, checking it with given interval
+func (w *Writer) replay(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.replaySpool()
+	}
+}
+
+// replaySpool moves the oldest data points from spool to client until its
+// queue is filled to low watermark, returns number of moved points
+func (w *Writer) replaySpool() int {
+	w.spoolMu.Lock()
+	defer w.spoolMu.Unlock()
+	queued, size := w.client.Queue()
+	room := int(spoolLowWatermark*float64(size)) - queued
+	if room <= 0 || w.spool.Len() == 0 {
+		return 0
+	}
+	points, err := w.spool.Pop(room)
+	if err != nil {
+		log.Printf("[ERROR] Failed to read spool: %v", err)
+	}
+	for _, p := range points {
+		w.client.Push(&opentsdb.DataPoint{p.Metric, p.Timestamp, p.Value, opentsdb.Tags(p.Tags)})
+	}
+	return len(points)
+}
+
+// sendRejected sends number of data points rejected by OpenTSDB by reason
+func (w *Writer) sendRejected(ts int64, statsTag opentsdb.Tags) {
+	for reason, count := range w.client.Rejected() {
+		log.Printf("[WARN][%d] %v data points rejected by OpenTSDB: %v", ts, count, reason)
+		w.push("pinba.aggregator.rejected", ts, count,
+			withTag(statsTag, "reason", reason))
+	}
+}
+
+// sendSpool sends size of spool in bytes and data points, and number of
+// data points evicted from it and dropped by client
+func (w *Writer) sendSpool(ts int64, dropped int64, statsTag opentsdb.Tags) {
+	w.push("pinba.aggregator.dropped", ts, dropped, statsTag)
+	if w.spool == nil {
+		return
+	}
+	evicted := w.spool.Evicted()
+	if evicted > 0 {
+		log.Printf("[WARN][%d] Spool is full, %v oldest data points evicted", ts, evicted)
+	}
+	w.push("pinba.aggregator.spool.size", ts, w.spool.Size(), statsTag)
+	w.push("pinba.aggregator.spool.points", ts, w.spool.Len(), statsTag)
+	w.push("pinba.aggregator.spool.evicted", ts, evicted, statsTag)
+}
+
+// sendSkipped sends number of requests skipped by missing mandatory tag
+func (w *Writer) sendSkipped(ts int64, skipped map[string]int64, statsTag opentsdb.Tags) {
+	for _, tag := range w.mandatoryTags {
+		if skipped[tag.Tag] > 0 {
+			log.Printf("[WARN][%d] %v requests skipped without %q tag", ts, skipped[tag.Tag], tag.Tag)
+		}
+		w.push("pinba.aggregator.skipped", ts, skipped[tag.Tag],
+			withTag(statsTag, "tag", tag.Tag))
+	}
+}
+
+// sendSanitized sends how many names and tag values were changed by every
+// rule of sanitizer
+func (w *Writer) sendSanitized(ts int64, statsTag opentsdb.Tags) {
+	for rule, count := range w.sanitizer.Counts() {
+		w.push("pinba.aggregator.sanitized", ts, count,
+			withTag(statsTag, "rule", rule))
+	}
+}
+
+// sendCardinality sends total number of series, number of values folded
+// into "__other__" series and metrics and tags with the most series
+func (w *Writer) sendCardinality(ts int64, statsTag opentsdb.Tags) {
+	var series int
+	var overflow int64
+	for _, shard := range w.shards {
+		series += len(shard.Data)
+		overflow += shard.Overflow
+	}
+	if overflow > 0 {
+		log.Printf("[WARN][%d] Too many series, %v values folded into %q series", ts, overflow, OtherTagValue)
+	}
+	w.push("pinba.aggregator.series", ts, series, statsTag)
+	w.push("pinba.aggregator.overflow", ts, overflow, statsTag)
+
+	names, tags := topCardinality(w.shards, w.cardinalityTop)
+	for _, c := range names {
+		w.push("pinba.aggregator.cardinality.metric", ts, c.Count,
+			withTag(statsTag, "metric", c.Key))
+	}
+	for _, c := range tags {
+		w.push("pinba.aggregator.cardinality.tag", ts, c.Count,
+			withTag(statsTag, "tag", c.Key))
+	}
+}
+
+// sendBurnRates counts good and bad values of series with SLO objective and
+// sends their burn rates as "<name>.burn_rate" with size of window in
+// "window" tag
+func (w *Writer) sendBurnRates(ts int64, data []map[string]*Metric) {
+	if w.burnRates == nil {
+		return
+	}
+	for _, series := range data {
+		w.burnRates.Add(ts, series)
+	}
+	w.burnRates.Expire(ts)
+	w.burnRates.Each(ts, func(name string, tags opentsdb.Tags, window string, rate float64) {
+		w.push(name+".burn_rate", ts, rate, withTag(tags, "window", window))
+	})
+}
+
+// checkAlerts checks alert rules against series of interval, before they
+// are handed to sender, and passes fired and resolved alerts to notifier
+func (w *Writer) checkAlerts(ts, span int64, data []map[string]*Metric) {
+	if w.alerts == nil || len(w.alerts.rules) == 0 {
+		return
+	}
+	for _, series := range data {
+		w.notifier.Notify(w.alerts.Check(ts, span, series))
+	}
+}
+
+// flushRollups sends series of tiers, which windows are closed by given
+// timestamp, with timestamp of window start
+func (w *Writer) flushRollups(ts int64) {
+	for _, rollup := range w.rollups {
+		start, span, data := rollup.Flush(ts)
+		if data == nil {
+			continue
+		}
+		log.Printf("[INFO][%d] Rollup %ds window %d closed with %v series, covers %ds",
+			ts, rollup.Interval, start, len(data), span)
+		w.enqueue(&snapshot{
+			requests: &client.PinbaRequests{Timestamp: start, Span: span},
+			data:     []map[string]*Metric{data},
+		})
+	}
+}
+
+// addRollups merges series of one interval from every shard into every tier
+func (w *Writer) addRollups(ts, span int64, data []map[string]*Metric) {
+	for _, rollup := range w.rollups {
+		if err := rollup.Add(ts, span, data...); err != nil {
+			log.Printf("[WARN][%d] Rollup %ds: %v", ts, rollup.Interval, err)
+		}
+	}
+}
+
+// perShard returns part of limit for one of n shards, zero is unlimited
+func perShard(limit, n int) int {
+	if limit <= 0 {
+		return 0
+	}
+	return (limit + n - 1) / n
+}
+
+// aggregate matches requests against metrics settings and adds values to
+// shards of metrics buffer. Requests are matched in parallel by chunks, and
+// then every shard adds its own samples from all chunks in parallel too.
+// Returns number of skipped requests by missing mandatory tag
+func (w *Writer) aggregate(requests []*pinba.Request) map[string]int64 {
+	var wg sync.WaitGroup
+	n := len(w.shards)
+
+	// samples[chunk][shard]
+	samples := make([][][]sample, n)
+	skipped := make([]map[string]int64, n)
+	size := (len(requests) + n - 1) / n
+	for i := 0; i < n; i++ {
+		from, to := i*size, (i+1)*size
+		if from > len(requests) {
+			from = len(requests)
+		}
+		if to > len(requests) {
+			to = len(requests)
+		}
+
+		wg.Add(1)
+		go func(i int, chunk []*pinba.Request) {
+			defer wg.Done()
+			samples[i], skipped[i] = w.match(chunk)
+		}(i, requests[from:to])
+	}
+	wg.Wait()
+
+	for i, shard := range w.shards {
+		wg.Add(1)
+		go func(i int, shard *Metrics) {
+			defer wg.Done()
+			for _, chunk := range samples {
+				for _, s := range chunk[i] {
+					shard.add(s)
 				}
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+
+	total := make(map[string]int64)
+	for _, chunk := range skipped {
+		for tag, count := range chunk {
+			total[tag] += count
+		}
+	}
+	return total
+}
+
+// match returns samples for series of given requests, grouped by shard of
+// metrics buffer, and number of requests skipped by missing mandatory tag.
+// Series owned by other writer processes are skipped
+func (w *Writer) match(requests []*pinba.Request) ([][]sample, map[string]int64) {
+	samples := make([][]sample, len(w.shards))
+	skipped := make(map[string]int64)
+	add := func(tags pinba.Tags, name, rule string, count int64, value float32, status int, settings *MetricsSettings) {
+		if tags = w.sanitizer.Tags(tags); len(tags) == 0 {
+			return // OpenTSDB needs at least one tag
+		}
+		name = w.sanitizer.Name(name)
+		id := name + tags.String()
+		if w.ring != nil && w.ring.Get(id) != w.shard {
+			return
+		}
+		shard := 0
+		if w.shardsRing != nil {
+			shard = w.shardsRing.Get(id)
+		}
+		samples[shard] = append(samples[shard], sample{id, name, rule, tags, count, value, status, settings})
+	}
 
-				for _, config := range w.requestsSettings {
-					// We can't have metrics without tags
-					tags := request.Tags.Filter(config.Tags)
-					if len(tags) == 0 {
-						continue
-					}
+requests:
+	for _, request := range requests {
+		for _, tag := range w.mandatoryTags {
+			var ok bool
+			if request, ok = tag.Apply(request); !ok {
+				skipped[tag.Tag]++
+				continue requests
+			}
+		}
 
-					if len(config.ReqiredTags) > 0 &&
-						len(request.Tags.Filter(config.ReqiredTags)) != len(config.ReqiredTags) {
-						continue
-					}
+		for i := range w.requestsSettings {
+			config := &w.requestsSettings[i]
+			if config.matcher != nil && !config.matcher.MatchRequest(request) {
+				continue
+			}
 
-					name := w.prefix + request.Tags.Stringf(config.Name)
+			tags, reason := config.filter(request.Tags)
+			if reason != "" {
+				continue
+			}
 
-					w.metricsBuffer.Add(tags, name, 1, request.RequestTime)
+			name := w.prefix + request.Tags.Stringf(config.Name)
 
-					// If for this metric we also want CPU time, then add it
-					// with different name
-					if config.CPUTime {
-						w.metricsBuffer.Add(tags, name+".cpu", 1, request.RuUtime+request.RuStime)
-					}
+			add(tags, name, config.otherName, 1, config.requestValue(request), int(request.Status), config)
+
+			// If for this metric we also want CPU time, then add it
+			// with different name
+			if config.CPUTime {
+				add(tags, name+".cpu", config.otherName+".cpu", 1, request.RuUtime+request.RuStime, 0, config)
+			}
+		}
+
+		for i := range w.timersSettings {
+			config := &w.timersSettings[i]
+			if config.matcher != nil && !config.matcher.MatchRequest(request) {
+				continue
+			}
+
+			for _, timer := range request.Timers {
+				tags, reason := config.filter(timer.Tags)
+				if reason != "" {
+					continue
+				}
+
+				name := w.prefix + timer.Tags.Stringf(config.Name)
+
+				value := timer.Value
+				if config.Value == "cpu" {
+					value = timer.RuUtime + timer.RuStime
 				}
+				add(tags, name, config.otherName, int64(timer.HitCount), value, 0, config)
 
-				for _, config := range w.timersSettings {
-					for _, timer := range request.Timers {
-						// We can't have metrics without tags
-						tags := timer.Tags.Filter(config.Tags)
-						if len(tags) == 0 {
-							continue
-						}
-
-						if len(config.ReqiredTags) > 0 &&
-							len(timer.Tags.Filter(config.ReqiredTags)) != len(config.ReqiredTags) {
-							continue
-						}
-
-						name := w.prefix + timer.Tags.Stringf(config.Name)
-
-						w.metricsBuffer.Add(tags, name, int64(timer.HitCount), timer.Value)
-
-						// If for this metric we also want CPU time, then add it
-						// with different name
-						if config.CPUTime {
-							w.metricsBuffer.Add(tags, name+".cpu", int64(timer.HitCount), timer.RuUtime+timer.RuStime)
-						}
-					}
+				// If for this metric we also want CPU time, then add it
+				// with different name
+				if config.CPUTime {
+					add(tags, name+".cpu", config.otherName+".cpu", int64(timer.HitCount), timer.RuUtime+timer.RuStime, 0, config)
 				}
 			}
+		}
 
-			log.Printf("[DEBUG] Queue: %v, Sent: %v, Dropped: %v", len(w.client.Queue), w.client.Sent, w.client.Dropped)
-
-			go w.send(requests.Timestamp, w.metricsBuffer.Data)
-			w.metricsBuffer.Reset()
+		// Breakdown series get one value per request: sum of its timers in
+		// every group
+		for i := range w.breakdownSettings {
+			config := &w.breakdownSettings[i]
+			if config.matcher != nil && !config.matcher.MatchRequest(request) {
+				continue
+			}
 
-			d := time.Since(t)
-			log.Printf("[INFO][%d] Get %v metrics, appended in %v",
-				requests.Timestamp, len(requests.Requests), d-d%time.Millisecond)
+			tags, reason := config.filter(request.Tags)
+			if reason != "" {
+				continue
+			}
 
-			w.client.Push(&opentsdb.DataPoint{
-				"pinba.aggregator.metrics",
-				requests.Timestamp,
-				len(requests.Requests),
-				statsTag,
-			})
+			name := w.prefix + request.Tags.Stringf(config.Name)
+			for _, group := range config.breakdown(request, tags) {
+				add(group.tags, name, config.otherName, 1, group.value, 0, config)
+				if config.CPUTime {
+					add(group.tags, name+".cpu", config.otherName+".cpu", 1, group.cpu, 0, config)
+				}
+			}
 		}
 	}
+	return samples, skipped
 }
 
-func (w *Writer) send(ts int64, data map[string]*Metric) {
+func (w *Writer) send(requests *client.PinbaRequests, data map[string]*Metric) {
 	t := time.Now()
+	ts := requests.Timestamp
 
 	var total int
 	for _, m := range data {
@@ -160,19 +813,67 @@ func (w *Writer) send(ts int64, data map[string]*Metric) {
 			cpu := m.Percentile(95)
 			if cpu > 0 { // if cpu usage is zero, don't send it, it's not interesting
 				total++
-				w.client.Push(&opentsdb.DataPoint{m.Name, ts, cpu, m.Tags})
+				w.push(m.Name, ts, cpu, m.Tags)
 			}
+			total += w.sendHistogram(ts, m)
 		} else {
-			w.client.Push(&opentsdb.DataPoint{m.Name + ".rps", ts, float64(m.Count) / 10, m.Tags})
-			w.client.Push(&opentsdb.DataPoint{m.Name + ".p25", ts, m.Percentile(25), m.Tags})
-			w.client.Push(&opentsdb.DataPoint{m.Name + ".p50", ts, m.Percentile(50), m.Tags})
-			w.client.Push(&opentsdb.DataPoint{m.Name + ".p75", ts, m.Percentile(75), m.Tags})
-			w.client.Push(&opentsdb.DataPoint{m.Name + ".p95", ts, m.Percentile(95), m.Tags})
-			w.client.Push(&opentsdb.DataPoint{m.Name + ".max", ts, m.Max(), m.Tags})
+			w.push(m.Name+".rps", ts, requests.Rate(m.Count), m.Tags)
+			w.push(m.Name+".p25", ts, m.Percentile(25), m.Tags)
+			w.push(m.Name+".p50", ts, m.Percentile(50), m.Tags)
+			w.push(m.Name+".p75", ts, m.Percentile(75), m.Tags)
+			w.push(m.Name+".p95", ts, m.Percentile(95), m.Tags)
+			w.push(m.Name+".max", ts, m.Max(), m.Tags)
 			total += 6
+			total += w.sendHistogram(ts, m)
+			total += w.sendStatuses(requests, m)
+			total += w.sendApdex(ts, m)
 		}
 	}
 
 	d := time.Since(t)
 	log.Printf("[INFO][%d] %v unique metrics sent to OpenTSDB in %v", ts, total, d-d%time.Millisecond)
 }
+
+// sendApdex sends Apdex score of metric as "<name>.apdex" and numbers of
+// values within and over SLO threshold as "<name>.good" and "<name>.bad"
+func (w *Writer) sendApdex(ts int64, m *Metric) int {
+	if m.Apdex == nil {
+		return 0
+	}
+	w.push(m.Name+".apdex", ts, m.Apdex.Score(), m.Tags)
+	w.push(m.Name+".good", ts, m.Apdex.Good(), m.Tags)
+	w.push(m.Name+".bad", ts, m.Apdex.Bad(), m.Tags)
+	return 3
+}
+
+// sendStatuses sends rate of requests by HTTP status class as "<name>.status"
+// with class in "status" tag, rate of 5xx errors as "<name>.errors" and their
+// ratio to all requests as "<name>.error_rate"
+func (w *Writer) sendStatuses(requests *client.PinbaRequests, m *Metric) int {
+	if m.Statuses == nil {
+		return 0
+	}
+	ts := requests.Timestamp
+	for i, count := range m.Statuses {
+		w.push(m.Name+".status", ts, requests.Rate(count), withTag(m.Tags, "status", fmt.Sprintf("%dxx", i+1)))
+	}
+
+	errors := m.Statuses[4]
+	w.push(m.Name+".errors", ts, requests.Rate(errors), m.Tags)
+	w.push(m.Name+".error_rate", ts, float64(errors)/float64(m.Count), m.Tags)
+	return len(m.Statuses) + 2
+}
+
+// sendHistogram sends cumulative count of values in every bucket of metric
+// histogram as "<name>.hist" with bucket upper bound in "le" tag, like
+// Prometheus does. Every bucket is sent, even if its count didn't change,
+// otherwise OpenTSDB will interpolate it on aggregation
+func (w *Writer) sendHistogram(ts int64, m *Metric) int {
+	if m.Histogram == nil {
+		return 0
+	}
+	for i, count := range m.Histogram.Cumulative() {
+		w.push(m.Name+".hist", ts, count, withTag(m.Tags, "le", m.Histogram.Label(i)))
+	}
+	return len(m.Histogram.Counts)
+}
@@ -9,6 +9,18 @@ func main() {
 	var (
 		inAddr  = flag.String("in", "", "incoming socket")
 		outAddr = flag.String("out", "", "outcoming socket")
+
+		queueFrames = flag.Int("queue", 10, "frames (seconds) queued for every client")
+		queueBytes  = flag.Int64("queue-bytes", 0, "bytes queued for every client, 0 is no limit")
+		slowPolicy  = flag.String("slow-policy", policyDisconnect,
+			"what to do with client, which queue is full: disconnect, drop-oldest or pause, the last two send gap messages")
+		heartbeat = flag.Bool("heartbeat", false,
+			"send heartbeats to clients, when idle and every 10 sec, all clients should support them")
+
+		brokerAddr = flag.String("broker", "", "broker to publish to as well, file:<dir>")
+		topic      = flag.String("topic", "pinba", "topic of broker")
+		brokerMode = flag.String("broker-mode", "request", "publish every request or packet")
+		brokerKey  = flag.String("broker-key", "hostname", "key of requests, hostname or server")
 	)
 	flag.Parse()
 	log.Printf("Pinba collector listening on %s and send to %s\n", *inAddr, *outAddr)
@@ -22,10 +34,29 @@ func main() {
 	log.Printf("Start listening on udp://%v\n", *inAddr)
 	go pinbaServer.Listen(stream)
 
-	publisher, err := NewPublisher(outAddr)
+	queue := QueueSettings{Frames: *queueFrames, Bytes: *queueBytes, Policy: *slowPolicy}
+	publisher, err := NewPublisher(outAddr, queue)
 	if err != nil {
-		log.Fatalf("Can't resolve address: '%v'", err)
+		log.Fatalf("Can't create publisher: '%v'", err)
 	}
 	log.Printf("Start listening on tcp://%v\n", *outAddr)
+	if *heartbeat {
+		publisher.EnableHeartbeats(pinbaServer)
+		log.Printf("Sending heartbeats to clients\n")
+	}
+
+	if *brokerAddr != "" {
+		b, err := openBroker(*brokerAddr)
+		if err != nil {
+			log.Fatalf("Can't open broker: '%v'", err)
+		}
+		defer b.Close()
+		output, err := NewBrokerOutput(b, *topic, *brokerMode, *brokerKey)
+		if err != nil {
+			log.Fatalf("Can't create broker output: '%v'", err)
+		}
+		publisher.AddOutput(output)
+		log.Printf("Publishing every %v to topic %q of %v\n", *brokerMode, *topic, *brokerAddr)
+	}
 	publisher.Start(stream)
 }
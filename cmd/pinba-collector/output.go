@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/broker"
+)
+
+// Output receives data collected by Publisher besides its TCP clients
+type Output interface {
+	// Request is called with every raw Pinba request
+	Request(data []byte)
+	// Packet is called with every packet of requests of one second
+	Packet(timestamp time.Time, data []byte) error
+}
+
+// BrokerOutput publishes collected data to topic of broker: either every raw
+// request, keyed by its hostname or server name, or every packet, keyed by
+// hostname of collector. Requests are produced in batches with packets
+type BrokerOutput struct {
+	broker broker.Broker
+	topic  string
+	mode   string
+	key    string
+
+	hostname []byte
+	pending  []broker.Message
+}
+
+// NewBrokerOutput creates output to topic of broker, mode is "request" or
+// "packet", key of requests is "hostname" or "server"
+func NewBrokerOutput(b broker.Broker, topic, mode, key string) (*BrokerOutput, error) {
+	if mode != "request" && mode != "packet" {
+		return nil, fmt.Errorf("broker mode should be request or packet, got %q", mode)
+	}
+	if key != "hostname" && key != "server" {
+		return nil, fmt.Errorf("broker key should be hostname or server, got %q", key)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &BrokerOutput{broker: b, topic: topic, mode: mode, key: key, hostname: []byte(hostname)}, nil
+}
+
+// Request queues request for the next batch, if output is in request mode
+func (o *BrokerOutput) Request(data []byte) {
+	if o.mode != "request" {
+		return
+	}
+	o.pending = append(o.pending, broker.Message{Key: o.requestKey(data), Value: data})
+}
+
+// requestKey decodes request for its hostname or server name, key is empty
+// if request is invalid
+func (o *BrokerOutput) requestKey(data []byte) []byte {
+	request, err := pinba.NewRequest(data)
+	if err != nil {
+		return nil
+	}
+	if o.key == "server" {
+		return []byte(request.ServerName)
+	}
+	return []byte(request.Hostname)
+}
+
+// Packet produces requests queued since the last packet, or packet itself
+func (o *BrokerOutput) Packet(timestamp time.Time, data []byte) error {
+	if o.mode == "packet" {
+		return o.broker.Produce(o.topic, broker.Message{Timestamp: timestamp.Unix(), Key: o.hostname, Value: data})
+	}
+
+	messages := o.pending
+	o.pending = nil
+	for i := range messages {
+		messages[i].Timestamp = timestamp.Unix()
+	}
+	return o.broker.Produce(o.topic, messages...)
+}
+
+// openBroker opens broker by address, only "file:<dir>" is supported now
+func openBroker(addr string) (broker.Broker, error) {
+	if strings.HasPrefix(addr, "file:") {
+		return broker.NewFileBroker(strings.TrimPrefix(addr, "file:"))
+	}
+	return nil, fmt.Errorf("unknown broker %q, should be file:<dir>", addr)
+}
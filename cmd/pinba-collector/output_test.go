@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/olegfedoseev/pinba-server/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerOutputRequests(t *testing.T) {
+	b := broker.NewMemoryBroker()
+	output, err := NewBrokerOutput(b, "pinba", "request", "server")
+	assert.NoError(t, err)
+
+	output.Request(pinbaPacket)
+	output.Request(pinbaPacket)
+	messages, err := b.Fetch("pinba", 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, messages, "requests are produced with packet")
+
+	assert.NoError(t, output.Packet(time.Unix(1500000000, 0), []byte("packet")))
+	messages, err = b.Fetch("pinba", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+	for _, m := range messages {
+		assert.Equal(t, []byte("test.ru"), m.Key)
+		assert.Equal(t, pinbaPacket, m.Value)
+		assert.EqualValues(t, 1500000000, m.Timestamp)
+	}
+
+	// Nothing new to produce
+	assert.NoError(t, output.Packet(time.Unix(1500000001, 0), []byte("packet")))
+	messages, err = b.Fetch("pinba", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 2)
+}
+
+func TestBrokerOutputPackets(t *testing.T) {
+	b := broker.NewMemoryBroker()
+	output, err := NewBrokerOutput(b, "packets", "packet", "hostname")
+	assert.NoError(t, err)
+
+	output.Request(pinbaPacket)
+	assert.NoError(t, output.Packet(time.Unix(1500000000, 0), []byte("packet")))
+	messages, err := b.Fetch("packets", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	hostname, _ := os.Hostname()
+	assert.Equal(t, []byte(hostname), messages[0].Key)
+	assert.Equal(t, []byte("packet"), messages[0].Value)
+
+	_, err = NewBrokerOutput(b, "pinba", "message", "hostname")
+	assert.Error(t, err)
+	_, err = NewBrokerOutput(b, "pinba", "request", "script")
+	assert.Error(t, err)
+	_, err = openBroker("kafka://127.0.0.1:9092")
+	assert.Error(t, err)
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"net"
+	"sync/atomic"
 )
 
 // PinbaServer is UDP server for pinba "clients"
 type PinbaServer struct {
+	// packets received and dropped, because stream was full
+	packets int64
+	dropped int64
+
 	server *net.UDPConn
 }
 
@@ -33,11 +38,21 @@ func (pinba *PinbaServer) Listen(stream chan []byte) {
 			continue
 		}
 
+		atomic.AddInt64(&pinba.packets, 1)
 		select {
 		case stream <- buf[0:n]:
 			// all good
 		default:
 			// chan is full
+			atomic.AddInt64(&pinba.dropped, 1)
 		}
 	}
 }
+
+// Stats returns number of packets received and dropped since start
+func (pinba *PinbaServer) Stats() (packets, dropped int64) {
+	if pinba == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&pinba.packets), atomic.LoadInt64(&pinba.dropped)
+}
@@ -3,19 +3,43 @@ package main
 import (
 	"log"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/olegfedoseev/pinba-server/client"
 )
 
-type clientChan chan []byte
+// heartbeatInterval is how often heartbeat is sent, when there are requests.
+// When there are none, it's sent every second instead of packet. Lag of
+// subscribers is logged with the same interval. Heartbeats are sent only if
+// they are enabled, clients older than them fail to read them
+const heartbeatInterval = 10 * time.Second
 
 type Publisher struct {
 	Server  *net.TCPListener
-	clients map[string]clientChan
 	packets int
 	timer   time.Duration
+	outputs []Output
+
+	queue       QueueSettings
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	lastReport  time.Time
+
+	// source of requests, which stats are sent in heartbeats, requests is
+	// number of requests sent to clients
+	heartbeats    bool
+	source        *PinbaServer
+	requests      int64
+	lastHeartbeat time.Time
 }
 
-func NewPublisher(outAddr *string) (*Publisher, error) {
+// NewPublisher creates publisher listening for subscribers on given address,
+// each of them gets its own queue with given settings
+func NewPublisher(outAddr *string, queue QueueSettings) (*Publisher, error) {
+	if err := queue.Validate(); err != nil {
+		return nil, err
+	}
 	addr, err := net.ResolveTCPAddr("tcp", *outAddr)
 	if err != nil {
 		return nil, err
@@ -25,14 +49,28 @@ func NewPublisher(outAddr *string) (*Publisher, error) {
 		return nil, err
 	}
 
-	clients := make(map[string]clientChan, 0)
 	p := &Publisher{
-		Server:  listener,
-		clients: clients,
+		Server:      listener,
+		queue:       queue,
+		subscribers: make(map[*subscriber]struct{}),
 	}
 	return p, nil
 }
 
+// AddOutput adds output, that gets the same data as TCP clients. It should
+// be called before Start
+func (p *Publisher) AddOutput(output Output) {
+	p.outputs = append(p.outputs, output)
+}
+
+// EnableHeartbeats makes publisher send heartbeats with stats of given
+// server to clients. Every client should support them, so it's off by
+// default. It should be called before Start
+func (p *Publisher) EnableHeartbeats(source *PinbaServer) {
+	p.heartbeats = true
+	p.source = source
+}
+
 func (p *Publisher) sender() {
 	defer p.Server.Close()
 	for {
@@ -41,29 +79,44 @@ func (p *Publisher) sender() {
 		if err != nil {
 			log.Fatal(err)
 		}
+		conn.SetNoDelay(false)
 
-		p.clients[conn.RemoteAddr().String()] = make(chan []byte, 10)
+		s := newSubscriber(conn, p.queue)
+		p.mu.Lock()
+		p.subscribers[s] = struct{}{}
+		p.mu.Unlock()
 		log.Printf("Look's like we got customer! He's from %v", conn.RemoteAddr())
 
 		// Handle the connection in a new goroutine.
-		go func(client *net.TCPConn) {
-			defer client.Close()
-			client.SetNoDelay(false)
+		go p.send(s)
+	}
+}
 
-			for {
-				data := <-p.clients[client.RemoteAddr().String()]
+// send writes queued frames to subscriber until it's evicted
+func (p *Publisher) send(s *subscriber) {
+	for {
+		data, ok := s.pop()
+		if !ok {
+			return
+		}
 
-				client.SetWriteDeadline(time.Now().Add(time.Second))
-				if _, err := client.Write(data); err != nil {
-					log.Printf("Failed to Write: '%v', closing connection", err)
-					break
-				}
-				client.SetWriteDeadline(time.Time{}) // No timeout
-			}
-			delete(p.clients, client.RemoteAddr().String())
-			log.Printf("Goodbye %v!", client.RemoteAddr())
-		}(conn)
+		s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := s.conn.Write(data); err != nil {
+			p.evict(s, "failed to write: "+err.Error())
+			return
+		}
+	}
+}
+
+// evict disconnects subscriber for given reason
+func (p *Publisher) evict(s *subscriber, reason string) {
+	if !s.evict() {
+		return
 	}
+	p.mu.Lock()
+	delete(p.subscribers, s)
+	p.mu.Unlock()
+	log.Printf("Goodbye %v! Evicted, because %s, %s", s.conn.RemoteAddr(), reason, s.report())
 }
 
 func (p *Publisher) Start(stream chan []byte) {
@@ -80,11 +133,20 @@ func (p *Publisher) Start(stream chan []byte) {
 			if err := packet.AddRequest(data); err != nil {
 				log.Printf("Failed to add request: %v", err)
 			}
+			for _, output := range p.outputs {
+				output.Request(data)
+			}
 
 		case now := <-ticker.C:
+			if now.Sub(p.lastReport) >= heartbeatInterval {
+				p.report()
+				p.lastReport = now
+			}
+
 			if packet.Count == 0 {
 				log.Printf("No packets for %.f sec (since %v)!\n",
 					time.Now().Sub(idleTime).Seconds(), idleTime.Format("15:04:05"))
+				p.heartbeat(now, idleTime)
 				continue
 			}
 			idleTime = now
@@ -98,15 +160,76 @@ func (p *Publisher) Start(stream chan []byte) {
 			}
 			log.Printf("Prepared packet of %v requests in %v", packet.Count, time.Since(t))
 
-			for _, c := range p.clients {
-				if len(c) == cap(c) {
-					close(c) // clients channel is full, looks like it's dead
-					log.Printf("Close client connection - too slow")
-					continue
+			for _, output := range p.outputs {
+				if err := output.Packet(now, data); err != nil {
+					log.Printf("Failed to send packet to output: %v", err)
 				}
-				c <- data
 			}
+
+			p.broadcast(now.Unix(), data)
+			p.requests += packet.Count
 			packet.Reset()
+
+			if now.Sub(p.lastHeartbeat) >= heartbeatInterval {
+				p.heartbeat(now, idleTime)
+			}
 		}
 	}
 }
+
+// heartbeat sends clients heartbeat with stats of collector, so they know
+// it's alive, while idle, and can detect lost packets. Every client also
+// gets its own lag. It does nothing, if heartbeats are not enabled
+func (p *Publisher) heartbeat(now, idleTime time.Time) {
+	if !p.heartbeats {
+		return
+	}
+	packets, dropped := p.source.Stats()
+	heartbeat := client.Heartbeat{
+		Packets:  packets,
+		Dropped:  dropped,
+		Requests: p.requests,
+		Idle:     int64(now.Sub(idleTime).Seconds()),
+	}
+	for _, s := range p.list() {
+		frames, bytes := s.lag()
+		heartbeat.Queued, heartbeat.QueuedBytes = int64(frames), bytes
+		data, err := client.EncodeHeartbeat(now.Unix(), heartbeat)
+		if err != nil {
+			log.Printf("Failed to prepare heartbeat: %v", err)
+			return
+		}
+		p.push(s, now.Unix(), data)
+	}
+	p.lastHeartbeat = now
+}
+
+func (p *Publisher) broadcast(timestamp int64, data []byte) {
+	for _, s := range p.list() {
+		p.push(s, timestamp, data)
+	}
+}
+
+func (p *Publisher) push(s *subscriber, timestamp int64, data []byte) {
+	if reason := s.push(timestamp, data); reason != "" {
+		p.evict(s, reason)
+	}
+}
+
+// report logs lag of every subscriber
+func (p *Publisher) report() {
+	for _, s := range p.list() {
+		log.Printf("Subscriber %v: %s", s.conn.RemoteAddr(), s.report())
+	}
+}
+
+// list returns connected subscribers
+func (p *Publisher) list() []*subscriber {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := make([]*subscriber, 0, len(p.subscribers))
+	for s := range p.subscribers {
+		result = append(result, s)
+	}
+	return result
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	pinba "github.com/olegfedoseev/pinba-server/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSubscriber(t *testing.T, queue QueueSettings) (*subscriber, net.Conn) {
+	server, client := net.Pipe()
+	return newSubscriber(server, queue), client
+}
+
+// popMessage decodes next frame in queue of subscriber
+func popMessage(t *testing.T, s *subscriber) pinba.ServerMessage {
+	data, ok := s.pop()
+	assert.True(t, ok)
+	message := pinba.ServerMessage{}
+	assert.NoError(t, message.ReadFrom(bytes.NewReader(data)))
+	return message
+}
+
+func TestPublisherHeartbeat(t *testing.T) {
+	s, conn := testSubscriber(t, QueueSettings{Frames: 10, Policy: policyDisconnect})
+	defer conn.Close()
+	p := &Publisher{
+		subscribers: map[*subscriber]struct{}{s: {}},
+		requests:    97,
+	}
+	now := time.Unix(testTimestamp, 0)
+
+	// Heartbeats are off by default
+	p.heartbeat(now, now)
+	frames, _ := s.lag()
+	assert.Equal(t, 0, frames)
+
+	p.EnableHeartbeats(&PinbaServer{packets: 100, dropped: 3})
+	p.broadcast(testTimestamp, []byte("packet"))
+	p.heartbeat(now, now.Add(-5*time.Second))
+	assert.Equal(t, now, p.lastHeartbeat)
+
+	data, _ := s.pop()
+	assert.Equal(t, "packet", string(data))
+	message := popMessage(t, s)
+	assert.EqualValues(t, testTimestamp, message.Timestamp)
+	assert.Equal(t, &pinba.Heartbeat{Packets: 100, Dropped: 3, Requests: 97, Idle: 5, Queued: 1, QueuedBytes: 6},
+		message.Heartbeat)
+
+	// Publisher without source still sends heartbeats
+	p.source = nil
+	p.heartbeat(now, now)
+	assert.Equal(t, &pinba.Heartbeat{Requests: 97}, popMessage(t, s).Heartbeat)
+}
+
+func TestPublisherEvict(t *testing.T) {
+	s, conn := testSubscriber(t, QueueSettings{Frames: 2, Policy: policyDisconnect})
+	defer conn.Close()
+	p := &Publisher{subscribers: map[*subscriber]struct{}{s: {}}}
+
+	p.broadcast(1, []byte("1"))
+	p.broadcast(2, []byte("2"))
+	assert.Len(t, p.list(), 1)
+	p.broadcast(3, []byte("3"))
+	assert.Empty(t, p.list())
+
+	_, ok := s.pop()
+	assert.False(t, ok, "queue of evicted subscriber is not sent")
+	_, err := conn.Read(make([]byte, 1))
+	assert.Error(t, err, "connection is closed")
+}
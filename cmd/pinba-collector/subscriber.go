@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/olegfedoseev/pinba-server/client"
+)
+
+// Policies for subscribers, which are too slow to read their queue
+const (
+	// policyDisconnect evicts subscriber, when its queue is full
+	policyDisconnect = "disconnect"
+	// policyDropOldest drops the oldest frames to make room for new ones
+	policyDropOldest = "drop-oldest"
+	// policyPause drops new frames, when queue is full, until subscriber
+	// reads half of it
+	policyPause = "pause"
+)
+
+// QueueSettings limits queue of every subscriber and sets what to do, when
+// it's full. Subscriber gets gap message in place of dropped frames
+type QueueSettings struct {
+	Frames int
+	// Bytes is limit of queued bytes, 0 is no limit
+	Bytes  int64
+	Policy string
+}
+
+// Validate checks queue settings
+func (s QueueSettings) Validate() error {
+	if s.Frames <= 0 {
+		return fmt.Errorf("queue should have at least one frame, got %d", s.Frames)
+	}
+	if s.Bytes < 0 {
+		return fmt.Errorf("bytes limit of queue can't be negative, got %d", s.Bytes)
+	}
+	switch s.Policy {
+	case policyDisconnect, policyDropOldest, policyPause:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q, should be %s, %s or %s",
+		s.Policy, policyDisconnect, policyDropOldest, policyPause)
+}
+
+// queued is frame in queue of subscriber, or gap in place of dropped ones
+type queued struct {
+	timestamp int64
+	data      []byte
+	gap       *client.Gap
+}
+
+// subscriber is TCP client of Publisher with its own queue of frames
+type subscriber struct {
+	conn     net.Conn
+	settings QueueSettings
+
+	mu     sync.Mutex
+	queue  []queued
+	frames int
+	bytes  int64
+	paused bool
+	// maximum lag since last report and frames dropped since connect
+	maxFrames int
+	maxBytes  int64
+	dropped   int64
+	evicted   bool
+
+	// wake is signaled, when something is queued
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newSubscriber(conn net.Conn, settings QueueSettings) *subscriber {
+	return &subscriber{
+		conn:     conn,
+		settings: settings,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// push queues frame with given timestamp, and returns reason to evict
+// subscriber, if it's too slow for its policy
+func (s *subscriber) push(timestamp int64, data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.evicted {
+		return ""
+	}
+
+	if s.paused && s.frames <= s.settings.Frames/2 {
+		s.paused = false
+	}
+	if s.paused || s.full(data) {
+		switch s.settings.Policy {
+		case policyDisconnect:
+			return fmt.Sprintf("queue is full: %d frames, %d bytes", s.frames, s.bytes)
+		case policyDropOldest:
+			for s.frames > 0 && s.full(data) {
+				s.dropOldest()
+			}
+		case policyPause:
+			s.paused = true
+		}
+		if s.paused || s.full(data) {
+			// Frame doesn't fit even in empty queue
+			s.drop(len(s.queue), timestamp, data)
+			return ""
+		}
+	}
+
+	s.queue = append(s.queue, queued{timestamp: timestamp, data: data})
+	s.frames++
+	s.bytes += int64(len(data))
+	if s.frames > s.maxFrames {
+		s.maxFrames = s.frames
+	}
+	if s.bytes > s.maxBytes {
+		s.maxBytes = s.bytes
+	}
+	s.signal()
+	return ""
+}
+
+func (s *subscriber) full(data []byte) bool {
+	if s.frames >= s.settings.Frames {
+		return true
+	}
+	return s.settings.Bytes > 0 && s.bytes+int64(len(data)) > s.settings.Bytes
+}
+
+// dropOldest replaces the oldest frame in queue with gap
+func (s *subscriber) dropOldest() {
+	for i, q := range s.queue {
+		if q.gap == nil {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			s.frames--
+			s.bytes -= int64(len(q.data))
+			s.drop(i, q.timestamp, q.data)
+			return
+		}
+	}
+}
+
+// drop records dropped frame in gap at position i of queue, merging it with
+// gap right before it, if there is one
+func (s *subscriber) drop(i int, timestamp int64, data []byte) {
+	s.dropped++
+	if i > 0 && s.queue[i-1].gap != nil {
+		gap := s.queue[i-1].gap
+		gap.Messages++
+		gap.Bytes += int64(len(data))
+		if timestamp < gap.From {
+			gap.From = timestamp
+		}
+		if timestamp > gap.To {
+			gap.To = timestamp
+		}
+		return
+	}
+	gap := &client.Gap{Messages: 1, Bytes: int64(len(data)), From: timestamp, To: timestamp}
+	s.queue = append(s.queue, queued{})
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = queued{timestamp: timestamp, gap: gap}
+	s.signal()
+}
+
+func (s *subscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for next frame in queue and returns it, gap is encoded only
+// now, so it has every frame dropped in its place. It returns false, when
+// subscriber is evicted
+func (s *subscriber) pop() ([]byte, bool) {
+	for {
+		s.mu.Lock()
+		if s.evicted {
+			s.mu.Unlock()
+			return nil, false
+		}
+		if len(s.queue) > 0 {
+			q := s.queue[0]
+			s.queue[0] = queued{}
+			s.queue = s.queue[1:]
+			if q.gap == nil {
+				s.frames--
+				s.bytes -= int64(len(q.data))
+			}
+			s.mu.Unlock()
+
+			if q.gap == nil {
+				return q.data, true
+			}
+			data, err := client.EncodeGap(*q.gap)
+			if err != nil {
+				continue
+			}
+			return data, true
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return nil, false
+		}
+	}
+}
+
+// lag returns number of frames and bytes in queue
+func (s *subscriber) lag() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frames, s.bytes
+}
+
+// report returns description of subscriber lag and resets its maximum
+func (s *subscriber) report() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := fmt.Sprintf("lag %d frames, %d bytes (max %d frames, %d bytes), %d frames dropped",
+		s.frames, s.bytes, s.maxFrames, s.maxBytes, s.dropped)
+	s.maxFrames, s.maxBytes = s.frames, s.bytes
+	return result
+}
+
+// evict stops sending to subscriber and closes its connection, it returns
+// false, if subscriber is already evicted
+func (s *subscriber) evict() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.evicted {
+		return false
+	}
+	s.evicted = true
+	close(s.done)
+	s.conn.Close()
+	return true
+}
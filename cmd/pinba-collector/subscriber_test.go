@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	pinba "github.com/olegfedoseev/pinba-server/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueSettingsValidate(t *testing.T) {
+	assert.NoError(t, QueueSettings{Frames: 10, Policy: policyPause}.Validate())
+	assert.Error(t, QueueSettings{Frames: 0, Policy: policyPause}.Validate())
+	assert.Error(t, QueueSettings{Frames: 10, Bytes: -1, Policy: policyPause}.Validate())
+	assert.Error(t, QueueSettings{Frames: 10, Policy: "block"}.Validate())
+}
+
+func TestSubscriberDisconnect(t *testing.T) {
+	s, conn := testSubscriber(t, QueueSettings{Frames: 10, Bytes: 5, Policy: policyDisconnect})
+	defer conn.Close()
+
+	assert.Equal(t, "", s.push(1, []byte("123")))
+	assert.Equal(t, "queue is full: 1 frames, 3 bytes", s.push(2, []byte("456")))
+	frames, bytes := s.lag()
+	assert.Equal(t, 1, frames)
+	assert.EqualValues(t, 3, bytes)
+}
+
+func TestSubscriberDropOldest(t *testing.T) {
+	s, conn := testSubscriber(t, QueueSettings{Frames: 2, Policy: policyDropOldest})
+	defer conn.Close()
+
+	for ts := int64(1); ts <= 5; ts++ {
+		assert.Equal(t, "", s.push(ts, []byte("frame")))
+	}
+	// Frames 1-3 are replaced with one gap
+	assert.Equal(t, &pinba.Gap{Messages: 3, Bytes: 15, From: 1, To: 3}, popMessage(t, s).Gap)
+	for _, expected := range []string{"frame", "frame"} {
+		data, _ := s.pop()
+		assert.Equal(t, expected, string(data))
+	}
+
+	// Gap was sent, so next one is new
+	for ts := int64(6); ts <= 8; ts++ {
+		s.push(ts, []byte("frame"))
+	}
+	assert.Equal(t, &pinba.Gap{Messages: 1, Bytes: 5, From: 6, To: 6}, popMessage(t, s).Gap)
+	assert.True(t, strings.HasSuffix(s.report(), "4 frames dropped"))
+}
+
+func TestSubscriberPause(t *testing.T) {
+	s, conn := testSubscriber(t, QueueSettings{Frames: 4, Policy: policyPause})
+	defer conn.Close()
+
+	for ts := int64(1); ts <= 6; ts++ {
+		s.push(ts, []byte{byte(ts)})
+	}
+	// Subscriber reads one frame, but paused queue waits for half of it
+	data, _ := s.pop()
+	assert.Equal(t, []byte{1}, data)
+	s.push(7, []byte{7})
+
+	data, _ = s.pop()
+	assert.Equal(t, []byte{2}, data)
+	s.push(8, []byte{8})
+
+	for _, expected := range []byte{3, 4} {
+		data, _ = s.pop()
+		assert.Equal(t, []byte{expected}, data)
+	}
+	assert.Equal(t, &pinba.Gap{Messages: 3, Bytes: 3, From: 5, To: 7}, popMessage(t, s).Gap)
+	data, _ = s.pop()
+	assert.Equal(t, []byte{8}, data)
+}
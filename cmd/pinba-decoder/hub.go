@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hub publishes messages to subscribers connected over TCP. Protocol is text
+// one, like NATS. Subscriber sends commands, one per line:
+//
+//	SUB <pattern>    subscribe to topics matching pattern, like "test.ru" or
+//	                 "*.test.ru" (see path.Match), "*" matches every topic
+//	UNSUB <pattern>  cancel subscription with the same pattern
+//	PING             check connection, hub answers PONG
+//
+// Hub answers "+OK" to SUB and UNSUB, "-ERR <reason>" to invalid commands,
+// and sends every message of subscribed topics as:
+//
+//	MSG <topic> <size of payload>\r\n<payload>\r\n
+//
+// Topic is server name of request and payload is client.Record in JSON.
+// Messages for subscriber, which queue is full, are dropped
+type Hub struct {
+	queueSize int
+
+	mu          sync.RWMutex
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	conn    net.Conn
+	queue   chan []byte
+	done    chan struct{}
+	dropped int64
+
+	mu       sync.Mutex
+	patterns []string
+}
+
+// NewHub creates hub with given size of queue of every subscriber
+func NewHub(queueSize int) *Hub {
+	return &Hub{queueSize: queueSize, subscribers: make(map[*subscriber]struct{})}
+}
+
+// Serve accepts subscribers until listener is closed
+func (h *Hub) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go h.handle(conn)
+	}
+}
+
+// Subscribers returns number of connected subscribers
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscribers)
+}
+
+// Publish queues message for every subscriber of topic, frame is encoded
+// only if there is one
+func (h *Hub) Publish(topic string, payload []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var frame []byte
+	for s := range h.subscribers {
+		if !s.matches(topic) {
+			continue
+		}
+		if frame == nil {
+			frame = make([]byte, 0, len(topic)+len(payload)+32)
+			frame = append(frame, fmt.Sprintf("MSG %s %d\r\n", topic, len(payload))...)
+			frame = append(frame, payload...)
+			frame = append(frame, "\r\n"...)
+		}
+		select {
+		case s.queue <- frame:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+func (h *Hub) handle(conn net.Conn) {
+	s := &subscriber{
+		conn:  conn,
+		queue: make(chan []byte, h.queueSize),
+		done:  make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+	log.Printf("Subscriber %v connected", conn.RemoteAddr())
+
+	go s.write()
+	s.read()
+
+	h.mu.Lock()
+	delete(h.subscribers, s)
+	h.mu.Unlock()
+	close(s.done)
+	conn.Close()
+	log.Printf("Subscriber %v disconnected, %d messages dropped",
+		conn.RemoteAddr(), atomic.LoadInt64(&s.dropped))
+}
+
+// read handles commands of subscriber until it disconnects
+func (s *subscriber) read() {
+	scanner := bufio.NewScanner(s.conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch command := strings.ToUpper(fields[0]); {
+		case command == "PING" && len(fields) == 1:
+			s.reply("PONG")
+		case (command == "SUB" || command == "UNSUB") && len(fields) == 2:
+			if _, err := path.Match(fields[1], ""); err != nil {
+				s.reply("-ERR invalid pattern")
+				continue
+			}
+			s.subscribe(fields[1], command == "SUB")
+			s.reply("+OK")
+		default:
+			s.reply("-ERR unknown command")
+		}
+	}
+}
+
+// reply queues answer to command, waiting for space in queue
+func (s *subscriber) reply(line string) {
+	select {
+	case s.queue <- []byte(line + "\r\n"):
+	case <-time.After(time.Second):
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+func (s *subscriber) subscribe(pattern string, subscribe bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.patterns {
+		if p == pattern {
+			if !subscribe {
+				s.patterns = append(s.patterns[:i], s.patterns[i+1:]...)
+			}
+			return
+		}
+	}
+	if subscribe {
+		s.patterns = append(s.patterns, pattern)
+	}
+}
+
+func (s *subscriber) matches(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.patterns {
+		if ok, _ := path.Match(p, topic); ok || p == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// write sends queued frames until subscriber disconnects or is too slow to
+// take one in a second
+func (s *subscriber) write() {
+	for {
+		select {
+		case frame := <-s.queue:
+			s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := s.conn.Write(frame); err != nil {
+				log.Printf("Failed to write to subscriber %v: %v", s.conn.RemoteAddr(), err)
+				s.conn.Close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/stretchr/testify/assert"
+)
+
+func testHub(t *testing.T, queueSize int) (*Hub, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	hub := NewHub(queueSize)
+	go hub.Serve(listener)
+	return hub, listener.Addr().String()
+}
+
+type testSubscriber struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func subscribe(t *testing.T, addr string, commands ...string) *testSubscriber {
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	s := &testSubscriber{conn: conn, r: bufio.NewReader(conn)}
+	for _, command := range commands {
+		assert.Equal(t, "+OK", s.send(t, command))
+	}
+	return s
+}
+
+// send sends command and returns answer to it
+func (s *testSubscriber) send(t *testing.T, command string) string {
+	fmt.Fprintf(s.conn, "%s\n", command)
+	return s.line(t)
+}
+
+func (s *testSubscriber) line(t *testing.T) string {
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := s.r.ReadString('\n')
+	assert.NoError(t, err)
+	return strings.TrimRight(line, "\r\n")
+}
+
+// message reads the next message and returns its topic and payload
+func (s *testSubscriber) message(t *testing.T) (string, string) {
+	var topic string
+	var size int
+	_, err := fmt.Sscanf(s.line(t), "MSG %s %d", &topic, &size)
+	assert.NoError(t, err)
+	payload := make([]byte, size+2)
+	_, err = io.ReadFull(s.r, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "\r\n", string(payload[size:]))
+	return topic, string(payload[:size])
+}
+
+func TestHub(t *testing.T) {
+	hub, addr := testHub(t, 100)
+
+	exact := subscribe(t, addr, "SUB test.ru")
+	defer exact.conn.Close()
+	wildcard := subscribe(t, addr, "sub *.test.ru", "SUB other.ru")
+	defer wildcard.conn.Close()
+	all := subscribe(t, addr, "SUB *", "SUB test.ru")
+	defer all.conn.Close()
+	assert.Equal(t, 3, hub.Subscribers())
+
+	assert.Equal(t, "PONG", exact.send(t, "PING"))
+	assert.Equal(t, "-ERR unknown command", exact.send(t, "PUB test.ru"))
+	assert.Equal(t, "-ERR unknown command", exact.send(t, "SUB"))
+	assert.Equal(t, "-ERR invalid pattern", exact.send(t, "SUB [test"))
+
+	hub.Publish("test.ru", []byte(`{"n":1}`))
+	hub.Publish("www.test.ru", []byte(`{"n":2}`))
+	hub.Publish("other.ru", []byte(`{"n":3}`))
+	hub.Publish("unknown.ru", []byte(`{"n":4}`))
+
+	topic, payload := exact.message(t)
+	assert.Equal(t, "test.ru", topic)
+	assert.Equal(t, `{"n":1}`, payload)
+
+	for _, expected := range []string{"www.test.ru", "other.ru"} {
+		topic, _ = wildcard.message(t)
+		assert.Equal(t, expected, topic)
+	}
+
+	// Message is sent once, even if several patterns match it
+	for _, expected := range []string{"test.ru", "www.test.ru", "other.ru", "unknown.ru"} {
+		topic, _ = all.message(t)
+		assert.Equal(t, expected, topic)
+	}
+
+	assert.Equal(t, "+OK", exact.send(t, "UNSUB test.ru"))
+	hub.Publish("test.ru", []byte(`{"n":5}`))
+	assert.Equal(t, "PONG", exact.send(t, "PING"))
+
+	all.conn.Close()
+	for i := 0; i < 100 && hub.Subscribers() > 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, hub.Subscribers())
+}
+
+func TestHubDropped(t *testing.T) {
+	hub := NewHub(1)
+	s := &subscriber{queue: make(chan []byte, 1), patterns: []string{"test.ru"}}
+	hub.subscribers[s] = struct{}{}
+
+	hub.Publish("test.ru", []byte("1"))
+	hub.Publish("test.ru", []byte("2"))
+	hub.Publish("other.ru", []byte("3"))
+	assert.EqualValues(t, 1, s.dropped)
+	assert.Equal(t, "MSG test.ru 1\r\n1\r\n", string(<-s.queue))
+}
+
+func TestFilter(t *testing.T) {
+	r := &pinba.Request{ServerName: "www.test.ru", ScriptName: "/api/users", RequestTime: 0.5}
+	assert.True(t, (&filter{}).Match(r))
+	assert.True(t, (&filter{server: regexp.MustCompile(`test\.ru$`), minTime: 0.5}).Match(r))
+	assert.False(t, (&filter{server: regexp.MustCompile(`^test\.ru$`)}).Match(r))
+	assert.False(t, (&filter{script: regexp.MustCompile(`^/admin/`)}).Match(r))
+	assert.False(t, (&filter{minTime: 1}).Match(r))
+
+	assert.Equal(t, "www.test.ru", topic(r))
+	assert.Equal(t, "_", topic(&pinba.Request{}))
+	assert.Equal(t, "bad_name", topic(&pinba.Request{ServerName: "bad name"}))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+)
+
+// filter selects requests, that are published
+type filter struct {
+	server  *regexp.Regexp
+	script  *regexp.Regexp
+	minTime float32
+}
+
+// Match returns true if request should be published
+func (f *filter) Match(r *pinba.Request) bool {
+	if f.server != nil && !f.server.MatchString(r.ServerName) {
+		return false
+	}
+	if f.script != nil && !f.script.MatchString(r.ScriptName) {
+		return false
+	}
+	return r.RequestTime >= f.minTime
+}
+
+// topic returns topic of request, that is its server name, it can't be empty
+// or have spaces
+func topic(r *pinba.Request) string {
+	if r.ServerName == "" {
+		return "_"
+	}
+	return strings.Map(func(c rune) rune {
+		if c <= ' ' {
+			return '_'
+		}
+		return c
+	}, r.ServerName)
+}
+
+func main() {
+	var (
+		inAddr  = flag.String("in", "", "collector address to read requests from")
+		outAddr = flag.String("out", "", "address for subscribers to connect to")
+		queue   = flag.Int("queue", 10000, "messages queued for every subscriber")
+		server  = flag.String("server", "", "publish only requests with server name matching regexp")
+		script  = flag.String("script", "", "publish only requests with script name matching regexp")
+		minTime = flag.Float64("min-time", 0, "publish only requests slower than this, in seconds")
+	)
+	flag.Parse()
+
+	f := &filter{minTime: float32(*minTime)}
+	var err error
+	if *server != "" {
+		if f.server, err = regexp.Compile(*server); err != nil {
+			log.Fatalf("Invalid server regexp: %v", err)
+		}
+	}
+	if *script != "" {
+		if f.script, err = regexp.Compile(*script); err != nil {
+			log.Fatalf("Invalid script regexp: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", *outAddr)
+	if err != nil {
+		log.Fatalf("Can't listen for subscribers: %v", err)
+	}
+	hub := NewHub(*queue)
+	go func() {
+		log.Fatalf("Stopped accepting subscribers: %v", hub.Serve(listener))
+	}()
+
+	pinba, err := client.New(*inAddr, 5*time.Second, 5*time.Second)
+	if err != nil {
+		log.Fatalf("Failed to create pinba client: %v", err)
+	}
+	go pinba.Listen(1)
+	log.Printf("Decoding requests from %s for subscribers at %s\n", *inAddr, *outAddr)
+
+	for requests := range pinba.Requests {
+		if hub.Subscribers() == 0 {
+			continue
+		}
+		t := time.Now()
+		published := 0
+		for _, r := range requests.Requests {
+			if !f.Match(r) {
+				continue
+			}
+			payload, err := json.Marshal(client.NewRecord(requests.Timestamp, r))
+			if err != nil {
+				log.Printf("Failed to encode request: %v", err)
+				continue
+			}
+			hub.Publish(topic(r), payload)
+			published++
+		}
+		d := time.Since(t)
+		log.Printf("[%d] Published %v of %v requests to %v subscribers in %v", requests.Timestamp,
+			published, len(requests.Requests), hub.Subscribers(), d-d%time.Millisecond)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/olegfedoseev/pinba"
+)
+
+// Columnar format stores every interval as block of columns, so readers can
+// skip columns they don't need, and values of one column compress better.
+// Integers are unsigned varints (timestamp is signed one) and floats are
+// float32 little endian. Block is:
+//
+//	magic "PCOL" and version byte 1
+//	timestamp of interval and number of rows
+//	dictionary: number of strings, then length and bytes of every string
+//	number of columns, then for every column length and bytes of its name,
+//	length of its data and data
+//
+// Strings in columns are indexes in dictionary. Columns with value per row:
+//
+//	hostname, server_name, script_name: strings
+//	status, request_count, document_size, memory_peak: integers
+//	request_time, ru_utime, ru_stime: floats
+//	tags: number of tags, then key and value of every tag
+//	timers: number of timers, then hit_count, value, ru_utime, ru_stime and
+//	tags (as above) of every timer
+//
+// Readers should ignore unknown columns and use zero values for missing ones
+var columnarMagic = []byte("PCOL\x01")
+
+// column is data of one column being encoded
+type column struct {
+	bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (c *column) uint(v uint64) {
+	n := binary.PutUvarint(c.tmp[:], v)
+	c.Write(c.tmp[:n])
+}
+
+func (c *column) float(v float32) {
+	binary.LittleEndian.PutUint32(c.tmp[:4], math.Float32bits(v))
+	c.Write(c.tmp[:4])
+}
+
+// dictionary keeps unique strings of block in order of appearance
+type dictionary struct {
+	index   map[string]uint64
+	strings []string
+}
+
+func (d *dictionary) add(s string) uint64 {
+	i, ok := d.index[s]
+	if !ok {
+		i = uint64(len(d.strings))
+		d.index[s] = i
+		d.strings = append(d.strings, s)
+	}
+	return i
+}
+
+var columnNames = []string{
+	"hostname", "server_name", "script_name",
+	"status", "request_count", "document_size", "memory_peak",
+	"request_time", "ru_utime", "ru_stime",
+	"tags", "timers",
+}
+
+func writeColumnar(w io.Writer, ts int64, requests []*pinba.Request) error {
+	dict := &dictionary{index: make(map[string]uint64)}
+	columns := make(map[string]*column, len(columnNames))
+	for _, name := range columnNames {
+		columns[name] = &column{}
+	}
+	tags := func(c *column, tags pinba.Tags) {
+		c.uint(uint64(len(tags)))
+		for _, tag := range tags {
+			c.uint(dict.add(tag.Key))
+			c.uint(dict.add(tag.Value))
+		}
+	}
+
+	for _, r := range requests {
+		columns["hostname"].uint(dict.add(r.Hostname))
+		columns["server_name"].uint(dict.add(r.ServerName))
+		columns["script_name"].uint(dict.add(r.ScriptName))
+		columns["status"].uint(uint64(r.Status))
+		columns["request_count"].uint(uint64(r.RequestCount))
+		columns["document_size"].uint(uint64(r.DocumentSize))
+		columns["memory_peak"].uint(uint64(r.MemoryPeak))
+		columns["request_time"].float(r.RequestTime)
+		columns["ru_utime"].float(r.RuUtime)
+		columns["ru_stime"].float(r.RuStime)
+		tags(columns["tags"], r.Tags)
+
+		timers := columns["timers"]
+		timers.uint(uint64(len(r.Timers)))
+		for _, timer := range r.Timers {
+			timers.uint(uint64(timer.HitCount))
+			timers.float(timer.Value)
+			timers.float(timer.RuUtime)
+			timers.float(timer.RuStime)
+			tags(timers, timer.Tags)
+		}
+	}
+
+	header := &column{}
+	header.Write(columnarMagic)
+	n := binary.PutVarint(header.tmp[:], ts)
+	header.Write(header.tmp[:n])
+	header.uint(uint64(len(requests)))
+	header.uint(uint64(len(dict.strings)))
+	for _, s := range dict.strings {
+		header.uint(uint64(len(s)))
+		header.WriteString(s)
+	}
+	header.uint(uint64(len(columnNames)))
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	for _, name := range columnNames {
+		prefix := &column{}
+		prefix.uint(uint64(len(name)))
+		prefix.WriteString(name)
+		prefix.uint(uint64(columns[name].Len()))
+		if _, err := w.Write(prefix.Bytes()); err != nil {
+			return err
+		}
+		if _, err := w.Write(columns[name].Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ColumnarReader reads blocks of columnar format
+type ColumnarReader struct {
+	r *bufio.Reader
+}
+
+// NewColumnarReader creates reader of blocks from r, which should be
+// decompressed already
+func NewColumnarReader(r io.Reader) *ColumnarReader {
+	return &ColumnarReader{r: bufio.NewReader(r)}
+}
+
+var errCorrupted = errors.New("corrupted columnar block")
+
+// Limits of block, lengths and counts over them are treated as corruption,
+// so broken block can't make reader allocate all memory
+const (
+	// maxColumnarBytes is limit of length of string or column data
+	maxColumnarBytes = 256 << 20
+	// maxColumnarCount is limit of number of rows, strings or columns
+	maxColumnarCount = 1 << 24
+)
+
+// Read returns timestamp and requests of the next block, or io.EOF if there
+// is no more blocks
+func (c *ColumnarReader) Read() (int64, []*pinba.Request, error) {
+	magic := make([]byte, len(columnarMagic))
+	if _, err := io.ReadFull(c.r, magic); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorrupted
+		}
+		return 0, nil, err
+	}
+	if !bytes.Equal(magic, columnarMagic) {
+		return 0, nil, fmt.Errorf("unknown columnar block %q", magic)
+	}
+
+	ts, err := binary.ReadVarint(c.r)
+	if err != nil {
+		return 0, nil, errCorrupted
+	}
+	rows, err := c.count()
+	if err != nil {
+		return 0, nil, err
+	}
+	size, err := c.count()
+	if err != nil {
+		return 0, nil, err
+	}
+	dict := make([]string, 0)
+	for i := uint64(0); i < size; i++ {
+		s, err := c.bytes()
+		if err != nil {
+			return 0, nil, err
+		}
+		dict = append(dict, string(s))
+	}
+
+	n, err := c.count()
+	if err != nil {
+		return 0, nil, err
+	}
+	columns := make(map[string]*columnReader, n)
+	for i := uint64(0); i < n; i++ {
+		name, err := c.bytes()
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err := c.bytes()
+		if err != nil {
+			return 0, nil, err
+		}
+		columns[string(name)] = &columnReader{r: bytes.NewReader(data), dict: dict}
+	}
+
+	requests := make([]*pinba.Request, 0)
+	for i := uint64(0); i < rows; i++ {
+		r := &pinba.Request{
+			Hostname:     columns["hostname"].string(),
+			ServerName:   columns["server_name"].string(),
+			ScriptName:   columns["script_name"].string(),
+			Status:       uint32(columns["status"].uint()),
+			RequestCount: uint32(columns["request_count"].uint()),
+			DocumentSize: uint32(columns["document_size"].uint()),
+			MemoryPeak:   uint32(columns["memory_peak"].uint()),
+			RequestTime:  columns["request_time"].float(),
+			RuUtime:      columns["ru_utime"].float(),
+			RuStime:      columns["ru_stime"].float(),
+			Tags:         columns["tags"].tags(),
+		}
+		timers := columns["timers"]
+		for j := timers.uint(); j > 0 && timers.err == nil; j-- {
+			r.Timers = append(r.Timers, pinba.Timer{
+				HitCount: int(timers.uint()),
+				Value:    timers.float(),
+				RuUtime:  timers.float(),
+				RuStime:  timers.float(),
+				Tags:     timers.tags(),
+			})
+		}
+		for _, column := range columns {
+			if column.err != nil {
+				return 0, nil, column.err
+			}
+		}
+		requests = append(requests, r)
+	}
+	return ts, requests, nil
+}
+
+func (c *ColumnarReader) uint() (uint64, error) {
+	v, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return 0, errCorrupted
+	}
+	return v, nil
+}
+
+// count reads number of rows, strings or columns
+func (c *ColumnarReader) count() (uint64, error) {
+	n, err := c.uint()
+	if err != nil {
+		return 0, err
+	}
+	if n > maxColumnarCount {
+		return 0, errCorrupted
+	}
+	return n, nil
+}
+
+// bytes reads length and data of string or column. Buffer grows as data is
+// read, so it's not allocated for length of truncated block
+func (c *ColumnarReader) bytes() ([]byte, error) {
+	n, err := c.uint()
+	if err != nil {
+		return nil, err
+	}
+	if n > maxColumnarBytes {
+		return nil, errCorrupted
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(c.r, int64(n)))
+	if err != nil || uint64(len(data)) != n {
+		return nil, errCorrupted
+	}
+	return data, nil
+}
+
+// columnReader decodes values of one column, it remembers the first error
+// and returns zero values after it. Methods of nil reader (missing column)
+// return zero values
+type columnReader struct {
+	r    *bytes.Reader
+	dict []string
+	err  error
+}
+
+func (c *columnReader) uint() uint64 {
+	if c == nil || c.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		c.err = errCorrupted
+	}
+	return v
+}
+
+func (c *columnReader) float() float32 {
+	if c == nil || c.err != nil {
+		return 0
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(c.r, buf[:]); err != nil {
+		c.err = errCorrupted
+		return 0
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(buf[:]))
+}
+
+func (c *columnReader) string() string {
+	i := c.uint()
+	if c == nil || c.err != nil {
+		return ""
+	}
+	if i >= uint64(len(c.dict)) {
+		c.err = errCorrupted
+		return ""
+	}
+	return c.dict[i]
+}
+
+func (c *columnReader) tags() pinba.Tags {
+	n := c.uint()
+	if c == nil || c.err != nil || n == 0 {
+		return nil
+	}
+	tags := make(pinba.Tags, 0)
+	for i := uint64(0); i < n && c.err == nil; i++ {
+		tags = append(tags, pinba.Tag{Key: c.string(), Value: c.string()})
+	}
+	return tags
+}
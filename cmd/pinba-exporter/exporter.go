@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+)
+
+// Formats of exported files and their extensions
+var formats = map[string]struct {
+	ext    string
+	encode func(w io.Writer, ts int64, requests []*pinba.Request) error
+}{
+	"jsonl":    {".jsonl.gz", writeJSONLines},
+	"columnar": {".pcol.gz", writeColumnar},
+}
+
+// Exporter writes requests to gzipped files in directory, one per hour of
+// their timestamps, like "requests-2017111315.jsonl.gz". Files of the same
+// hour are appended, when exporter is restarted, as gzip allows
+type Exporter struct {
+	dir    string
+	ext    string
+	encode func(w io.Writer, ts int64, requests []*pinba.Request) error
+
+	// current file and start of its hour
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+	hour int64
+}
+
+// NewExporter creates exporter of requests to dir in given format
+func NewExporter(dir, format string) (*Exporter, error) {
+	f, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q, should be jsonl or columnar", format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Exporter{dir: dir, ext: f.ext, encode: f.encode}, nil
+}
+
+// Write writes requests of one interval to file of their hour and flushes
+// it, so file is readable up to the last complete interval
+func (e *Exporter) Write(requests *client.PinbaRequests) error {
+	hour := requests.Timestamp - requests.Timestamp%3600
+	if e.file == nil || hour != e.hour {
+		if err := e.Close(); err != nil {
+			return err
+		}
+		if err := e.open(hour); err != nil {
+			return err
+		}
+	}
+
+	if err := e.encode(e.buf, requests.Timestamp, requests.Requests); err != nil {
+		return err
+	}
+	if err := e.buf.Flush(); err != nil {
+		return err
+	}
+	return e.gz.Flush()
+}
+
+// Filename returns name of file for hour starting at given timestamp
+func (e *Exporter) Filename(hour int64) string {
+	name := "requests-" + time.Unix(hour, 0).UTC().Format("2006010215") + e.ext
+	return filepath.Join(e.dir, name)
+}
+
+func (e *Exporter) open(hour int64) error {
+	file, err := os.OpenFile(e.Filename(hour), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	e.file = file
+	e.gz = gzip.NewWriter(file)
+	e.buf = bufio.NewWriterSize(e.gz, 64<<10)
+	e.hour = hour
+	return nil
+}
+
+// Close finishes current file
+func (e *Exporter) Close() error {
+	if e.file == nil {
+		return nil
+	}
+	err := e.buf.Flush()
+	if cerr := e.gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := e.file.Close(); err == nil {
+		err = cerr
+	}
+	e.file, e.gz, e.buf = nil, nil, nil
+	return err
+}
+
+func writeJSONLines(w io.Writer, ts int64, requests []*pinba.Request) error {
+	encoder := json.NewEncoder(w)
+	for _, r := range requests {
+		// Encode adds newline after every value
+		if err := encoder.Encode(client.NewRecord(ts, r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
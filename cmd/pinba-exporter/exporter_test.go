@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/olegfedoseev/pinba"
+	"github.com/olegfedoseev/pinba-server/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRequests(ts int64) *client.PinbaRequests {
+	return &client.PinbaRequests{
+		Timestamp: ts,
+		Span:      10,
+		Requests: []*pinba.Request{
+			{
+				Hostname: "web1", ServerName: "test.ru", ScriptName: "/index.php",
+				Status: 200, RequestCount: 1, DocumentSize: 1024, MemoryPeak: 2 << 20,
+				RequestTime: 0.25, RuUtime: 0.1, RuStime: 0.01,
+				Tags: pinba.Tags{{Key: "server", Value: "test.ru"}, {Key: "script", Value: "/index.php"}},
+				Timers: []pinba.Timer{
+					{HitCount: 2, Value: 0.1, Tags: pinba.Tags{{Key: "group", Value: "db"}, {Key: "op", Value: "select"}}},
+					{HitCount: 1, Value: 0.05, RuUtime: 0.01, Tags: pinba.Tags{{Key: "group", Value: "cache"}}},
+				},
+			},
+			{Hostname: "web2", ServerName: "test.ru", ScriptName: "/api.php", Status: 500, RequestTime: 1.5},
+		},
+	}
+}
+
+func readGzip(t *testing.T, filename string) []byte {
+	f, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestExporterJSONLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exporter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e, err := NewExporter(dir, "jsonl")
+	assert.NoError(t, err)
+	// 1500000000 is 2017-07-14 02:40:00 UTC, next hour starts at 1500001200
+	assert.NoError(t, e.Write(testRequests(1500000000)))
+	assert.NoError(t, e.Write(testRequests(1500000010)))
+	assert.NoError(t, e.Write(testRequests(1500001200)))
+	assert.NoError(t, e.Close())
+
+	// Restart appends to file of the same hour
+	e, err = NewExporter(dir, "jsonl")
+	assert.NoError(t, err)
+	assert.NoError(t, e.Write(testRequests(1500001210)))
+	assert.NoError(t, e.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "requests-2017071402.jsonl.gz"),
+		filepath.Join(dir, "requests-2017071403.jsonl.gz"),
+	}, files)
+
+	var records []client.Record
+	scanner := bufio.NewScanner(bytes.NewReader(readGzip(t, files[0])))
+	for scanner.Scan() {
+		var r client.Record
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	assert.Len(t, records, 4)
+	assert.EqualValues(t, 1500000010, records[2].Timestamp)
+	assert.Equal(t, "/index.php", records[0].ScriptName)
+	assert.Equal(t, map[string]string{"server": "test.ru", "script": "/index.php"}, records[0].Tags)
+	assert.Equal(t, client.RecordTimer{HitCount: 2, Value: 0.1, Tags: map[string]string{"group": "db", "op": "select"}},
+		records[0].Timers[0])
+	assert.Empty(t, records[1].Timers)
+
+	assert.Equal(t, 4, bytes.Count(readGzip(t, files[1]), []byte("\n")))
+
+	_, err = NewExporter(dir, "parquet")
+	assert.Error(t, err)
+}
+
+func TestExporterColumnar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exporter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e, err := NewExporter(dir, "columnar")
+	assert.NoError(t, err)
+	assert.NoError(t, e.Write(testRequests(1500000000)))
+	assert.NoError(t, e.Write(testRequests(1500000010)))
+	assert.NoError(t, e.Close())
+
+	r := NewColumnarReader(bytes.NewReader(readGzip(t, e.Filename(1499997600))))
+	for _, ts := range []int64{1500000000, 1500000010} {
+		blockTs, requests, err := r.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, ts, blockTs)
+		assert.Equal(t, testRequests(ts).Requests, requests)
+	}
+	_, _, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestColumnarCorrupted(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeColumnar(&buf, 1500000000, testRequests(1500000000).Requests))
+	data := buf.Bytes()
+
+	// Truncated block
+	_, _, err := NewColumnarReader(bytes.NewReader(data[:len(data)-3])).Read()
+	assert.Equal(t, errCorrupted, err)
+
+	_, _, err = NewColumnarReader(bytes.NewReader([]byte("PARQUET"))).Read()
+	assert.Error(t, err)
+
+	// Huge length of string and number of rows
+	for _, header := range [][]byte{
+		{0xc0, 0xc4, 0x07, 0x01, 0x01, 0xff, 0xff, 0xff, 0xff, 0x0f, 'a'},
+		{0xc0, 0xc4, 0x07, 0xff, 0xff, 0xff, 0xff, 0x0f, 0x00, 0x00},
+	} {
+		_, _, err = NewColumnarReader(bytes.NewReader(append([]byte("PCOL\x01"), header...))).Read()
+		assert.Equal(t, errCorrupted, err)
+	}
+
+	// Empty block
+	buf.Reset()
+	assert.NoError(t, writeColumnar(&buf, 1500000000, nil))
+	ts, requests, err := NewColumnarReader(&buf).Read()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1500000000, ts)
+	assert.Empty(t, requests)
+}
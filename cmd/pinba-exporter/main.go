@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/olegfedoseev/pinba-server/client"
+)
+
+func main() {
+	var (
+		inAddr   = flag.String("in", "", "collector address to read requests from")
+		dir      = flag.String("dir", ".", "directory for hourly files of requests")
+		format   = flag.String("format", "jsonl", "format of files: jsonl or columnar")
+		interval = flag.Int64("interval", 10, "seconds of requests written at once")
+	)
+	flag.Parse()
+
+	exporter, err := NewExporter(*dir, *format)
+	if err != nil {
+		log.Fatalf("Failed to create exporter: %v", err)
+	}
+
+	pinba, err := client.New(*inAddr, 5*time.Second, 5*time.Second)
+	if err != nil {
+		log.Fatalf("Failed to create pinba client: %v", err)
+	}
+	go pinba.Listen(*interval)
+	log.Printf("Exporting requests from %s to %s as %s\n", *inAddr, *dir, *format)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case requests := <-pinba.Requests:
+			if len(requests.Requests) == 0 {
+				// Collector was idle, there is nothing to export
+				continue
+			}
+			t := time.Now()
+			if err := exporter.Write(requests); err != nil {
+				log.Printf("[ERROR][%d] Failed to export %v requests: %v",
+					requests.Timestamp, len(requests.Requests), err)
+				continue
+			}
+			d := time.Since(t)
+			log.Printf("[INFO][%d] Exported %v requests in %v",
+				requests.Timestamp, len(requests.Requests), d-d%time.Millisecond)
+
+		case <-signals:
+			// Complete gzip stream of the last file
+			if err := exporter.Close(); err != nil {
+				log.Fatalf("Failed to close exporter: %v", err)
+			}
+			return
+		}
+	}
+}